@@ -0,0 +1,85 @@
+# Stdout callback used by the deployer backend: one JSON object per line
+# (play start, task result, recap) so that each task can be stored as a
+# structured deployment log entry.
+from __future__ import absolute_import, division, print_function
+__metaclass__ = type
+
+DOCUMENTATION = '''
+    name: deployer_json
+    type: stdout
+    short_description: JSON lines output for proxmox-game-deployer
+    description:
+      - Prints one JSON object per event (play_start, task_result, stats).
+'''
+
+import json
+import sys
+import time
+
+from ansible.plugins.callback import CallbackBase
+
+
+class CallbackModule(CallbackBase):
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = 'stdout'
+    CALLBACK_NAME = 'deployer_json'
+
+    def __init__(self):
+        super(CallbackModule, self).__init__()
+        self._play = ''
+        self._task_start = {}
+
+    def _emit(self, event):
+        sys.stdout.write(json.dumps(event, default=str) + '\n')
+        sys.stdout.flush()
+
+    def v2_playbook_on_play_start(self, play):
+        self._play = play.get_name().strip()
+        self._emit({'event': 'play_start', 'play': self._play})
+
+    def v2_playbook_on_task_start(self, task, is_conditional):
+        self._task_start[task._uuid] = time.time()
+
+    def v2_playbook_on_handler_task_start(self, task):
+        self._task_start[task._uuid] = time.time()
+
+    def _result(self, result, status):
+        task = result._task
+        res = result._result or {}
+        start = self._task_start.get(task._uuid)
+        duration_ms = int((time.time() - start) * 1000) if start else 0
+        msg = res.get('msg') or ''
+        if status in ('failed', 'unreachable'):
+            stderr = (res.get('stderr') or '').strip()
+            if stderr:
+                msg = (msg + '\n' + stderr[-2000:]).strip()
+        if status == 'skipped' and not msg:
+            msg = res.get('skip_reason') or ''
+        self._emit({
+            'event': 'task_result',
+            'play': self._play,
+            'task': task.get_name().strip(),
+            'host': result._host.get_name(),
+            'status': status,
+            'duration_ms': duration_ms,
+            'msg': msg if isinstance(msg, str) else json.dumps(msg, default=str),
+            'ignore_errors': bool(task.ignore_errors),
+        })
+
+    def v2_runner_on_ok(self, result):
+        self._result(result, 'changed' if result._result.get('changed') else 'ok')
+
+    def v2_runner_on_failed(self, result, ignore_errors=False):
+        self._result(result, 'failed')
+
+    def v2_runner_on_skipped(self, result):
+        self._result(result, 'skipped')
+
+    def v2_runner_on_unreachable(self, result):
+        self._result(result, 'unreachable')
+
+    def v2_playbook_on_stats(self, stats):
+        hosts = {}
+        for h in sorted(stats.processed.keys()):
+            hosts[h] = stats.summarize(h)
+        self._emit({'event': 'stats', 'hosts': hosts})
@@ -3,10 +3,13 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -40,16 +43,14 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to init server: %v", err)
 	}
-	defer srv.Close()
 
 	// Start background worker for jobs.
 	worker := deploy.NewWorker(srv.DB)
+	srv.Worker = worker
 	worker.Start()
-	defer worker.Stop()
 
-	// Graceful shutdown handling.
 	go func() {
-		if err := srv.ListenAndServe(addr); err != nil {
+		if err := srv.ListenAndServe(addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("http server stopped: %v", err)
 		}
 	}()
@@ -64,9 +65,45 @@ func main() {
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
 
-	log.Printf("shutting down...")
-	// allow background goroutines a bit of time to finish
-	time.Sleep(2 * time.Second)
+	// Arrêt propre : le worker termine l'étape en cours de chaque job (qui
+	// repasse en file d'attente), puis le serveur HTTP draine ses requêtes.
+	// Un second signal force l'arrêt immédiat.
+	timeout := shutdownTimeout()
+	log.Printf("shutting down (timeout %s)...", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		<-sigCh
+		log.Printf("second signal received, forcing shutdown")
+		cancel()
+	}()
+
+	if err := worker.Shutdown(shutdownCtx); err != nil {
+		log.Printf("worker shutdown: %v (interrupted jobs were re-queued)", err)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("http shutdown: %v", err)
+	}
+	if err := srv.Close(); err != nil {
+		log.Printf("close database: %v", err)
+	}
+	log.Printf("shutdown complete")
+}
+
+// shutdownTimeout reads APP_SHUTDOWN_TIMEOUT (Go duration or seconds,
+// default 60s).
+func shutdownTimeout() time.Duration {
+	v := strings.TrimSpace(os.Getenv("APP_SHUTDOWN_TIMEOUT"))
+	if v == "" {
+		return 60 * time.Second
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return d
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 60 * time.Second
 }
 
 func getenv(key, def string) string {
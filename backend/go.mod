@@ -11,4 +11,4 @@ require (
 	golang.org/x/crypto v0.23.0
 )
 
-require github.com/gorcon/rcon v1.4.0 // indirect
+require github.com/gorcon/rcon v1.4.0
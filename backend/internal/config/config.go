@@ -26,6 +26,11 @@ type ProxmoxConfig struct {
 	APIURL          string   `json:"api_url"`
 	APITokenID      string   `json:"api_token_id"`
 	APITokenSecret  string   `json:"api_token_secret"`
+	// AuthMode is "token" (default, APITokenID/APITokenSecret) or "ticket"
+	// (Username/Password of a realm user, e.g. "deployer@pve").
+	AuthMode string `json:"auth_mode,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
 	DefaultNode     string   `json:"default_node"`
 	DefaultStorage  string   `json:"default_storage"`
 	DefaultBridge   string   `json:"default_bridge"`
@@ -33,10 +38,50 @@ type ProxmoxConfig struct {
 	SSHUser         string   `json:"ssh_user"`
 	SSHPublicKey    string   `json:"ssh_public_key"`
 	AllowedNodes    []string `json:"allowed_nodes"`
-	CloudInitConfig string   `json:"cloud_init_config,omitempty"`
+	// CloudInitConfig is an optional cloud-init user-data template (Go
+	// text/template, see deploy.CloudInitData) rendered per deployment and
+	// uploaded as a snippet on SnippetStorage (default "local", or
+	// APP_SNIPPET_STORAGE) referenced by cicustom.
+	CloudInitConfig string `json:"cloud_init_config,omitempty"`
+	SnippetStorage  string `json:"snippet_storage,omitempty"`
+	// FailureCleanup is what happens to the VM of a failed deployment:
+	// "destroy" (default), "keep" or "stop".
+	FailureCleanup string `json:"failure_cleanup,omitempty"`
+	// Provisioner installs the game server on new VMs: "ansible" (default)
+	// or "ssh-script". A deployment may override it.
+	Provisioner string `json:"provisioner,omitempty"`
+	// APITimeoutSeconds bounds each Proxmox API call and APIRetries is how
+	// many times idempotent calls are retried; 0 falls back to
+	// APP_PROXMOX_TIMEOUT / APP_PROXMOX_RETRIES.
+	APITimeoutSeconds int `json:"api_timeout_seconds,omitempty"`
+	APIRetries        int `json:"api_retries,omitempty"`
+	// PlacementStrategy chooses the node of deployments without node among
+	// AllowedNodes: "spread" (default), "pack" or "round-robin".
+	PlacementStrategy string `json:"placement_strategy,omitempty"`
+	// AutoSnapshot takes a Proxmox snapshot of the server VM before risky
+	// operations (version migration, spec changes). APP_AUTO_SNAPSHOT=true
+	// also enables it.
+	AutoSnapshot bool `json:"auto_snapshot,omitempty"`
+	// LXCTemplate is the default OS template (vztmpl volid, e.g.
+	// "local:vztmpl/debian-12-standard_12.7-1_amd64.tar.zst") of
+	// deployments with guest_type "lxc".
+	LXCTemplate string `json:"lxc_template,omitempty"`
+	// NetworkMode is the default network mode of deployments: "pool"
+	// (static IP from APP_NET_CIDR), "static" or "dhcp" (APP_NETWORK_MODE
+	// when unset). DHCPLeasesFile (or APP_DHCP_LEASES_FILE), a dnsmasq or
+	// ISC dhcpd leases file readable by the app, is searched by MAC for the
+	// address of DHCP guests without guest agent.
+	NetworkMode    string `json:"network_mode,omitempty"`
+	DHCPLeasesFile string `json:"dhcp_leases_file,omitempty"`
 	CreatedAt       string   `json:"created_at"`
 }
 
+// Authentication modes of ProxmoxConfig.AuthMode.
+const (
+	AuthModeToken  = "token"
+	AuthModeTicket = "ticket"
+)
+
 // IsInitialized reports whether the application has completed the setup wizard.
 func IsInitialized(ctx context.Context, db Store) (bool, error) {
 	row := db.QueryRowContext(ctx, `SELECT value FROM settings WHERE key = ?`, AppConfigKey)
@@ -93,6 +93,31 @@ func (d *DB) Migrate(ctx context.Context) error {
 			FOREIGN KEY(deployment_id) REFERENCES deployments(id) ON DELETE CASCADE
 		);`,
 		`CREATE INDEX IF NOT EXISTS idx_server_action_logs_deployment_ts ON server_action_logs(deployment_id, ts DESC);`,
+		// ip_pools: pools IPAM (sous-réseau, passerelle, plage allouable, adresses réservées)
+		`CREATE TABLE IF NOT EXISTS ip_pools (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			cidr TEXT NOT NULL,
+			gateway TEXT NOT NULL,
+			dns TEXT,
+			vlan INTEGER,
+			bridge TEXT,
+			range_start TEXT,
+			range_end TEXT,
+			reserved_json TEXT,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		);`,
+		// ip_allocations: une adresse par déploiement, libérée avec lui
+		`CREATE TABLE IF NOT EXISTS ip_allocations (
+			ip_address TEXT PRIMARY KEY,
+			pool_id INTEGER NOT NULL,
+			deployment_id INTEGER NOT NULL UNIQUE,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY(pool_id) REFERENCES ip_pools(id),
+			FOREIGN KEY(deployment_id) REFERENCES deployments(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_ip_allocations_pool ON ip_allocations(pool_id);`,
 	}
 
 	for i, stmt := range stmts {
@@ -101,10 +126,19 @@ func (d *DB) Migrate(ctx context.Context) error {
 		}
 	}
 
-	// Migrations pour bases existantes : ajout colonne role (users) et assigned_to_user_id (deployments).
+	// Migrations pour bases existantes : ajout de colonnes (users, deployments, ...).
 	alterStmts := []string{
 		`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user'`,
 		`ALTER TABLE deployments ADD COLUMN assigned_to_user_id INTEGER REFERENCES users(id)`,
+		// checkpoint : dernière étape terminée du pipeline (reprise après échec/redémarrage).
+		`ALTER TABLE deployments ADD COLUMN checkpoint TEXT`,
+		`ALTER TABLE deployments ADD COLUMN checkpoint_at DATETIME`,
+		// vm_node : node où se trouve la VM pendant le déploiement (clone pas encore migré).
+		`ALTER TABLE deployments ADD COLUMN vm_node TEXT`,
+		// lease_until : bail d'un job "running", renouvelé par le worker (heartbeat).
+		`ALTER TABLE jobs ADD COLUMN lease_until DATETIME`,
+		// data_json : données structurées d'une ligne de log (tâche Ansible...).
+		`ALTER TABLE deployment_logs ADD COLUMN data_json TEXT`,
 	}
 	for _, stmt := range alterStmts {
 		_, _ = d.ExecContext(ctx, stmt) // ignorer erreur si colonne déjà présente
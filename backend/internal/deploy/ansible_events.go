@@ -0,0 +1,152 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ansibleCallback is the stdout callback plugin shipped in
+// ansible/callback_plugins: it prints one JSON object per event.
+const ansibleCallback = "deployer_json"
+
+// AnsibleTask is the structured result of one Ansible task on one host,
+// stored in deployment_logs.data_json.
+type AnsibleTask struct {
+	Type       string `json:"type"` // toujours "ansible_task"
+	Play       string `json:"play,omitempty"`
+	Task       string `json:"task"`
+	Host       string `json:"host"`
+	Status     string `json:"status"` // ok, changed, failed, skipped, unreachable
+	DurationMS int64  `json:"duration_ms"`
+	Message    string `json:"message,omitempty"`
+	Ignored    bool   `json:"ignore_errors,omitempty"`
+}
+
+// ansibleEvent is a line printed by the deployer_json callback.
+type ansibleEvent struct {
+	Event        string                    `json:"event"`
+	Play         string                    `json:"play"`
+	Task         string                    `json:"task"`
+	Host         string                    `json:"host"`
+	Status       string                    `json:"status"`
+	DurationMS   int64                     `json:"duration_ms"`
+	Msg          string                    `json:"msg"`
+	IgnoreErrors bool                      `json:"ignore_errors"`
+	Hosts        map[string]map[string]int `json:"hosts"`
+}
+
+// ansibleLogEntry is one deployment log entry produced from Ansible output.
+type ansibleLogEntry struct {
+	Level   string
+	Message string
+	Task    *AnsibleTask // nil pour une ligne non structurée
+}
+
+// ansibleCallbackDir returns the directory holding the callback plugin
+// (APP_ANSIBLE_CALLBACK_DIR, default ./ansible/callback_plugins) or "" when
+// it is missing, in which case Ansible keeps its default output.
+func ansibleCallbackDir() string {
+	dir := os.Getenv("APP_ANSIBLE_CALLBACK_DIR")
+	if dir == "" {
+		dir = "./ansible/callback_plugins"
+	}
+	if _, err := os.Stat(filepath.Join(dir, ansibleCallback+".py")); err != nil {
+		return ""
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return dir
+}
+
+// parseAnsibleLine turns a line of Ansible output into a log entry. Lines
+// that are not callback events (warnings, default output) are kept as is.
+func parseAnsibleLine(level, line string) ansibleLogEntry {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "{") {
+		var ev ansibleEvent
+		if err := json.Unmarshal([]byte(trimmed), &ev); err == nil && ev.Event != "" {
+			if e, ok := ev.logEntry(); ok {
+				return e
+			}
+		}
+	}
+	return ansibleLogEntry{Level: ansibleLineLevel(level, line), Message: line}
+}
+
+func (ev ansibleEvent) logEntry() (ansibleLogEntry, bool) {
+	switch ev.Event {
+	case "play_start":
+		return ansibleLogEntry{Level: "info", Message: fmt.Sprintf("PLAY [%s]", ev.Play)}, true
+	case "task_result":
+		t := &AnsibleTask{
+			Type:       "ansible_task",
+			Play:       ev.Play,
+			Task:       ev.Task,
+			Host:       ev.Host,
+			Status:     ev.Status,
+			DurationMS: ev.DurationMS,
+			Message:    strings.TrimSpace(ev.Msg),
+			Ignored:    ev.IgnoreErrors,
+		}
+		level := "info"
+		msg := fmt.Sprintf("TASK [%s] %s: %s (%s)", t.Task, t.Host, t.Status, time.Duration(t.DurationMS)*time.Millisecond)
+		if t.Status == "failed" || t.Status == "unreachable" {
+			level = "error"
+			if t.Ignored {
+				level = "warn"
+				msg += " (ignored)"
+			}
+			if t.Message != "" {
+				msg += ": " + t.Message
+			}
+		}
+		return ansibleLogEntry{Level: level, Message: msg, Task: t}, true
+	case "stats":
+		hosts := make([]string, 0, len(ev.Hosts))
+		for h := range ev.Hosts {
+			hosts = append(hosts, h)
+		}
+		sort.Strings(hosts)
+		var parts []string
+		for _, h := range hosts {
+			s := ev.Hosts[h]
+			parts = append(parts, fmt.Sprintf("%s: ok=%d changed=%d failed=%d unreachable=%d skipped=%d",
+				h, s["ok"], s["changed"], s["failures"], s["unreachable"], s["skipped"]))
+		}
+		return ansibleLogEntry{Level: "info", Message: "PLAY RECAP " + strings.Join(parts, "; ")}, true
+	}
+	return ansibleLogEntry{}, false
+}
+
+// LoadAnsibleTasks returns the Ansible task results recorded for a
+// deployment, oldest first (all attempts included).
+func LoadAnsibleTasks(ctx context.Context, db Store, deploymentID int64) ([]AnsibleTask, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT data_json FROM deployment_logs
+		WHERE deployment_id = ? AND data_json IS NOT NULL
+		ORDER BY id ASC
+	`, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tasks []AnsibleTask
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var t AnsibleTask
+		if json.Unmarshal([]byte(raw), &t) == nil && t.Type == "ansible_task" {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks, rows.Err()
+}
@@ -0,0 +1,190 @@
+package deploy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+	"github.com/example/proxmox-game-deployer/internal/ipam"
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+)
+
+// CleanupPolicy tells what to do with a partially created VM when a
+// deployment fails for good.
+type CleanupPolicy string
+
+const (
+	// CleanupDestroy stops and deletes the VM, freeing its VMID, disk and IP.
+	CleanupDestroy CleanupPolicy = "destroy"
+	// CleanupKeep leaves the VM as is (useful for debugging).
+	CleanupKeep CleanupPolicy = "keep"
+	// CleanupStop stops the VM but keeps it on Proxmox.
+	CleanupStop CleanupPolicy = "stop"
+)
+
+// ParseCleanupPolicy validates a policy name; empty means "use the default".
+func ParseCleanupPolicy(s string) (CleanupPolicy, error) {
+	switch p := CleanupPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return "", nil
+	case CleanupDestroy, CleanupKeep, CleanupStop:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid cleanup policy %q (destroy, keep or stop)", s)
+	}
+}
+
+// cleanupPolicyFor resolves the policy for a deployment: request value first,
+// then the Proxmox settings, then APP_FAILED_VM_POLICY, defaulting to destroy.
+func cleanupPolicyFor(req MinecraftDeploymentRequest, cfg *config.ProxmoxConfig) CleanupPolicy {
+	cfgPolicy := ""
+	if cfg != nil {
+		cfgPolicy = cfg.FailureCleanup
+	}
+	for _, c := range []string{req.OnFailure, cfgPolicy, os.Getenv("APP_FAILED_VM_POLICY")} {
+		if p, err := ParseCleanupPolicy(c); err == nil && p != "" {
+			return p
+		}
+	}
+	return CleanupDestroy
+}
+
+// CleanupFailedDeployment applies the cleanup policy to the VM of a failed
+// deployment and records each step in deployment_logs. It is a no-op when no
+// VM was created.
+func CleanupFailedDeployment(ctx context.Context, db Store, job *Job, cfg *config.ProxmoxConfig) {
+	if job.DeploymentID == nil || cfg == nil {
+		return
+	}
+	deploymentID := *job.DeploymentID
+
+	var vmidNull sql.NullInt64
+	var checkpoint, vmNode sql.NullString
+	if err := db.QueryRowContext(ctx, `SELECT vmid, checkpoint, vm_node FROM deployments WHERE id = ?`, deploymentID).Scan(&vmidNull, &checkpoint, &vmNode); err != nil {
+		return
+	}
+	var req MinecraftDeploymentRequest
+	_ = json.Unmarshal([]byte(job.PayloadJSON), &req)
+	policy := cleanupPolicyFor(req, cfg)
+
+	// Sans VMID, aucune VM n'a pu être créée : on libère simplement l'IP.
+	if !vmidNull.Valid {
+		releaseDeploymentResources(ctx, db, deploymentID)
+		return
+	}
+	vmid := int(vmidNull.Int64)
+	// vm_node : la VM peut être restée sur le node du template (migration
+	// du clone échouée).
+	node := vmNode.String
+	if node == "" {
+		node = req.Node
+	}
+	if node == "" {
+		node = cfg.DefaultNode
+	}
+
+	cl, err := NewProxmoxClient(cfg)
+	if err != nil {
+		appendLog(ctx, db, deploymentID, "error", fmt.Sprintf("Cleanup: cannot create Proxmox client: %v", err))
+		return
+	}
+	c := cl.ForGuest(req.Guest())
+
+	// Avant StepCloned, le clone a pu être lancé puis échouer, expirer ou
+	// être annulé : la VM peut exister (ou être en cours de création). VMID
+	// et IP ne sont libérés qu'une fois l'absence de la VM confirmée.
+	if !Step(checkpoint.String).reached(StepCloned) {
+		found, err := locateOwnedGuest(ctx, c, vmid, req)
+		if err != nil {
+			appendLog(ctx, db, deploymentID, "error", fmt.Sprintf("Cleanup: cannot check whether VM %d exists (%v), VMID and IP kept", vmid, err))
+			return
+		}
+		if found == "" {
+			releaseDeploymentResources(ctx, db, deploymentID)
+			return
+		}
+		node = found
+		appendLog(ctx, db, deploymentID, "info", fmt.Sprintf("Cleanup: VM %d was created on node %s before the failure", vmid, node))
+	}
+
+	if policy == CleanupKeep {
+		appendLog(ctx, db, deploymentID, "info", fmt.Sprintf("Cleanup policy %q: VM %d kept on node %s for debugging", policy, vmid, node))
+		return
+	}
+
+	appendLog(ctx, db, deploymentID, "info", fmt.Sprintf("Cleanup policy %q: stopping VM %d", policy, vmid))
+	if cur, err := c.GetVMStatusCurrent(ctx, node, vmid); err == nil && cur.Status != "stopped" {
+		upid, err := c.StopVM(ctx, node, vmid)
+		if err == nil && upid != "" {
+			err = c.WaitForTask(ctx, node, upid, 5*time.Minute)
+		}
+		if err != nil {
+			appendLog(ctx, db, deploymentID, "error", fmt.Sprintf("Cleanup: stop VM %d failed: %v", vmid, err))
+			return
+		}
+	}
+	if policy == CleanupStop {
+		appendLog(ctx, db, deploymentID, "info", fmt.Sprintf("Cleanup: VM %d stopped and kept on node %s", vmid, node))
+		return
+	}
+
+	appendLog(ctx, db, deploymentID, "info", fmt.Sprintf("Cleanup: deleting VM %d", vmid))
+	upid, err := c.DeleteVM(ctx, node, vmid)
+	if err == nil && upid != "" {
+		err = c.WaitForTask(ctx, node, upid, 10*time.Minute)
+	}
+	if err != nil {
+		appendLog(ctx, db, deploymentID, "error", fmt.Sprintf("Cleanup: delete VM %d failed: %v", vmid, err))
+		return
+	}
+	releaseDeploymentResources(ctx, db, deploymentID)
+	appendLog(ctx, db, deploymentID, "info", fmt.Sprintf("Cleanup: VM %d deleted, VMID and IP released", vmid))
+	if req.Guest() == proxmox.GuestQEMU {
+		if err := RemoveUserData(ctx, c, cfg, node, deploymentID); err != nil {
+			appendLog(ctx, db, deploymentID, "warn", fmt.Sprintf("Cleanup: %v", err))
+		}
+	}
+}
+
+// locateOwnedGuest returns the node of guest vmid if it exists and belongs
+// to the deployment (named after req.Name or req.Hostname), "" if it does
+// not exist or is another guest that took the VMID.
+func locateOwnedGuest(ctx context.Context, c proxmox.API, vmid int, req MinecraftDeploymentRequest) (string, error) {
+	node, err := c.LocateVM(ctx, vmid)
+	if errors.Is(err, proxmox.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	vmCfg, err := c.GetVMConfig(ctx, node, vmid)
+	if errors.Is(err, proxmox.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, key := range []string{"name", "hostname"} {
+		if name, _ := vmCfg[key].(string); name != "" && (name == req.Name || name == req.Hostname) {
+			return node, nil
+		}
+	}
+	return "", nil
+}
+
+// releaseDeploymentResources forgets the VMID, IP (and its IPAM
+// allocation) and checkpoint of a deployment once its VM is gone, so they
+// can be reused and a re-run starts from scratch.
+func releaseDeploymentResources(ctx context.Context, db Store, deploymentID int64) {
+	_ = ipam.Release(ctx, db, deploymentID)
+	_, _ = db.ExecContext(ctx, `
+		UPDATE deployments SET vmid = NULL, vm_node = NULL, ip_address = NULL, checkpoint = NULL, checkpoint_at = NULL, updated_at = ?
+		WHERE id = ?
+	`, time.Now().UTC(), deploymentID)
+}
@@ -0,0 +1,265 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+	"github.com/example/proxmox-game-deployer/internal/sshexec"
+	"github.com/example/proxmox-game-deployer/internal/sshkeys"
+)
+
+// DefaultSnippetStorage holds the rendered cloud-init user-data when neither
+// the settings nor APP_SNIPPET_STORAGE choose a storage.
+const DefaultSnippetStorage = "local"
+
+// CloudInitData is what the cloud-init user-data template
+// (ProxmoxConfig.CloudInitConfig) is rendered with.
+type CloudInitData struct {
+	DeploymentID int64
+	Name         string
+	Hostname     string
+	FQDN         string
+	SearchDomain string
+	DNS          string
+	IPAddress    string
+	CIDR         int
+	Gateway      string
+	// User is the cloud-init user the application connects as over SSH.
+	User string
+	// SSHKeys are the public keys to authorize for User (the app key first).
+	SSHKeys          []string
+	Cores            int
+	MemoryMB         int
+	MinecraftType    string
+	MinecraftVersion string
+}
+
+// RenderCloudInit renders a user-data template. The rendered user-data
+// replaces the one Proxmox generates, so the template must create User with
+// SSHKeys itself, e.g.:
+//
+//	#cloud-config
+//	hostname: {{ .Hostname }}
+//	users:
+//	  - name: {{ .User }}
+//	    sudo: ALL=(ALL) NOPASSWD:ALL
+//	    ssh_authorized_keys:
+//	{{- range .SSHKeys }}
+//	      - {{ . }}
+//	{{- end }}
+//	packages: [openjdk-21-jre-headless]
+func RenderCloudInit(tmpl string, data CloudInitData) (string, error) {
+	t, err := template.New("cloud-init").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("cloud-init template: %w", err)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("cloud-init template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// ValidateCloudInitTemplate renders tmpl with sample data.
+func ValidateCloudInitTemplate(tmpl string) error {
+	_, err := RenderCloudInit(tmpl, CloudInitData{
+		DeploymentID: 1, Name: "mc", Hostname: "mc-1", FQDN: "mc-1", User: "ubuntu",
+		SSHKeys: []string{"ssh-ed25519 AAAA"}, Cores: 2, MemoryMB: 4096,
+	})
+	return err
+}
+
+// authorizedKeys returns the public keys installed on new guests: the
+// app-managed key, then the configured ssh_public_key (one per line).
+func authorizedKeys(cfg *config.ProxmoxConfig) string {
+	var keys []string
+	if k, err := sshkeys.PublicKey(); err == nil && k != "" {
+		keys = append(keys, k)
+	}
+	if cfg != nil {
+		for _, k := range strings.Split(cfg.SSHPublicKey, "\n") {
+			if k = strings.TrimSpace(k); k != "" && !containsString(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return strings.Join(keys, "\n")
+}
+
+// snippetStorageFor resolves the storage of cloud-init snippets: settings,
+// then APP_SNIPPET_STORAGE, defaulting to local.
+func snippetStorageFor(cfg *config.ProxmoxConfig) string {
+	for _, name := range []string{cfg.SnippetStorage, os.Getenv("APP_SNIPPET_STORAGE")} {
+		if strings.TrimSpace(name) != "" {
+			return strings.TrimSpace(name)
+		}
+	}
+	return DefaultSnippetStorage
+}
+
+// usesCloudInitTemplate reports whether the deployment gets custom
+// user-data (VMs only, containers have no cloud-init).
+func (p *pipeline) usesCloudInitTemplate() bool {
+	return p.req.Guest() == proxmox.GuestQEMU && strings.TrimSpace(p.cfg.CloudInitConfig) != ""
+}
+
+// applyCloudInit sets the hostname, DNS and SSH keys of the guest and, when
+// a user-data template is configured, uploads the rendered user-data as a
+// snippet referenced by cicustom. Idempotent: the snippet is overwritten.
+// Proxmox derives the hostname of a VM from its name, so the VM is only
+// renamed for a hostname chosen by the user; a generated one only reaches
+// the guest through the user-data template.
+func (p *pipeline) applyCloudInit(ctx context.Context) error {
+	req := p.req
+	opts := proxmox.CloudInitOptions{
+		Nameserver:   req.DNS,
+		SearchDomain: req.SearchDomain,
+		SSHKeys:      authorizedKeys(p.cfg),
+	}
+	if req.Hostname != "" && req.Hostname != req.Name && !req.AutoHostname {
+		opts.Hostname = req.Hostname
+	}
+	if p.usesCloudInitTemplate() {
+		volid, err := p.uploadUserData(ctx)
+		if err != nil {
+			p.log(ctx, "error", fmt.Sprintf("Cloud-init user-data: %v", err))
+			return err
+		}
+		opts.CICustom = "user=" + volid
+	}
+	p.log(ctx, "info", "Applying cloud-init settings (hostname, DNS, SSH keys)")
+	if err := p.client.SetCloudInit(ctx, req.Node, p.vmid, opts); err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Cloud-init settings failed: %v", err))
+		return err
+	}
+	return nil
+}
+
+// uploadUserData renders the user-data template and writes it on the
+// snippet storage of the deployment node (see locateSnippet). Returns the
+// volume ID of the snippet.
+func (p *pipeline) uploadUserData(ctx context.Context) (string, error) {
+	req := p.req
+	hostname := req.Hostname
+	if hostname == "" {
+		hostname = req.Name
+	}
+	fqdn := hostname
+	if req.SearchDomain != "" {
+		fqdn = hostname + "." + req.SearchDomain
+	}
+	user := p.cfg.SSHUser
+	if user == "" {
+		user = "ubuntu"
+	}
+	var keys []string
+	for _, k := range strings.Split(authorizedKeys(p.cfg), "\n") {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	userData, err := RenderCloudInit(p.cfg.CloudInitConfig, CloudInitData{
+		DeploymentID: p.deploymentID, Name: req.Name, Hostname: hostname, FQDN: fqdn,
+		SearchDomain: req.SearchDomain, DNS: req.DNS, IPAddress: req.IPAddress, CIDR: req.CIDR,
+		Gateway: req.Gateway, User: user, SSHKeys: keys, Cores: req.Cores, MemoryMB: req.MemoryMB,
+		MinecraftType: string(req.Minecraft.Type), MinecraftVersion: req.Minecraft.Version,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	storage := snippetStorageFor(p.cfg)
+	storages, err := p.client.ListStorages(ctx, req.Node)
+	if err != nil {
+		return "", err
+	}
+	ok := false
+	for _, st := range storages {
+		ok = ok || (st.Storage == storage && st.HasContent("snippets"))
+	}
+	if !ok {
+		return "", fmt.Errorf("storage %q on node %s does not hold snippets (enable the Snippets content type)", storage, req.Node)
+	}
+	sn, err := locateSnippet(ctx, p.client, p.cfg, req.Node, p.deploymentID)
+	if err != nil {
+		return "", err
+	}
+	cmd := fmt.Sprintf("mkdir -p %s && cat > %s", shellQuote(path.Dir(sn.file)), shellQuote(sn.file))
+	if err := sshexec.RunCommandWithStdin(ctx, sn.addr, sn.sshUser, sshexec.KeyPath(), cmd, strings.NewReader(userData)); err != nil {
+		return "", fmt.Errorf("writing snippet %s on %s@%s: %w", sn.file, sn.sshUser, sn.addr, err)
+	}
+	p.log(ctx, "info", fmt.Sprintf("Cloud-init user-data uploaded as %s", sn.volid))
+	return sn.volid, nil
+}
+
+// userDataSnippet is where the user-data of a deployment is written.
+type userDataSnippet struct {
+	volid   string // storage:snippets/deployer-<id>-user.yaml
+	file    string // chemin sur le node
+	addr    string
+	sshUser string
+}
+
+// locateSnippet resolves the user-data snippet of a deployment on node.
+// Proxmox cannot upload snippets through its API, so the file is written
+// over SSH (APP_PROXMOX_SSH_USER, default root, with the app key).
+func locateSnippet(ctx context.Context, api proxmox.API, cfg *config.ProxmoxConfig, node string, deploymentID int64) (*userDataSnippet, error) {
+	storage := snippetStorageFor(cfg)
+	dir, err := api.StoragePath(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := api.NodeAddress(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	sshUser := os.Getenv("APP_PROXMOX_SSH_USER")
+	if sshUser == "" {
+		sshUser = "root"
+	}
+	name := fmt.Sprintf("deployer-%d-user.yaml", deploymentID)
+	return &userDataSnippet{
+		volid:   storage + ":snippets/" + name,
+		file:    path.Join(dir, "snippets", name),
+		addr:    addr,
+		sshUser: sshUser,
+	}, nil
+}
+
+// RemoveUserData deletes the user-data snippet of a deployment from the
+// snippet storage of node, once its VM is gone. No-op without user-data
+// template (no snippet is written then).
+func RemoveUserData(ctx context.Context, api proxmox.API, cfg *config.ProxmoxConfig, node string, deploymentID int64) error {
+	if cfg == nil || strings.TrimSpace(cfg.CloudInitConfig) == "" {
+		return nil
+	}
+	sn, err := locateSnippet(ctx, api, cfg, node, deploymentID)
+	if err != nil {
+		return err
+	}
+	if _, stderr, err := sshexec.RunCommand(ctx, sn.addr, sn.sshUser, sshexec.KeyPath(), "rm -f "+shellQuote(sn.file)); err != nil {
+		return fmt.Errorf("removing snippet %s on %s@%s: %w: %s", sn.file, sn.sshUser, sn.addr, err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// waitCloudInit waits for cloud-init to finish its first boot (package
+// installation from the custom user-data) before provisioning. Failures
+// only log: the provisioners cope with a busy apt.
+func (p *pipeline) waitCloudInit(ctx context.Context, target ProvisionTarget) {
+	p.log(ctx, "info", "Waiting for cloud-init to finish")
+	wctx, cancel := context.WithTimeout(ctx, 20*time.Minute)
+	defer cancel()
+	_, stderr, err := sshexec.RunCommand(wctx, target.Host, target.SSHUser, sshexec.KeyPath(), "sudo cloud-init status --wait >/dev/null")
+	if err != nil {
+		p.log(ctx, "warn", fmt.Sprintf("cloud-init status: %v %s", err, strings.TrimSpace(stderr)))
+	}
+}
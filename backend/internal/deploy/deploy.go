@@ -1,21 +1,18 @@
 package deploy
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"math/big"
-	"net"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
-
 	"github.com/example/proxmox-game-deployer/internal/config"
 	"github.com/example/proxmox-game-deployer/internal/minecraft"
 	"github.com/example/proxmox-game-deployer/internal/proxmox"
@@ -24,10 +21,62 @@ import (
 // Store describes the DB operations required by the deploy package.
 type Store interface {
 	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
 	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
 	WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error
 }
 
+// NewProxmoxClient builds the Proxmox API client used by the pipeline and the
+// server handlers.
+func NewProxmoxClient(cfg *config.ProxmoxConfig) (proxmox.API, error) {
+	opts := proxmox.DefaultOptions()
+	if cfg.APITimeoutSeconds > 0 {
+		opts.Timeout = time.Duration(cfg.APITimeoutSeconds) * time.Second
+	}
+	if cfg.APIRetries > 0 {
+		opts.MaxRetries = cfg.APIRetries
+	}
+	switch cfg.AuthMode {
+	case config.AuthModeTicket:
+		return ticketClient(cfg.APIURL, cfg.Username, cfg.Password, opts)
+	case config.AuthModeToken, "":
+		return proxmox.NewClientWithOptions(cfg.APIURL, cfg.APITokenID, cfg.APITokenSecret, opts)
+	default:
+		return nil, fmt.Errorf("unknown proxmox auth_mode %q (token or ticket)", cfg.AuthMode)
+	}
+}
+
+// ticketClients caches the ticket clients per API URL and user: every
+// caller then shares one login, renewed before it expires, instead of
+// logging in again for each client.
+var ticketClients = struct {
+	sync.Mutex
+	m map[[2]string]*cachedTicketClient
+}{m: map[[2]string]*cachedTicketClient{}}
+
+type cachedTicketClient struct {
+	password string
+	opts     proxmox.Options
+	client   *proxmox.Client
+}
+
+// ticketClient returns the cached ticket client of (rawURL, username),
+// replaced when the password or the options changed in the settings.
+func ticketClient(rawURL, username, password string, opts proxmox.Options) (*proxmox.Client, error) {
+	key := [2]string{rawURL, username}
+	ticketClients.Lock()
+	defer ticketClients.Unlock()
+	if c, ok := ticketClients.m[key]; ok && c.password == password && c.opts == opts {
+		return c.client, nil
+	}
+	c, err := proxmox.NewTicketClient(rawURL, username, password, opts)
+	if err != nil {
+		return nil, err
+	}
+	ticketClients.m[key] = &cachedTicketClient{password: password, opts: opts, client: c}
+	return c, nil
+}
+
 // DeploymentStatus represents the current deployment state.
 type DeploymentStatus string
 
@@ -66,9 +115,39 @@ type MinecraftDeploymentRequest struct {
 	CIDR        int                 `json:"cidr"`
 	Gateway     string              `json:"gateway"`
 	DNS         string              `json:"dns"`
+	// SearchDomain is the DNS search domain (APP_NET_SEARCHDOMAIN when unset).
+	SearchDomain string `json:"searchdomain,omitempty"`
 	Hostname    string              `json:"hostname"`
+	// AutoHostname is set when Hostname was generated from the pool address
+	// rather than chosen by the user: the guest gets it, the VM keeps its name.
+	AutoHostname bool `json:"auto_hostname,omitempty"`
 	Minecraft   minecraft.Config    `json:"minecraft"`
 	BackupNotes string              `json:"backup_notes,omitempty"`
+	// OnFailure overrides the cleanup policy (destroy, keep, stop) applied to
+	// the VM if the deployment fails.
+	OnFailure string `json:"on_failure,omitempty"`
+	// Provisioner overrides the provisioner (ansible, ssh-script...) used to
+	// install the server.
+	Provisioner string `json:"provisioner,omitempty"`
+	// GuestType is "qemu" (default, clone of TemplateVM) or "lxc" (container
+	// created from OSTemplate, or from the configured lxc_template).
+	GuestType  string `json:"guest_type,omitempty"`
+	OSTemplate string `json:"ostemplate,omitempty"`
+	// NetworkMode is "pool", "static" (ip_address required) or "dhcp" (the
+	// IP is learned after boot). Defaults to the network_mode setting, then
+	// static when ip_address is set, else pool.
+	NetworkMode string `json:"network_mode,omitempty"`
+	// IPPool is the IPAM pool of pool mode (the first pool when unset).
+	IPPool string `json:"ip_pool,omitempty"`
+}
+
+// Guest returns the guest type of the deployment (qemu when unset or
+// invalid).
+func (r MinecraftDeploymentRequest) Guest() proxmox.GuestType {
+	if t, err := proxmox.ParseGuestType(r.GuestType); err == nil {
+		return t
+	}
+	return proxmox.GuestQEMU
 }
 
 // Job represents an internal job in the queue.
@@ -123,6 +202,22 @@ func appendLog(ctx context.Context, db Store, deploymentID int64, level, msg str
 		INSERT INTO deployment_logs (deployment_id, ts, level, message)
 		VALUES (?, ?, ?, ?)
 	`, deploymentID, time.Now().UTC(), level, msg)
+	NotifyDeployment(deploymentID)
+}
+
+// appendLogData appends a log line carrying structured data (stored as JSON
+// in deployment_logs.data_json).
+func appendLogData(ctx context.Context, db Store, deploymentID int64, level, msg string, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		appendLog(ctx, db, deploymentID, level, msg)
+		return
+	}
+	_, _ = db.ExecContext(ctx, `
+		INSERT INTO deployment_logs (deployment_id, ts, level, message, data_json)
+		VALUES (?, ?, ?, ?, ?)
+	`, deploymentID, time.Now().UTC(), level, msg, string(raw))
+	NotifyDeployment(deploymentID)
 }
 
 // updateDeploymentStatus updates the deployment status and optional fields.
@@ -138,6 +233,7 @@ func updateDeploymentStatus(ctx context.Context, db Store, deploymentID int64, s
 			UPDATE deployments SET result_json = ? WHERE id = ?
 		`, *resultJSON, deploymentID)
 	}
+	NotifyDeployment(deploymentID)
 }
 
 // ProcessJob runs the deployment pipeline for a single job.
@@ -151,7 +247,24 @@ func ProcessJob(ctx context.Context, db Store, j *Job, cfg *config.ProxmoxConfig
 		return err
 	}
 
-	// Resolve some defaults from global config if not provided.
+	if j.DeploymentID == nil {
+		return fmt.Errorf("job has no deployment_id")
+	}
+
+	c, err := NewProxmoxClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Resolve some defaults from global config if not provided. Without
+	// node, the placement engine picks one of the allowed nodes.
+	if req.Node == "" && len(cfg.AllowedNodes) > 0 {
+		node, err := placeDeployment(ctx, db, c, *j.DeploymentID, req, cfg)
+		if err != nil {
+			return err
+		}
+		req.Node = node
+	}
 	if req.Node == "" {
 		req.Node = cfg.DefaultNode
 	}
@@ -161,23 +274,40 @@ func ProcessJob(ctx context.Context, db Store, j *Job, cfg *config.ProxmoxConfig
 	if req.Bridge == "" {
 		req.Bridge = cfg.DefaultBridge
 	}
-	if req.TemplateVM == 0 {
+	guest, err := proxmox.ParseGuestType(req.GuestType)
+	if err != nil {
+		return err
+	}
+	req.GuestType = string(guest)
+	if guest == proxmox.GuestLXC {
+		if req.OSTemplate == "" {
+			req.OSTemplate = cfg.LXCTemplate
+		}
+		if req.OSTemplate == "" {
+			return fmt.Errorf("guest_type %q requires an ostemplate (request or lxc_template setting)", guest)
+		}
+	} else if req.TemplateVM == 0 {
 		req.TemplateVM = cfg.TemplateVMID
 	}
 
-	// Auto-fill network settings if not provided.
-	if req.IPAddress == "" {
-		ip, cidr, gw, dns, hostname, err := autoNetwork(ctx, db)
-		if err != nil {
+	mode, err := networkModeFor(req, cfg)
+	if err != nil {
+		return err
+	}
+	req.NetworkMode = string(mode)
+	if mode == NetworkStatic && req.IPAddress == "" {
+		return fmt.Errorf("network_mode %q requires ip_address", mode)
+	}
+
+	// Adresse du pool IPAM (DHCP : apprise après le boot).
+	if mode == NetworkPool {
+		if err := allocateNetwork(ctx, db, *j.DeploymentID, &req); err != nil {
 			return err
 		}
-		req.IPAddress = ip
-		req.CIDR = cidr
-		req.Gateway = gw
-		req.DNS = dns
-		if req.Hostname == "" {
-			req.Hostname = hostname
-		}
+	}
+
+	if req.SearchDomain == "" {
+		req.SearchDomain = os.Getenv("APP_NET_SEARCHDOMAIN")
 	}
 
 	// Auto JVM heap if not set: VM memory - 1GB, minimum 1G.
@@ -236,129 +366,35 @@ func ProcessJob(ctx context.Context, db Store, j *Job, cfg *config.ProxmoxConfig
 		req.Minecraft.AdminPassword = generatePassword(20)
 	}
 
-	c, err := proxmox.NewClient(cfg.APIURL, cfg.APITokenID, cfg.APITokenSecret)
-	if err != nil {
-		return err
-	}
-
-	deploymentID := j.DeploymentID
-	if deploymentID == nil {
-		return fmt.Errorf("job has no deployment_id")
+	// Persiste la requête résolue (IP, port, mots de passe...) dans le job
+	// afin qu'une reprise réutilise exactement les mêmes valeurs.
+	if raw, err := json.Marshal(req); err == nil {
+		j.PayloadJSON = string(raw)
+		_, _ = db.ExecContext(ctx, `UPDATE jobs SET payload_json = ?, updated_at = ? WHERE id = ?`, j.PayloadJSON, time.Now().UTC(), j.ID)
 	}
 
-	appendLog(ctx, db, *deploymentID, "info", "Starting deployment pipeline")
-
-	var vmid int
-	ipCIDR := fmt.Sprintf("%s/%d", req.IPAddress, req.CIDR)
-	ip := req.IPAddress
-
-	{
-		appendLog(ctx, db, *deploymentID, "info", "Requesting next VMID from Proxmox")
-		vmid, err = c.NextID(ctx)
-		if err != nil {
-			appendLog(ctx, db, *deploymentID, "error", fmt.Sprintf("Failed to get next VMID: %v", err))
-			return err
-		}
-
-		appendLog(ctx, db, *deploymentID, "info", fmt.Sprintf("Cloning VM from template %d to new VMID %d", req.TemplateVM, vmid))
-		upid, err := c.CloneVM(ctx, req.Node, req.TemplateVM, vmid, req.Name, req.Storage)
-		if err != nil {
-			appendLog(ctx, db, *deploymentID, "error", fmt.Sprintf("Clone failed: %v", err))
-			return err
-		}
-		appendLog(ctx, db, *deploymentID, "info", fmt.Sprintf("Waiting for clone task %s", upid))
-		if err := c.WaitForTask(ctx, req.Node, upid, 30*time.Minute); err != nil {
-			appendLog(ctx, db, *deploymentID, "error", fmt.Sprintf("Clone task failed: %v", err))
-			return err
-		}
-
-		// À ce stade, la VM existe : on enregistre immédiatement le VMID et l'IP
-		// dans la DB afin que les suppressions/cancellations puissent la cibler
-		// même si des erreurs surviennent plus tard dans le pipeline.
-		updateDeploymentStatus(ctx, db, *deploymentID, StatusRunning, &vmid, &ip, nil, nil)
-
-		appendLog(ctx, db, *deploymentID, "info", "Configuring VM resources and cloud-init networking")
-		if err := c.ConfigureVM(ctx, req.Node, vmid, req.Cores, req.MemoryMB, req.DiskGB, req.Bridge, req.VLAN, ipCIDR, req.Gateway); err != nil {
-			appendLog(ctx, db, *deploymentID, "error", fmt.Sprintf("Configure VM failed: %v", err))
-			return err
-		}
-
-		// Ajuste la taille du disque principal (scsi0) uniquement si la taille demandée
-		// est supérieure à celle du template (Proxmox ne permet pas de réduire un disque).
-		if req.DiskGB > 0 {
-			currentGB, errCur := c.GetScsi0SizeGB(ctx, req.Node, vmid)
-			if errCur != nil {
-				appendLog(ctx, db, *deploymentID, "info", fmt.Sprintf("Could not read current disk size: %v, skipping resize", errCur))
-			} else if req.DiskGB <= currentGB {
-				appendLog(ctx, db, *deploymentID, "info", fmt.Sprintf("Disk already %dG (template), requested %dG — no resize (Proxmox does not support shrinking)", currentGB, req.DiskGB))
-			} else {
-				appendLog(ctx, db, *deploymentID, "info", fmt.Sprintf("Resizing VM disk from %dG to %dG", currentGB, req.DiskGB))
-				if upid, err := c.ResizeDisk(ctx, req.Node, vmid, req.DiskGB); err != nil {
-					appendLog(ctx, db, *deploymentID, "error", fmt.Sprintf("Resize disk failed: %v", err))
-					return err
-				} else if upid != "" {
-					if err := c.WaitForTask(ctx, req.Node, upid, 30*time.Minute); err != nil {
-						appendLog(ctx, db, *deploymentID, "error", fmt.Sprintf("Resize disk task failed: %v", err))
-						return err
-					}
-				}
-			}
-		}
-
-		appendLog(ctx, db, *deploymentID, "info", "Starting VM")
-		upid, err = c.StartVM(ctx, req.Node, vmid)
-		if err != nil {
-			appendLog(ctx, db, *deploymentID, "error", fmt.Sprintf("Start VM failed: %v", err))
-			return err
-		}
-		if err := c.WaitForTask(ctx, req.Node, upid, 10*time.Minute); err != nil {
-			appendLog(ctx, db, *deploymentID, "error", fmt.Sprintf("Start task failed: %v", err))
-			return err
-		}
-
-		appendLog(ctx, db, *deploymentID, "info", "Waiting for SSH to become available on VM")
-		if err := c.WaitForSSH(ctx, ip, 22, 15*time.Minute); err != nil {
-			appendLog(ctx, db, *deploymentID, "error", fmt.Sprintf("SSH did not become available: %v", err))
-			return err
-		}
+	prov, err := provisionerFor(req, cfg)
+	if err != nil {
+		return err
 	}
 
-	appendLog(ctx, db, *deploymentID, "info", "Running Ansible playbook to provision Minecraft server")
-
-	{
-		if err := runAnsibleMinecraft(ctx, req, ip, cfg.SSHUser); err != nil {
-			appendLog(ctx, db, *deploymentID, "error", fmt.Sprintf("Ansible provisioning failed: %v", err))
-			return err
-		}
+	p := &pipeline{
+		db:           db,
+		client:       c.ForGuest(guest),
+		prov:         prov,
+		cfg:          cfg,
+		job:          j,
+		deploymentID: *j.DeploymentID,
+		req:          req,
+		ip:           req.IPAddress,
 	}
-
-	mcDir := "/opt/minecraft"
-	mcUser := "minecraft"
-	if u := req.Minecraft.AdminUser; u != "" {
-		mcDir = "/home/" + u + "/minecraft"
-		mcUser = u
-	}
-	result := map[string]any{
-		"vmid":          vmid,
-		"ip":            ip,
-		"job":           j.ID,
-		"run":           uuid.NewString(),
-		"mc_dir":        mcDir,
-		"mc_user":       mcUser,
-		"sftp_user":     req.Minecraft.AdminUser,
-		"sftp_password": req.Minecraft.AdminPassword,
-		"rcon_port":     req.Minecraft.RCONPort,
-		"rcon_password": req.Minecraft.RCONPassword,
-	}
-	rawResult, _ := json.Marshal(result)
-	resStr := string(rawResult)
-	updateDeploymentStatus(ctx, db, *deploymentID, StatusSuccess, &vmid, &ip, nil, &resStr)
-	appendLog(ctx, db, *deploymentID, "info", "Deployment completed successfully")
-	return nil
+	return p.run(ctx)
 }
 
 // runAnsibleMinecraft spawns ansible-playbook with the relevant variables.
-func runAnsibleMinecraft(ctx context.Context, req MinecraftDeploymentRequest, hostIP, sshUser string) error {
+// onEntry (optional) receives each output line, parsed into a log entry, as
+// it is produced.
+func runAnsibleMinecraft(ctx context.Context, req MinecraftDeploymentRequest, hostIP, sshUser string, onEntry func(ansibleLogEntry)) error {
 	playbook := "./ansible/provision_minecraft.yml"
 	hasModpackURL := strings.TrimSpace(req.Minecraft.ModpackURL) != ""
 	if req.Minecraft.Modpack != nil || hasModpackURL {
@@ -461,20 +497,68 @@ func runAnsibleMinecraft(ctx context.Context, req MinecraftDeploymentRequest, ho
 	if keyPath != "" {
 		env = append(env, "ANSIBLE_PRIVATE_KEY_FILE="+keyPath)
 	}
+	// Sortie structurée (un objet JSON par tâche) via le callback fourni.
+	if dir := ansibleCallbackDir(); dir != "" {
+		env = append(env, "ANSIBLE_CALLBACK_PLUGINS="+dir, "ANSIBLE_STDOUT_CALLBACK="+ansibleCallback)
+	}
 	cmd.Env = env
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		out := strings.TrimSpace(stdout.String() + "\n" + stderr.String())
-		if out != "" {
-			return fmt.Errorf("%w\n\nSortie Ansible:\n%s", err, out)
+	setProcessGroup(cmd)
+
+	// La sortie est transmise ligne par ligne (logs du déploiement en temps
+	// réel) ; seules les dernières lignes sont gardées pour le message d'erreur.
+	var mu sync.Mutex
+	tail := &tailLines{n: 40}
+	aptLock := false
+	var failed *AnsibleTask
+	stream := func(level string) *lineWriter {
+		return &lineWriter{mu: &mu, onLine: func(line string) {
+			if strings.TrimSpace(line) == "" {
+				return
+			}
+			e := parseAnsibleLine(level, line)
+			tail.add(e.Message)
+			if isAptLockFailure(e.Message) {
+				aptLock = true
+			}
+			if e.Task != nil && (e.Task.Status == "failed" || e.Task.Status == "unreachable") && !e.Task.Ignored && failed == nil {
+				failed = e.Task
+			}
+			if onEntry != nil {
+				onEntry(e)
+			}
+		}}
+	}
+	stdout, stderr := stream("info"), stream("warn")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	stdout.Flush()
+	stderr.Flush()
+	if err != nil {
+		if failed != nil {
+			err = fmt.Errorf("task %q %s on %s: %w", failed.Task, failed.Status, failed.Host, err)
+		}
+		if out := strings.TrimSpace(tail.String()); out != "" {
+			err = fmt.Errorf("%w\n\nSortie Ansible (dernières lignes):\n%s", err, out)
+		}
+		// Un verrou apt (unattended-upgrades au premier boot) est transitoire.
+		if aptLock {
+			return Retryable(err)
 		}
 		return err
 	}
 	return nil
 }
 
+// ansibleLineLevel picks the deployment log level of an Ansible output line.
+func ansibleLineLevel(def, line string) string {
+	l := strings.TrimSpace(line)
+	if strings.HasPrefix(l, "fatal:") || strings.HasPrefix(l, "failed:") || strings.HasPrefix(l, "ERROR!") {
+		return "error"
+	}
+	return def
+}
+
 // generatePassword crée un mot de passe aléatoire simple (a-zA-Z0-9).
 func generatePassword(length int) string {
 	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
@@ -493,76 +577,3 @@ func generatePassword(length int) string {
 	}
 	return b.String()
 }
-
-// autoNetwork allocates a fixed IP and related settings from an internal pool.
-// It uses environment variables:
-//  - APP_NET_CIDR (e.g. 192.168.1.0/24)
-//  - APP_NET_GATEWAY
-//  - APP_NET_DNS
-//  - APP_HOSTNAME_PREFIX (optional, default "mc-")
-// This is a simple allocator based on IPs already stored in the deployments table.
-func autoNetwork(ctx context.Context, db Store) (string, int, string, string, string, error) {
-	baseCIDR := os.Getenv("APP_NET_CIDR")
-	if baseCIDR == "" {
-		return "", 0, "", "", "", fmt.Errorf("APP_NET_CIDR is not set")
-	}
-	gw := os.Getenv("APP_NET_GATEWAY")
-	if gw == "" {
-		return "", 0, "", "", "", fmt.Errorf("APP_NET_GATEWAY is not set")
-	}
-	dns := os.Getenv("APP_NET_DNS")
-	if dns == "" {
-		dns = gw
-	}
-	prefix := os.Getenv("APP_HOSTNAME_PREFIX")
-	if prefix == "" {
-		prefix = "mc-"
-	}
-
-	ip, ipNet, err := net.ParseCIDR(baseCIDR)
-	if err != nil {
-		return "", 0, "", "", "", fmt.Errorf("invalid APP_NET_CIDR: %w", err)
-	}
-
-	// Collect used IPs from deployments.
-	row := db.QueryRowContext(ctx, `
-		SELECT GROUP_CONCAT(ip_address, ',') FROM deployments WHERE ip_address IS NOT NULL
-	`)
-	var usedConcat sql.NullString
-	_ = row.Scan(&usedConcat)
-
-	used := map[string]struct{}{}
-	if usedConcat.Valid {
-		for _, s := range strings.Split(usedConcat.String, ",") {
-			s = strings.TrimSpace(s)
-			if s != "" {
-				used[s] = struct{}{}
-			}
-		}
-	}
-
-	// Start scanning from base+10 up to end of subnet.
-	ip = ip.To4()
-	if ip == nil {
-		return "", 0, "", "", "", fmt.Errorf("APP_NET_CIDR must be IPv4")
-	}
-
-	start := ip.Mask(ipNet.Mask)
-	start[3] += 10
-
-	for i := 10; i < 250; i++ {
-		addr := net.IPv4(start[0], start[1], start[2], byte(i))
-		if !ipNet.Contains(addr) {
-			break
-		}
-		s := addr.String()
-		if _, ok := used[s]; !ok {
-			hostname := prefix + strings.ReplaceAll(s, ".", "-")
-			_, bits := ipNet.Mask.Size()
-			return s, bits, gw, dns, hostname, nil
-		}
-	}
-
-	return "", 0, "", "", "", fmt.Errorf("no free IP found in %s", baseCIDR)
-}
-
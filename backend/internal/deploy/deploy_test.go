@@ -0,0 +1,37 @@
+package deploy
+
+import (
+	"testing"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+)
+
+func TestNewProxmoxClientSharesTicketClients(t *testing.T) {
+	cfg := &config.ProxmoxConfig{
+		APIURL:   "https://pve.example:8006",
+		AuthMode: config.AuthModeTicket,
+		Username: "deployer@pve",
+		Password: "secret",
+	}
+	a, err := NewProxmoxClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewProxmoxClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("two ticket clients for the same URL and user: each one logs in")
+	}
+
+	changed := *cfg
+	changed.Password = "new-secret"
+	c, err := NewProxmoxClient(&changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == a {
+		t.Fatal("client kept after a password change")
+	}
+}
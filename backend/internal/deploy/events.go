@@ -0,0 +1,49 @@
+package deploy
+
+import "sync"
+
+// watchers holds, per deployment, the channels of the clients following its
+// logs (SSE). Notifications only say "something changed": readers fetch the
+// new rows from the database, so a coalesced or missed wake-up never loses a
+// log line.
+var watchers = struct {
+	sync.Mutex
+	m map[int64]map[chan struct{}]struct{}
+}{m: make(map[int64]map[chan struct{}]struct{})}
+
+// WatchDeployment returns a channel that receives a value whenever a log line
+// is appended to the deployment or its status changes. The returned function
+// must be called to stop watching.
+func WatchDeployment(deploymentID int64) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	watchers.Lock()
+	if watchers.m[deploymentID] == nil {
+		watchers.m[deploymentID] = make(map[chan struct{}]struct{})
+	}
+	watchers.m[deploymentID][ch] = struct{}{}
+	watchers.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			watchers.Lock()
+			delete(watchers.m[deploymentID], ch)
+			if len(watchers.m[deploymentID]) == 0 {
+				delete(watchers.m, deploymentID)
+			}
+			watchers.Unlock()
+		})
+	}
+}
+
+// NotifyDeployment wakes up the watchers of a deployment. It never blocks.
+func NotifyDeployment(deploymentID int64) {
+	watchers.Lock()
+	defer watchers.Unlock()
+	for ch := range watchers.m[deploymentID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+)
+
+// InventoryError reports a deployment setting that does not match what
+// exists in the Proxmox cluster.
+type InventoryError struct {
+	Field   string
+	Message string
+}
+
+func (e *InventoryError) Error() string { return e.Field + ": " + e.Message }
+
+// ValidateAgainstInventory checks the node, storage, bridge (and VLAN
+// support) and template of req against the cluster, after resolving the
+// defaults from cfg like ProcessJob does. Containers need an OS template
+// instead of a template VM. Without a node and with allowed_nodes set, the
+// storage and bridge must exist on at least one allowed node. Mismatches are
+// returned as *InventoryError; other errors come from the Proxmox API.
+func ValidateAgainstInventory(ctx context.Context, api proxmox.API, req MinecraftDeploymentRequest, cfg *config.ProxmoxConfig) error {
+	node, storage, bridge, template := req.Node, req.Storage, req.Bridge, req.TemplateVM
+	if cfg != nil {
+		if node == "" {
+			node = cfg.DefaultNode
+		}
+		if storage == "" {
+			storage = cfg.DefaultStorage
+		}
+		if bridge == "" {
+			bridge = cfg.DefaultBridge
+		}
+		if template == 0 {
+			template = cfg.TemplateVMID
+		}
+	}
+	// Un conteneur est créé depuis un vztmpl, pas cloné d'un template VM.
+	content := "images"
+	if req.Guest() == proxmox.GuestLXC {
+		content, template = "rootdir", 0
+		if req.OSTemplate == "" && (cfg == nil || cfg.LXCTemplate == "") {
+			return &InventoryError{"ostemplate", "no OS template: set ostemplate or the lxc_template setting"}
+		}
+	}
+
+	if req.Node != "" && cfg != nil && len(cfg.AllowedNodes) > 0 && !containsString(cfg.AllowedNodes, req.Node) {
+		return &InventoryError{"node", fmt.Sprintf("node %q is not in allowed_nodes (%s)", req.Node, strings.Join(cfg.AllowedNodes, ", "))}
+	}
+
+	nodes, err := api.ListNodes(ctx)
+	if err != nil {
+		return err
+	}
+	// Sans node, le moteur de placement choisira parmi allowed_nodes : au
+	// moins un d'eux doit avoir le storage et le bridge demandés.
+	if req.Node == "" && cfg != nil && len(cfg.AllowedNodes) > 0 {
+		var errs []*InventoryError
+		ok := false
+		for _, name := range cfg.AllowedNodes {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			err := validateNode(ctx, api, nodes, name, storage, bridge, content, req.VLAN)
+			var ie *InventoryError
+			if errors.As(err, &ie) {
+				errs = append(errs, ie)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			ok = true
+			break
+		}
+		if !ok {
+			return allowedNodesError(errs)
+		}
+	} else if err := validateNode(ctx, api, nodes, node, storage, bridge, content, req.VLAN); err != nil {
+		return err
+	}
+
+	if template != 0 {
+		templates, err := api.ListTemplates(ctx)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, t := range templates {
+			if t.VMID == template {
+				found = true
+			}
+		}
+		if !found {
+			return &InventoryError{"template_vmid", fmt.Sprintf("VM %d is not a template", template)}
+		}
+	}
+	return nil
+}
+
+// validateNode checks that node is online and has storage (accepting
+// content) and bridge (VLAN aware when vlan is set).
+func validateNode(ctx context.Context, api proxmox.API, nodes []proxmox.NodeInfo, node, storage, bridge, content string, vlan *int) error {
+	found := false
+	for _, n := range nodes {
+		if n.Node == node {
+			if n.Status != "online" {
+				return &InventoryError{"node", fmt.Sprintf("node %q is %s", node, n.Status)}
+			}
+			found = true
+		}
+	}
+	if !found {
+		return &InventoryError{"node", fmt.Sprintf("node %q does not exist in the cluster", node)}
+	}
+
+	if storage != "" {
+		storages, err := api.ListStorages(ctx, node)
+		if err != nil {
+			return err
+		}
+		var st *proxmox.StorageInfo
+		for i := range storages {
+			if storages[i].Storage == storage {
+				st = &storages[i]
+			}
+		}
+		switch {
+		case st == nil:
+			return &InventoryError{"storage", fmt.Sprintf("storage %q is not available on node %q", storage, node)}
+		case !st.HasContent(content):
+			return &InventoryError{"storage", fmt.Sprintf("storage %q does not accept %s (content: %s)", storage, guestDisks(content), st.Content)}
+		}
+	}
+
+	if bridge != "" {
+		bridges, err := api.ListBridges(ctx, node)
+		if err != nil {
+			return err
+		}
+		var br *proxmox.BridgeInfo
+		for i := range bridges {
+			if bridges[i].Iface == bridge {
+				br = &bridges[i]
+			}
+		}
+		switch {
+		case br == nil:
+			return &InventoryError{"bridge", fmt.Sprintf("bridge %q does not exist on node %q", bridge, node)}
+		case vlan != nil && br.VLANAware != 1:
+			return &InventoryError{"vlan", fmt.Sprintf("bridge %q is not VLAN aware, vlan %d cannot be used", bridge, *vlan)}
+		}
+	}
+	return nil
+}
+
+// allowedNodesError summarizes why none of the allowed nodes qualifies. The
+// field is the common one when every node fails on the same setting.
+func allowedNodesError(errs []*InventoryError) error {
+	if len(errs) == 0 {
+		return &InventoryError{"node", "allowed_nodes is empty"}
+	}
+	field := errs[0].Field
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		if e.Field != field {
+			field = "node"
+		}
+		msgs[i] = e.Message
+	}
+	return &InventoryError{field, "no allowed node qualifies: " + strings.Join(msgs, "; ")}
+}
+
+func guestDisks(content string) string {
+	if content == "rootdir" {
+		return "container volumes"
+	}
+	return "VM disks"
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if strings.TrimSpace(v) == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package deploy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+)
+
+// leaseDuration is how long a running job stays owned by its worker without
+// a heartbeat. The worker renews it every leaseDuration/4.
+const leaseDuration = 2 * time.Minute
+
+// reapInterval is how often expired leases are looked for.
+const reapInterval = time.Minute
+
+// StaleJobPolicy tells what to do with a job whose lease expired.
+type StaleJobPolicy string
+
+const (
+	// StaleRequeue puts the job back in the queue; it resumes from its last
+	// checkpoint (if attempts remain).
+	StaleRequeue StaleJobPolicy = "requeue"
+	// StaleFail marks the job and its deployment as failed.
+	StaleFail StaleJobPolicy = "fail"
+)
+
+// staleJobPolicy reads APP_STALE_JOB_POLICY (default "requeue").
+func staleJobPolicy() StaleJobPolicy {
+	if StaleJobPolicy(strings.ToLower(strings.TrimSpace(os.Getenv("APP_STALE_JOB_POLICY")))) == StaleFail {
+		return StaleFail
+	}
+	return StaleRequeue
+}
+
+// heartbeat renews the lease of a running job until the returned function is
+// called.
+func (w *Worker) heartbeat(ctx context.Context, job *Job) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(leaseDuration / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := w.DB.ExecContext(ctx, `
+					UPDATE jobs SET lease_until = ? WHERE id = ? AND status = ?
+				`, time.Now().UTC().Add(leaseDuration), job.ID, string(JobRunning))
+				if err != nil {
+					log.Printf("[worker] heartbeat job id=%d: %v", job.ID, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// reapLoop periodically recovers jobs whose lease expired.
+func (w *Worker) reapLoop() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.StopCh:
+			return
+		case <-ticker.C:
+			if err := w.ReapExpiredJobs(context.Background()); err != nil {
+				log.Printf("[worker] reap expired jobs: %v", err)
+			}
+		}
+	}
+}
+
+// ReapExpiredJobs recovers jobs stuck in "running" whose lease expired (the
+// process died or was restarted while running them). Depending on
+// APP_STALE_JOB_POLICY and the remaining attempts, they are re-queued or
+// failed; the deployment log explains what happened. Called at startup
+// (reconciliation) and then periodically.
+func (w *Worker) ReapExpiredJobs(ctx context.Context) error {
+	now := time.Now().UTC()
+	rows, err := w.DB.QueryContext(ctx, `
+		SELECT id, type, payload_json, status, deployment_id, run_after, last_error, attempts, created_at, updated_at
+		FROM jobs
+		WHERE status = ? AND (lease_until IS NULL OR lease_until < ?)
+		ORDER BY id
+	`, string(JobRunning), now)
+	if err != nil {
+		return err
+	}
+	var stale []*Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		stale = append(stale, j)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	cfg, cfgErr := config.LoadProxmoxConfig(ctx, w.DB)
+	if cfgErr != nil {
+		cfg = nil
+	}
+	for _, job := range stale {
+		if w.isActive(job) {
+			continue
+		}
+		w.recoverStaleJob(ctx, job, cfg, now)
+	}
+	return nil
+}
+
+// isActive reports whether job is currently run by this worker.
+func (w *Worker) isActive(job *Job) bool {
+	if job.DeploymentID == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.active[*job.DeploymentID]
+	return ok
+}
+
+// recoverStaleJob applies the stale job policy to a single job.
+func (w *Worker) recoverStaleJob(ctx context.Context, job *Job, cfg *config.ProxmoxConfig, now time.Time) {
+	policy := retryPolicyFor(job.Type)
+	step := "unknown"
+	if job.DeploymentID != nil {
+		var checkpoint sql.NullString
+		_ = w.DB.QueryRowContext(ctx, `SELECT checkpoint FROM deployments WHERE id = ?`, *job.DeploymentID).Scan(&checkpoint)
+		if checkpoint.Valid && checkpoint.String != "" {
+			step = checkpoint.String
+		} else {
+			step = "none"
+		}
+	}
+	reason := fmt.Sprintf("job lease expired (server restarted or crashed while the job was running, last completed step: %s)", step)
+
+	if staleJobPolicy() == StaleRequeue && job.Attempts < policy.MaxAttempts {
+		res, err := w.DB.ExecContext(ctx, `
+			UPDATE jobs SET status = ?, run_after = ?, last_error = ?, lease_until = NULL, updated_at = ?
+			WHERE id = ? AND status = ? AND (lease_until IS NULL OR lease_until < ?)
+		`, string(JobQueued), now, reason, now, job.ID, string(JobRunning), now)
+		if err != nil {
+			return
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			return
+		}
+		log.Printf("[worker] job id=%d re-queued: %s", job.ID, reason)
+		if job.DeploymentID != nil {
+			_, _ = w.DB.ExecContext(ctx, `
+				UPDATE deployments SET status = ?, updated_at = ? WHERE id = ? AND status = ?
+			`, string(StatusQueued), now, *job.DeploymentID, string(StatusRunning))
+			appendLog(ctx, w.DB, *job.DeploymentID, "warn", fmt.Sprintf("Attempt %d/%d interrupted: %s — re-queued, it will resume from the last checkpoint", job.Attempts, policy.MaxAttempts, reason))
+		}
+		return
+	}
+
+	res, err := w.DB.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, last_error = ?, lease_until = NULL, updated_at = ?
+		WHERE id = ? AND status = ? AND (lease_until IS NULL OR lease_until < ?)
+	`, string(JobFailed), reason, now, job.ID, string(JobRunning), now)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return
+	}
+	log.Printf("[worker] job id=%d failed: %s", job.ID, reason)
+	if job.DeploymentID != nil {
+		appendLog(ctx, w.DB, *job.DeploymentID, "error", fmt.Sprintf("Attempt %d/%d interrupted: %s — marked as failed", job.Attempts, policy.MaxAttempts, reason))
+		markJobAndDeploymentFailed(ctx, w.DB, job, fmt.Errorf("%s", reason))
+		CleanupFailedDeployment(ctx, w.DB, job, cfg)
+	}
+}
@@ -0,0 +1,58 @@
+package deploy
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// lineWriter is an io.Writer that calls onLine for each complete line written
+// to it. Several lineWriters may share the same mutex so that stdout and
+// stderr lines are delivered one at a time.
+type lineWriter struct {
+	mu     *sync.Mutex
+	buf    bytes.Buffer
+	onLine func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(w.buf.Next(i+1)), "\r\n")
+		w.onLine(line)
+	}
+	return len(p), nil
+}
+
+// Flush delivers a trailing line without newline, if any.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.onLine(strings.TrimRight(w.buf.String(), "\r\n"))
+		w.buf.Reset()
+	}
+}
+
+// tailLines keeps the last n lines it is given.
+type tailLines struct {
+	n     int
+	lines []string
+}
+
+func (t *tailLines) add(line string) {
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.n {
+		t.lines = t.lines[len(t.lines)-t.n:]
+	}
+}
+
+func (t *tailLines) String() string {
+	return strings.Join(t.lines, "\n")
+}
@@ -0,0 +1,228 @@
+package deploy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+	"github.com/example/proxmox-game-deployer/internal/ipam"
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+)
+
+// NetworkMode is how a deployment gets its IP address.
+type NetworkMode string
+
+const (
+	// NetworkPool allocates a static IP from an IPAM pool (ip_pool).
+	NetworkPool NetworkMode = "pool"
+	// NetworkStatic uses the ip_address/cidr/gateway of the request.
+	NetworkStatic NetworkMode = "static"
+	// NetworkDHCP lets the guest get its address by DHCP; it is learned
+	// after boot (guest agent or DHCP leases file).
+	NetworkDHCP NetworkMode = "dhcp"
+)
+
+// ParseNetworkMode validates a network mode; empty is accepted (resolved
+// later by networkModeFor).
+func ParseNetworkMode(s string) (NetworkMode, error) {
+	switch m := NetworkMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case NetworkPool, NetworkStatic, NetworkDHCP, "":
+		return m, nil
+	}
+	return "", fmt.Errorf("network_mode must be %q, %q or %q", NetworkPool, NetworkStatic, NetworkDHCP)
+}
+
+// networkModeFor resolves the network mode of a deployment: request, then
+// settings, then APP_NETWORK_MODE. Without any, a request with an IP is
+// static and the others use the pool.
+func networkModeFor(req MinecraftDeploymentRequest, cfg *config.ProxmoxConfig) (NetworkMode, error) {
+	cfgMode := ""
+	if cfg != nil {
+		cfgMode = cfg.NetworkMode
+	}
+	for _, name := range []string{req.NetworkMode, cfgMode, os.Getenv("APP_NETWORK_MODE")} {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		m, err := ParseNetworkMode(name)
+		if err != nil {
+			return "", err
+		}
+		// Une IP explicite dans la requête l'emporte sur le mode global.
+		if req.IPAddress != "" && req.NetworkMode == "" {
+			return NetworkStatic, nil
+		}
+		return m, nil
+	}
+	if req.IPAddress != "" {
+		return NetworkStatic, nil
+	}
+	return NetworkPool, nil
+}
+
+// dhcpLeasesFileFor returns the DHCP leases file used to find the address
+// of DHCP guests by MAC: settings, then APP_DHCP_LEASES_FILE ("" = none).
+func dhcpLeasesFileFor(cfg *config.ProxmoxConfig) string {
+	if cfg != nil && strings.TrimSpace(cfg.DHCPLeasesFile) != "" {
+		return strings.TrimSpace(cfg.DHCPLeasesFile)
+	}
+	return strings.TrimSpace(os.Getenv("APP_DHCP_LEASES_FILE"))
+}
+
+// allocateNetwork assigns the deployment an address of its IPAM pool and
+// fills the network settings of req from the pool. Replayed jobs get the
+// same address back (the allocation, or the IP of the previous run).
+func allocateNetwork(ctx context.Context, db Store, deploymentID int64, req *MinecraftDeploymentRequest) error {
+	pool, err := ipam.ResolvePool(ctx, db, req.IPPool)
+	if err != nil {
+		return err
+	}
+	lease, err := ipam.Allocate(ctx, db, pool, deploymentID, req.IPAddress)
+	if err != nil {
+		return err
+	}
+	for _, ip := range lease.Skipped {
+		appendLog(ctx, db, deploymentID, "warn", fmt.Sprintf("IP %s of pool %s is in use on the network (ping/ARP) but unknown to the app, skipped", ip, lease.Pool.Name))
+	}
+	_, _ = db.ExecContext(ctx, `UPDATE deployments SET ip_address = ?, updated_at = ? WHERE id = ?`, lease.IP, time.Now().UTC(), deploymentID)
+
+	req.IPPool = lease.Pool.Name
+	req.IPAddress = lease.IP
+	req.CIDR = lease.Pool.Prefix()
+	req.Gateway = lease.Pool.Gateway
+	req.DNS = lease.Pool.DNS
+	if lease.Pool.Bridge != "" {
+		req.Bridge = lease.Pool.Bridge
+	}
+	if lease.Pool.VLAN != nil {
+		vlan := *lease.Pool.VLAN
+		req.VLAN = &vlan
+	}
+	if req.Hostname == "" {
+		prefix := os.Getenv("APP_HOSTNAME_PREFIX")
+		if prefix == "" {
+			prefix = "mc-"
+		}
+		req.Hostname = prefix + strings.ReplaceAll(lease.IP, ".", "-")
+		req.AutoHostname = true
+	}
+	appendLog(ctx, db, deploymentID, "info", fmt.Sprintf("IP %s/%d allocated from pool %s", lease.IP, req.CIDR, lease.Pool.Name))
+	return nil
+}
+
+// guestIPCIDR is the address given to Proxmox (ipconfig0 or net0).
+func guestIPCIDR(req MinecraftDeploymentRequest) string {
+	if req.IPAddress == "" {
+		return proxmox.DHCP
+	}
+	return fmt.Sprintf("%s/%d", req.IPAddress, req.CIDR)
+}
+
+var macRe = regexp.MustCompile(`(?i)([0-9a-f]{2}(?::[0-9a-f]{2}){5})`)
+
+// guestMAC returns the MAC address of net0 ("virtio=BC:24:11:..." for VMs,
+// "hwaddr=BC:24:11:..." for containers), lower-cased.
+func guestMAC(vmCfg map[string]any) string {
+	net0, _ := vmCfg["net0"].(string)
+	return strings.ToLower(macRe.FindString(net0))
+}
+
+var iscLeaseRe = regexp.MustCompile(`^lease\s+(\S+)\s*\{`)
+
+// lookupLease returns the IP leased to mac in a dnsmasq ("expiry mac ip
+// host id") or ISC dhcpd ("lease ip { ... hardware ethernet mac; }") leases
+// file. The most recent matching lease wins.
+func lookupLease(path, mac string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var found, iscIP string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if m := iscLeaseRe.FindStringSubmatch(line); m != nil {
+			iscIP = m[1]
+			continue
+		}
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case len(fields) == 3 && fields[0] == "hardware" && fields[1] == "ethernet":
+			if strings.EqualFold(fields[2], mac) && iscIP != "" {
+				found = iscIP
+			}
+		case len(fields) >= 3 && strings.EqualFold(fields[1], mac):
+			found = fields[2]
+		}
+	}
+	return found, sc.Err()
+}
+
+// dhcpDiscoveryTimeout bounds the wait for the address of a DHCP guest.
+const dhcpDiscoveryTimeout = 10 * time.Minute
+
+// discoverIP learns the address of a DHCP guest after boot, from the guest
+// agent (or container interfaces) or, by MAC, from the DHCP leases file,
+// and records it on the deployment.
+func (p *pipeline) discoverIP(ctx context.Context) error {
+	req := p.req
+	leases := dhcpLeasesFileFor(p.cfg)
+	vmCfg, err := p.client.GetVMConfig(ctx, req.Node, p.vmid)
+	if err != nil {
+		return err
+	}
+	mac := guestMAC(vmCfg)
+	if req.Guest() == proxmox.GuestQEMU && !proxmox.AgentEnabled(vmCfg) && leases == "" {
+		err := errors.New("DHCP guest without QEMU guest agent: set dhcp_leases_file to find its address")
+		p.log(ctx, "error", err.Error())
+		return err
+	}
+	p.log(ctx, "info", fmt.Sprintf("Waiting for the DHCP address of the guest (MAC %s)", mac))
+
+	deadline := time.Now().Add(dhcpDiscoveryTimeout)
+	var lastErr error
+	for {
+		ip, source := "", ""
+		if ifaces, err := p.client.AgentNetworkInterfaces(ctx, req.Node, p.vmid); err == nil {
+			if ips := proxmox.GuestIPv4(ifaces); len(ips) > 0 {
+				ip, source = ips[0], "guest agent"
+			}
+		} else {
+			lastErr = err
+		}
+		if ip == "" && leases != "" && mac != "" {
+			if l, err := lookupLease(leases, mac); err == nil {
+				ip, source = l, leases
+			} else {
+				lastErr = err
+			}
+		}
+		if ip != "" {
+			p.ip = ip
+			_, _ = p.db.ExecContext(ctx, `UPDATE deployments SET ip_address = ?, updated_at = ? WHERE id = ?`, ip, time.Now().UTC(), p.deploymentID)
+			p.log(ctx, "info", fmt.Sprintf("Guest got IP %s by DHCP (from %s)", ip, source))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+	err = fmt.Errorf("no DHCP address found for the guest after %s (last error: %v)", dhcpDiscoveryTimeout, lastErr)
+	if leases == "" {
+		err = fmt.Errorf("%w; enable the guest agent or set dhcp_leases_file", err)
+	}
+	p.log(ctx, "error", err.Error())
+	return Retryable(err)
+}
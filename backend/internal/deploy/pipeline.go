@@ -0,0 +1,626 @@
+package deploy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+	"github.com/example/proxmox-game-deployer/internal/sshexec"
+)
+
+// Step identifies a completed stage of the deployment pipeline. The last
+// completed step is saved in deployments.checkpoint so that a re-run of the
+// job resumes from there instead of starting from scratch.
+type Step string
+
+const (
+	StepNone          Step = ""
+	StepVMIDAllocated Step = "vmid_allocated"
+	StepCloned        Step = "cloned"
+	StepConfigured    Step = "configured"
+	StepStarted       Step = "started"
+	StepProvisioned   Step = "provisioned"
+)
+
+// stepOrder lists the steps in execution order.
+var stepOrder = []Step{StepNone, StepVMIDAllocated, StepCloned, StepConfigured, StepStarted, StepProvisioned}
+
+// reached reports whether s is at or after target in the pipeline.
+func (s Step) reached(target Step) bool {
+	return stepIndex(s) >= stepIndex(target)
+}
+
+func stepIndex(s Step) int {
+	for i, st := range stepOrder {
+		if st == s {
+			return i
+		}
+	}
+	return 0
+}
+
+// vmidMu serialises NextID + clone request between concurrent jobs: Proxmox
+// only reserves a VMID once the clone task has been created.
+var vmidMu sync.Mutex
+
+// pipeline holds the state of one deployment run.
+type pipeline struct {
+	db           Store
+	client       proxmox.API
+	prov         Provisioner
+	cfg          *config.ProxmoxConfig
+	job          *Job
+	deploymentID int64
+	req          MinecraftDeploymentRequest
+
+	vmid int
+	ip   string
+	step Step
+}
+
+// run executes the remaining steps, saving a checkpoint after each one.
+func (p *pipeline) run(ctx context.Context) error {
+	if err := p.loadCheckpoint(ctx); err != nil {
+		return err
+	}
+
+	policy := retryPolicyFor(p.job.Type)
+	updateDeploymentStatus(ctx, p.db, p.deploymentID, StatusRunning, nil, nil, nil, nil)
+	if p.step == StepNone {
+		p.log(ctx, "info", fmt.Sprintf("Starting deployment pipeline (attempt %d/%d)", p.job.Attempts, policy.MaxAttempts))
+	} else {
+		p.log(ctx, "info", fmt.Sprintf("Resuming deployment pipeline after step %q with VMID %d (attempt %d/%d)", p.step, p.vmid, p.job.Attempts, policy.MaxAttempts))
+	}
+
+	steps := []struct {
+		done Step
+		run  func(ctx context.Context) error
+	}{
+		{StepVMIDAllocated, p.allocateVMID},
+		{StepCloned, p.cloneVM},
+		{StepConfigured, p.configureVM},
+		{StepStarted, p.startVM},
+		{StepProvisioned, p.provision},
+	}
+	for _, s := range steps {
+		if p.step.reached(s.done) {
+			continue
+		}
+		if err := s.run(ctx); err != nil {
+			if hint := proxmoxHint(err, p.cfg); hint != "" {
+				p.log(ctx, "error", hint)
+			}
+			return err
+		}
+		p.saveCheckpoint(ctx, s.done)
+		if s.done != StepProvisioned && draining(ctx) {
+			return errDraining
+		}
+	}
+
+	return p.finish(ctx)
+}
+
+// proxmoxHint explains what to do about a typed Proxmox error.
+func proxmoxHint(err error, cfg *config.ProxmoxConfig) string {
+	var se *proxmox.StatusError
+	errors.As(err, &se)
+	switch {
+	case errors.Is(err, proxmox.ErrUnauthorized) && cfg != nil && cfg.AuthMode == config.AuthModeTicket:
+		return "Proxmox rejected the credentials: check the username, password and permissions of the user in the settings"
+	case errors.Is(err, proxmox.ErrUnauthorized):
+		return "Proxmox rejected the credentials: check the API token and its permissions in the settings"
+	case errors.Is(err, proxmox.ErrLocked):
+		return "The VM is locked by another Proxmox operation (backup, snapshot, migration...); the job is retried if attempts remain"
+	case errors.Is(err, proxmox.ErrValidation) && se != nil && len(se.Errors) > 0:
+		return "Proxmox rejected parameters: " + se.FieldErrors()
+	case errors.Is(err, proxmox.ErrValidation):
+		return "Proxmox rejected the request parameters: check the deployment settings (resources, storage, bridge)"
+	case errors.Is(err, proxmox.ErrNotFound):
+		return "Proxmox resource not found: check the node, template VMID and storage in the settings"
+	}
+	return ""
+}
+
+func (p *pipeline) log(ctx context.Context, level, msg string) {
+	appendLog(ctx, p.db, p.deploymentID, level, msg)
+}
+
+// loadCheckpoint restores the last completed step, the VMID and the IP
+// (DHCP guests) of a previous run of this deployment.
+func (p *pipeline) loadCheckpoint(ctx context.Context) error {
+	var checkpoint sql.NullString
+	var vmid sql.NullInt64
+	var ip sql.NullString
+	err := p.db.QueryRowContext(ctx, `
+		SELECT checkpoint, vmid, ip_address FROM deployments WHERE id = ?
+	`, p.deploymentID).Scan(&checkpoint, &vmid, &ip)
+	if err != nil {
+		return err
+	}
+	if checkpoint.Valid {
+		p.step = Step(checkpoint.String)
+	}
+	if vmid.Valid {
+		p.vmid = int(vmid.Int64)
+	} else if p.step != StepNone {
+		// Checkpoint sans VMID : rien d'exploitable, on repart de zéro.
+		p.step = StepNone
+	}
+	if p.ip == "" && p.step != StepNone && ip.Valid {
+		p.ip = ip.String
+	}
+	return nil
+}
+
+// saveCheckpoint records step as the last completed one.
+func (p *pipeline) saveCheckpoint(ctx context.Context, step Step) {
+	p.step = step
+	_, _ = p.db.ExecContext(ctx, `
+		UPDATE deployments SET checkpoint = ?, checkpoint_at = ?, updated_at = ? WHERE id = ?
+	`, string(step), time.Now().UTC(), time.Now().UTC(), p.deploymentID)
+}
+
+// allocateVMID requests a new VMID and stores it on the deployment right away
+// so that deletions/cancellations can target the VM even if a later step fails.
+func (p *pipeline) allocateVMID(ctx context.Context) error {
+	vmidMu.Lock()
+	defer vmidMu.Unlock()
+	return p.allocateVMIDLocked(ctx)
+}
+
+func (p *pipeline) allocateVMIDLocked(ctx context.Context) error {
+	p.log(ctx, "info", "Requesting next VMID from Proxmox")
+	vmid, err := p.client.NextID(ctx)
+	if err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Failed to get next VMID: %v", err))
+		return err
+	}
+	p.vmid = vmid
+	_, _ = p.db.ExecContext(ctx, `UPDATE deployments SET vmid = ?, updated_at = ? WHERE id = ?`, vmid, time.Now().UTC(), p.deploymentID)
+	return nil
+}
+
+// cloneVM clones the template into the allocated VMID. When resuming, a VM
+// that already exists with the expected name is considered as ours (the
+// clone was requested before the interruption); if the VMID has been taken
+// by another VM, a new one is allocated.
+//
+// The template may live on another node than req.Node: on shared storage it
+// is cloned straight to req.Node (target), otherwise it is fully cloned on
+// its own node and the clone is then migrated to req.Node.
+func (p *pipeline) cloneVM(ctx context.Context) error {
+	if p.req.Guest() == proxmox.GuestLXC {
+		return p.createContainer(ctx)
+	}
+	req := p.req
+	srcNode := p.templateNode(ctx)
+	vmidMu.Lock()
+	if vmCfg, err := p.client.GetVMConfig(ctx, req.Node, p.vmid); err == nil {
+		if name, _ := vmCfg["name"].(string); p.ownsName(name) {
+			vmidMu.Unlock()
+			p.log(ctx, "info", fmt.Sprintf("VM %d already exists, reusing it", p.vmid))
+			return nil
+		}
+		p.log(ctx, "info", fmt.Sprintf("VMID %d is used by another VM, allocating a new one", p.vmid))
+		if err := p.allocateVMIDLocked(ctx); err != nil {
+			vmidMu.Unlock()
+			return err
+		}
+	} else if srcNode != req.Node {
+		// Reprise après un clone terminé sur le node du template mais dont la
+		// migration n'a pas eu lieu.
+		if vmCfg, err := p.client.GetVMConfig(ctx, srcNode, p.vmid); err == nil {
+			if name, _ := vmCfg["name"].(string); name == req.Name {
+				vmidMu.Unlock()
+				p.log(ctx, "info", fmt.Sprintf("VM %d already cloned on node %s", p.vmid, srcNode))
+				p.setVMNode(ctx, srcNode)
+				return p.migrateClone(ctx, srcNode)
+			}
+			p.log(ctx, "info", fmt.Sprintf("VMID %d is used by another VM, allocating a new one", p.vmid))
+			if err := p.allocateVMIDLocked(ctx); err != nil {
+				vmidMu.Unlock()
+				return err
+			}
+		}
+	}
+
+	opts := proxmox.CloneOptions{}
+	migrate := false
+	if srcNode != req.Node {
+		if p.templateOnSharedStorage(ctx, srcNode) {
+			opts.Target = req.Node
+			p.log(ctx, "info", fmt.Sprintf("Template %d is on node %s with shared storage, cloning directly to node %s", req.TemplateVM, srcNode, req.Node))
+		} else {
+			// Un linked clone ne peut pas quitter le node de sa base.
+			opts.Full = true
+			migrate = true
+			p.log(ctx, "info", fmt.Sprintf("Template %d is on node %s with local storage: full clone there, then migration to node %s", req.TemplateVM, srcNode, req.Node))
+		}
+	}
+
+	// Le node de la VM est enregistré avant le clone : un échec (du clone ou
+	// de la migration) laisse une VM que le nettoyage doit trouver.
+	if migrate || opts.Target == "" {
+		p.setVMNode(ctx, srcNode)
+	} else {
+		p.setVMNode(ctx, opts.Target)
+	}
+	p.log(ctx, "info", fmt.Sprintf("Cloning VM from template %d to new VMID %d", req.TemplateVM, p.vmid))
+	upid, err := p.client.CloneVMWithOptions(ctx, srcNode, req.TemplateVM, p.vmid, req.Name, opts)
+	vmidMu.Unlock()
+	if err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Clone failed: %v", err))
+		return err
+	}
+	p.log(ctx, "info", fmt.Sprintf("Waiting for clone task %s", upid))
+	if err := p.client.WaitForTask(ctx, srcNode, upid, 30*time.Minute); err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Clone task failed: %v", err))
+		return err
+	}
+	if migrate {
+		if err := p.migrateClone(ctx, srcNode); err != nil {
+			return err
+		}
+	}
+	updateDeploymentStatus(ctx, p.db, p.deploymentID, StatusRunning, &p.vmid, &p.ip, nil, nil)
+	return nil
+}
+
+// createContainer creates the LXC container of the deployment from its OS
+// template (StepCloned for containers). CPU, memory and network are set
+// again by configureVM, like for a cloned VM.
+func (p *pipeline) createContainer(ctx context.Context) error {
+	req := p.req
+	vmidMu.Lock()
+	if ctCfg, err := p.client.GetVMConfig(ctx, req.Node, p.vmid); err == nil {
+		if name, _ := ctCfg["hostname"].(string); p.ownsName(name) {
+			vmidMu.Unlock()
+			p.log(ctx, "info", fmt.Sprintf("Container %d already exists, reusing it", p.vmid))
+			return nil
+		}
+		p.log(ctx, "info", fmt.Sprintf("VMID %d is used by another guest, allocating a new one", p.vmid))
+		if err := p.allocateVMIDLocked(ctx); err != nil {
+			vmidMu.Unlock()
+			return err
+		}
+	}
+
+	p.setVMNode(ctx, req.Node)
+	p.log(ctx, "info", fmt.Sprintf("Creating container %d from %s", p.vmid, req.OSTemplate))
+	upid, err := p.client.CreateLXC(ctx, req.Node, p.vmid, proxmox.LXCOptions{
+		OSTemplate:    req.OSTemplate,
+		Hostname:      req.Name,
+		Cores:         req.Cores,
+		MemoryMB:      req.MemoryMB,
+		SwapMB:        512,
+		Storage:       req.Storage,
+		DiskGB:        req.DiskGB,
+		Bridge:        req.Bridge,
+		VLAN:          req.VLAN,
+		IPCIDR:        guestIPCIDR(req),
+		Gateway:       req.Gateway,
+		Nameserver:    req.DNS,
+		SSHPublicKeys: authorizedKeys(p.cfg),
+		Unprivileged:  true,
+		Nesting:       true,
+	})
+	vmidMu.Unlock()
+	if err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Container creation failed: %v", err))
+		return err
+	}
+	p.log(ctx, "info", fmt.Sprintf("Waiting for create task %s", upid))
+	if err := p.client.WaitForTask(ctx, req.Node, upid, 30*time.Minute); err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Create task failed: %v", err))
+		return err
+	}
+	updateDeploymentStatus(ctx, p.db, p.deploymentID, StatusRunning, &p.vmid, &p.ip, nil, nil)
+	return nil
+}
+
+// ownsName reports whether a guest name is the one of this deployment: its
+// name, or its hostname once cloud-init settings have been applied.
+func (p *pipeline) ownsName(name string) bool {
+	return name == p.req.Name || (p.req.Hostname != "" && name == p.req.Hostname)
+}
+
+// templateNode returns the node the template lives on, req.Node if it
+// cannot be located.
+func (p *pipeline) templateNode(ctx context.Context) string {
+	node, err := p.client.LocateVM(ctx, p.req.TemplateVM)
+	if err != nil {
+		p.log(ctx, "warn", fmt.Sprintf("Could not locate template %d (%v), assuming it is on node %s", p.req.TemplateVM, err, p.req.Node))
+		return p.req.Node
+	}
+	return node
+}
+
+// templateOnSharedStorage reports whether the template boot disk is on a
+// storage shared between nodes. Unknown counts as local.
+func (p *pipeline) templateOnSharedStorage(ctx context.Context, node string) bool {
+	vmCfg, err := p.client.GetVMConfig(ctx, node, p.req.TemplateVM)
+	if err != nil {
+		return false
+	}
+	storage := ""
+	for _, key := range []string{"scsi0", "virtio0", "sata0", "ide0"} {
+		if disk, ok := vmCfg[key].(string); ok {
+			storage, _, _ = strings.Cut(disk, ":")
+			break
+		}
+	}
+	if storage == "" {
+		return false
+	}
+	storages, err := p.client.ListStorages(ctx, node)
+	if err != nil {
+		return false
+	}
+	for _, st := range storages {
+		if st.Storage == storage {
+			return st.Shared == 1
+		}
+	}
+	return false
+}
+
+// migrateClone moves the freshly cloned (stopped) VM from node to req.Node,
+// its disks going to req.Storage.
+func (p *pipeline) migrateClone(ctx context.Context, node string) error {
+	req := p.req
+	p.log(ctx, "info", fmt.Sprintf("Migrating VM %d from node %s to node %s", p.vmid, node, req.Node))
+	upid, err := p.client.MigrateVM(ctx, node, p.vmid, req.Node, false, req.Storage)
+	if err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Migration failed: %v", err))
+		return err
+	}
+	if err := p.client.WaitForTask(ctx, node, upid, 60*time.Minute); err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Migration task failed: %v", err))
+		return err
+	}
+	p.setVMNode(ctx, req.Node)
+	return nil
+}
+
+// setVMNode records the node the VM of the deployment is on (vm_node).
+func (p *pipeline) setVMNode(ctx context.Context, node string) {
+	_, _ = p.db.ExecContext(ctx, `UPDATE deployments SET vm_node = ?, updated_at = ? WHERE id = ?`, node, time.Now().UTC(), p.deploymentID)
+}
+
+// configureVM applies CPU/RAM/network and grows the disk if needed. Both
+// operations are idempotent, so the step can safely be replayed.
+func (p *pipeline) configureVM(ctx context.Context) error {
+	req := p.req
+	ipCIDR := guestIPCIDR(req)
+	p.log(ctx, "info", "Configuring VM resources and cloud-init networking")
+	if err := p.client.ConfigureVM(ctx, req.Node, p.vmid, req.Cores, req.MemoryMB, req.DiskGB, req.Bridge, req.VLAN, ipCIDR, req.Gateway); err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Configure VM failed: %v", err))
+		return err
+	}
+	if err := p.applyCloudInit(ctx); err != nil {
+		return err
+	}
+
+	// Ajuste la taille du disque principal (scsi0) uniquement si la taille demandée
+	// est supérieure à celle du template (Proxmox ne permet pas de réduire un disque).
+	if req.DiskGB > 0 {
+		currentGB, errCur := p.client.GetScsi0SizeGB(ctx, req.Node, p.vmid)
+		if errCur != nil {
+			p.log(ctx, "info", fmt.Sprintf("Could not read current disk size: %v, skipping resize", errCur))
+		} else if req.DiskGB <= currentGB {
+			p.log(ctx, "info", fmt.Sprintf("Disk already %dG (template), requested %dG — no resize (Proxmox does not support shrinking)", currentGB, req.DiskGB))
+		} else {
+			p.log(ctx, "info", fmt.Sprintf("Resizing VM disk from %dG to %dG", currentGB, req.DiskGB))
+			if upid, err := p.client.ResizeDisk(ctx, req.Node, p.vmid, req.DiskGB); err != nil {
+				p.log(ctx, "error", fmt.Sprintf("Resize disk failed: %v", err))
+				return err
+			} else if upid != "" {
+				if err := p.client.WaitForTask(ctx, req.Node, upid, 30*time.Minute); err != nil {
+					p.log(ctx, "error", fmt.Sprintf("Resize disk task failed: %v", err))
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// startVM boots the VM unless it is already running.
+func (p *pipeline) startVM(ctx context.Context) error {
+	req := p.req
+	if cur, err := p.client.GetVMStatusCurrent(ctx, req.Node, p.vmid); err == nil && cur.Status == "running" {
+		p.log(ctx, "info", "VM is already running")
+		return nil
+	}
+	p.log(ctx, "info", "Starting VM")
+	upid, err := p.client.StartVM(ctx, req.Node, p.vmid)
+	if err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Start VM failed: %v", err))
+		return err
+	}
+	if err := p.client.WaitForTask(ctx, req.Node, upid, 10*time.Minute); err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Start task failed: %v", err))
+		return err
+	}
+	return nil
+}
+
+// agentIPTimeout bounds the wait for the guest to report its address.
+const agentIPTimeout = 5 * time.Minute
+
+// confirmGuestIP waits for the guest to report its IPv4 addresses (QEMU
+// guest agent, or the interfaces of a container) and checks that the
+// expected one is among them. VMs without agent, or whose agent never
+// answers, are left to the SSH port polling. DHCP guests have no expected
+// IP: it is discovered instead.
+func (p *pipeline) confirmGuestIP(ctx context.Context) error {
+	req := p.req
+	if p.ip == "" {
+		return p.discoverIP(ctx)
+	}
+	if req.Guest() == proxmox.GuestQEMU {
+		vmCfg, err := p.client.GetVMConfig(ctx, req.Node, p.vmid)
+		if err != nil || !proxmox.AgentEnabled(vmCfg) {
+			p.log(ctx, "info", "QEMU guest agent not enabled on the VM, skipping IP check")
+			return nil
+		}
+	}
+	p.log(ctx, "info", "Waiting for the guest to report its IP address")
+	deadline := time.Now().Add(agentIPTimeout)
+	var seen []string
+	var lastErr error
+	for {
+		ifaces, err := p.client.AgentNetworkInterfaces(ctx, req.Node, p.vmid)
+		if err == nil {
+			seen = proxmox.GuestIPv4(ifaces)
+			if containsString(seen, p.ip) {
+				p.log(ctx, "info", fmt.Sprintf("Guest is up with IP %s", p.ip))
+				return nil
+			}
+		} else {
+			lastErr = err
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+	if len(seen) == 0 {
+		p.log(ctx, "warn", fmt.Sprintf("Guest agent did not report any address (%v), falling back to SSH polling", lastErr))
+		return nil
+	}
+	err := fmt.Errorf("guest booted with IP %s, expected %s", strings.Join(seen, ", "), p.ip)
+	p.log(ctx, "error", err.Error())
+	return err
+}
+
+// guestReadyTimeout bounds the wait for the first boot of the guest
+// (cloud-init) through the guest agent.
+const guestReadyTimeout = 20 * time.Minute
+
+// waitGuestReady checks from inside a VM, through the QEMU guest agent,
+// that its first boot is over: the agent answers and cloud-init is done.
+// It returns false when the agent is not usable, leaving the checks to SSH.
+// A failed cloud-init only logs: the provisioners cope with it.
+func (p *pipeline) waitGuestReady(ctx context.Context) bool {
+	req := p.req
+	if req.Guest() != proxmox.GuestQEMU {
+		return false
+	}
+	vmCfg, err := p.client.GetVMConfig(ctx, req.Node, p.vmid)
+	if err != nil || !proxmox.AgentEnabled(vmCfg) {
+		return false
+	}
+	if err := p.client.AgentPing(ctx, req.Node, p.vmid); err != nil {
+		p.log(ctx, "info", fmt.Sprintf("Guest agent does not answer (%v), readiness left to SSH", err))
+		return false
+	}
+	p.log(ctx, "info", "Waiting for cloud-init to finish (guest agent)")
+	st, err := proxmox.RunAgentCommand(ctx, p.client, req.Node, p.vmid, []string{"cloud-init", "status", "--wait"}, guestReadyTimeout)
+	switch {
+	case err != nil:
+		// Pas de cloud-init dans l'image, ou agent sans guest-exec.
+		p.log(ctx, "warn", fmt.Sprintf("cloud-init status through the guest agent: %v", err))
+	case st.ExitCode != 0:
+		p.log(ctx, "warn", fmt.Sprintf("cloud-init finished with errors (exit %d): %s", st.ExitCode, strings.TrimSpace(st.OutData+" "+st.ErrData)))
+	default:
+		p.log(ctx, "info", "Guest is ready (cloud-init done)")
+	}
+	return true
+}
+
+// provision waits for SSH (if the provisioner needs it) then installs the
+// server with the deployment's provisioner.
+func (p *pipeline) provision(ctx context.Context) error {
+	if err := p.confirmGuestIP(ctx); err != nil {
+		return err
+	}
+	agentReady := p.waitGuestReady(ctx)
+	if p.prov.RequiresSSH() {
+		p.log(ctx, "info", "Waiting for SSH to become available on VM")
+		if err := proxmox.WaitForSSH(ctx, p.ip, 22, 15*time.Minute); err != nil {
+			p.log(ctx, "error", fmt.Sprintf("SSH did not become available: %v", err))
+			return Retryable(err)
+		}
+	}
+
+	name := p.prov.Name()
+	p.log(ctx, "info", fmt.Sprintf("Provisioning Minecraft server with the %s provisioner", name))
+	target := ProvisionTarget{Host: p.ip, SSHUser: SSHUserFor(p.req, p.cfg)}
+	if p.prov.RequiresSSH() && p.req.Guest() == proxmox.GuestLXC {
+		if err := p.prepareContainer(ctx, target); err != nil {
+			return err
+		}
+	}
+	if p.prov.RequiresSSH() && p.usesCloudInitTemplate() && !agentReady {
+		p.waitCloudInit(ctx, target)
+	}
+	if err := p.prov.Provision(ctx, p.req, target, func(level, msg string, data any) {
+		if data != nil {
+			appendLogData(ctx, p.db, p.deploymentID, level, "["+name+"] "+msg, data)
+			return
+		}
+		p.log(ctx, level, "["+name+"] "+msg)
+	}); err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Provisioning (%s) failed: %v", name, err))
+		return err
+	}
+	return nil
+}
+
+// prepareContainer installs sudo in the container: the standard LXC
+// templates log in as root without it, while the provisioners and the
+// server actions run their commands through sudo.
+func (p *pipeline) prepareContainer(ctx context.Context, target ProvisionTarget) error {
+	const cmd = "command -v sudo >/dev/null || (apt-get update -q && DEBIAN_FRONTEND=noninteractive apt-get install -y -q sudo)"
+	if _, stderr, err := sshexec.RunCommand(ctx, target.Host, target.SSHUser, sshexec.KeyPath(), cmd); err != nil {
+		p.log(ctx, "error", fmt.Sprintf("Installing sudo in the container failed: %v: %s", err, strings.TrimSpace(stderr)))
+		return Retryable(err)
+	}
+	return nil
+}
+
+// finish stores the deployment result and marks it successful.
+func (p *pipeline) finish(ctx context.Context) error {
+	req := p.req
+	if p.vmid == 0 {
+		return errors.New("pipeline finished without a VMID")
+	}
+	mcDir := "/opt/minecraft"
+	mcUser := "minecraft"
+	if u := req.Minecraft.AdminUser; u != "" {
+		mcDir = "/home/" + u + "/minecraft"
+		mcUser = u
+	}
+	result := map[string]any{
+		"vmid":          p.vmid,
+		"ip":            p.ip,
+		"job":           p.job.ID,
+		"run":           uuid.NewString(),
+		"mc_dir":        mcDir,
+		"mc_user":       mcUser,
+		"sftp_user":     req.Minecraft.AdminUser,
+		"sftp_password": req.Minecraft.AdminPassword,
+		"rcon_port":     req.Minecraft.RCONPort,
+		"rcon_password": req.Minecraft.RCONPassword,
+	}
+	rawResult, _ := json.Marshal(result)
+	resStr := string(rawResult)
+	updateDeploymentStatus(ctx, p.db, p.deploymentID, StatusSuccess, &p.vmid, &p.ip, nil, &resStr)
+	p.log(ctx, "info", "Deployment completed successfully")
+	return nil
+}
@@ -0,0 +1,273 @@
+package deploy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+	"github.com/example/proxmox-game-deployer/internal/db"
+	"github.com/example/proxmox-game-deployer/internal/proxmox/proxmoxtest"
+)
+
+// testEnv runs deployments against a fake Proxmox API and the fake
+// provisioner.
+type testEnv struct {
+	db   *db.DB
+	fake *proxmoxtest.FakeServer
+	prov *FakeProvisioner
+	w    *Worker
+}
+
+// newTestEnv starts a fake cluster with nodes (default "pve"); the template
+// is on the first node and deployments go to the last one.
+func newTestEnv(t *testing.T, nodes ...string) *testEnv {
+	t.Helper()
+	t.Setenv("DRY_RUN", "false")
+	t.Setenv("APP_SSH_KEY_PATH", filepath.Join(t.TempDir(), "id_ed25519"))
+	t.Setenv("APP_JOB_MAX_ATTEMPTS", "")
+
+	d, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	ctx := context.Background()
+	if err := d.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) == 0 {
+		nodes = []string{"pve"}
+	}
+	fake := proxmoxtest.NewFakeServer(nodes...)
+	t.Cleanup(fake.Close)
+	cfg := config.ProxmoxConfig{
+		APIURL:         fake.URL,
+		APITokenID:     "root@pam!test",
+		APITokenSecret: "secret",
+		DefaultNode:    nodes[len(nodes)-1],
+		DefaultStorage: "local-lvm",
+		DefaultBridge:  "vmbr0",
+		TemplateVMID:   9000,
+		Provisioner:    "fake",
+	}
+	if err := config.SaveProxmoxConfig(ctx, d, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	prov := &FakeProvisioner{}
+	RegisterProvisioner(prov)
+	w := NewWorker(d)
+	w.NodeLimit = 0
+	return &testEnv{db: d, fake: fake, prov: prov, w: w}
+}
+
+// enqueue adds a deployment with a static address.
+func (e *testEnv) enqueue(t *testing.T, name string) int64 {
+	t.Helper()
+	id, err := EnqueueMinecraftDeployment(context.Background(), e.db, MinecraftDeploymentRequest{
+		Name: name, Cores: 2, MemoryMB: 4096, DiskGB: 20,
+		IPAddress: "10.0.0.50", CIDR: 24, Gateway: "10.0.0.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// runJob processes the next queued job, whatever its run_after.
+func (e *testEnv) runJob(t *testing.T) error {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := e.db.ExecContext(ctx, `UPDATE jobs SET run_after = '2000-01-01 00:00:00' WHERE status = ?`, string(JobQueued)); err != nil {
+		t.Fatal(err)
+	}
+	err := e.w.processNextJob(ctx)
+	if err == sql.ErrNoRows {
+		t.Fatal("no job to run")
+	}
+	return err
+}
+
+type deploymentRow struct {
+	status     string
+	vmid       sql.NullInt64
+	checkpoint sql.NullString
+}
+
+func (e *testEnv) deployment(t *testing.T, id int64) deploymentRow {
+	t.Helper()
+	var r deploymentRow
+	err := e.db.QueryRowContext(context.Background(), `
+		SELECT status, vmid, checkpoint FROM deployments WHERE id = ?
+	`, id).Scan(&r.status, &r.vmid, &r.checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func (e *testEnv) jobStatus(t *testing.T, id int64) (string, int) {
+	t.Helper()
+	var status string
+	var attempts int
+	err := e.db.QueryRowContext(context.Background(), `
+		SELECT status, attempts FROM jobs WHERE deployment_id = ?
+	`, id).Scan(&status, &attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, attempts
+}
+
+func TestProcessJobSuccess(t *testing.T) {
+	e := newTestEnv(t)
+	id := e.enqueue(t, "survival")
+
+	if err := e.runJob(t); err != nil {
+		t.Fatalf("job failed: %v", err)
+	}
+
+	d := e.deployment(t, id)
+	if d.status != string(StatusSuccess) || Step(d.checkpoint.String) != StepProvisioned {
+		t.Fatalf("deployment status=%s checkpoint=%s, want success/provisioned", d.status, d.checkpoint.String)
+	}
+	vm, ok := e.fake.VM(int(d.vmid.Int64))
+	if !ok {
+		t.Fatalf("VM %d not created", d.vmid.Int64)
+	}
+	if vm.Status != "running" || vm.Name != "survival" {
+		t.Fatalf("VM status=%s name=%s, want running/survival", vm.Status, vm.Name)
+	}
+	if vm.Config["cores"] != "2" || vm.Config["memory"] != "4096" {
+		t.Fatalf("VM not configured: %v", vm.Config)
+	}
+	if len(vm.Execs) != 1 || strings.Join(vm.Execs[0], " ") != "cloud-init status --wait" {
+		t.Fatalf("guest agent execs = %v, want the cloud-init readiness check", vm.Execs)
+	}
+	if calls := e.prov.Calls(); len(calls) != 1 || calls[0].Host != "10.0.0.50" {
+		t.Fatalf("provisioner calls = %+v, want one on 10.0.0.50", calls)
+	}
+	if status, _ := e.jobStatus(t, id); status != string(JobDone) {
+		t.Fatalf("job status = %s, want done", status)
+	}
+}
+
+func TestProcessJobRetryableFailure(t *testing.T) {
+	e := newTestEnv(t)
+	id := e.enqueue(t, "survival")
+
+	e.fake.FailRequest("start", http.StatusServiceUnavailable)
+	if err := e.runJob(t); err == nil {
+		t.Fatal("job succeeded despite the start failure")
+	}
+	status, attempts := e.jobStatus(t, id)
+	if status != string(JobQueued) || attempts != 1 {
+		t.Fatalf("job status=%s attempts=%d, want queued/1", status, attempts)
+	}
+	d := e.deployment(t, id)
+	if d.status != string(StatusQueued) || Step(d.checkpoint.String) != StepConfigured {
+		t.Fatalf("deployment status=%s checkpoint=%s, want queued/configured", d.status, d.checkpoint.String)
+	}
+
+	if err := e.runJob(t); err != nil {
+		t.Fatalf("second attempt failed: %v", err)
+	}
+	if d := e.deployment(t, id); d.status != string(StatusSuccess) {
+		t.Fatalf("deployment status = %s, want success", d.status)
+	}
+}
+
+func TestProcessJobResumesFromCheckpoint(t *testing.T) {
+	e := newTestEnv(t)
+	id := e.enqueue(t, "survival")
+
+	e.prov.Err = Retryable(errors.New("apt lock"))
+	if err := e.runJob(t); err == nil {
+		t.Fatal("job succeeded despite the provisioning failure")
+	}
+	first := e.deployment(t, id)
+	if Step(first.checkpoint.String) != StepStarted {
+		t.Fatalf("checkpoint = %s, want started", first.checkpoint.String)
+	}
+
+	// La reprise ne doit ni réserver de VMID ni recloner.
+	e.prov.Err = nil
+	e.fake.FailRequest("nextid", http.StatusInternalServerError)
+	e.fake.FailRequest("clone", http.StatusInternalServerError)
+	if err := e.runJob(t); err != nil {
+		t.Fatalf("resumed job failed: %v", err)
+	}
+	d := e.deployment(t, id)
+	if d.status != string(StatusSuccess) || d.vmid != first.vmid {
+		t.Fatalf("deployment status=%s vmid=%v, want success with VMID %v", d.status, d.vmid, first.vmid)
+	}
+	if n := len(e.prov.Calls()); n != 2 {
+		t.Fatalf("provisioner called %d times, want 2", n)
+	}
+}
+
+func TestProcessJobCleanupOnFailure(t *testing.T) {
+	e := newTestEnv(t)
+	id := e.enqueue(t, "survival")
+
+	e.prov.Err = errors.New("playbook failed")
+	if err := e.runJob(t); err == nil {
+		t.Fatal("job succeeded despite the provisioning failure")
+	}
+	if status, _ := e.jobStatus(t, id); status != string(JobFailed) {
+		t.Fatalf("job status = %s, want failed", status)
+	}
+	d := e.deployment(t, id)
+	if d.status != string(StatusFailed) {
+		t.Fatalf("deployment status = %s, want failed", d.status)
+	}
+	if d.vmid.Valid {
+		t.Fatalf("VMID %d still held after cleanup", d.vmid.Int64)
+	}
+	if _, ok := e.fake.VM(100); ok {
+		t.Fatal("VM 100 not deleted by the cleanup")
+	}
+}
+
+func TestProcessJobCleanupFailedClone(t *testing.T) {
+	e := newTestEnv(t)
+	id := e.enqueue(t, "survival")
+
+	// La tâche de clone échoue après avoir créé la VM : elle doit être
+	// supprimée même si le checkpoint "cloned" n'a pas été atteint.
+	e.fake.FailTask("clone")
+	if err := e.runJob(t); err == nil {
+		t.Fatal("job succeeded despite the clone failure")
+	}
+	d := e.deployment(t, id)
+	if d.status != string(StatusFailed) || d.vmid.Valid {
+		t.Fatalf("deployment status=%s vmid=%v, want failed without VMID", d.status, d.vmid)
+	}
+	if _, ok := e.fake.VM(100); ok {
+		t.Fatal("partial clone 100 not deleted by the cleanup")
+	}
+}
+
+func TestProcessJobCleanupFailedCloneMigration(t *testing.T) {
+	e := newTestEnv(t, "pve1", "pve2")
+	id := e.enqueue(t, "survival")
+
+	// Template sur stockage local : clone complet sur pve1 puis migration,
+	// qui échoue et laisse le clone sur pve1.
+	e.fake.FailTask("migrate")
+	if err := e.runJob(t); err == nil {
+		t.Fatal("job succeeded despite the migration failure")
+	}
+	if d := e.deployment(t, id); d.status != string(StatusFailed) || d.vmid.Valid {
+		t.Fatalf("deployment status=%s vmid=%v, want failed without VMID", d.status, d.vmid)
+	}
+	if vm, ok := e.fake.VM(100); ok {
+		t.Fatalf("clone 100 left on node %s", vm.Node)
+	}
+}
@@ -0,0 +1,395 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+)
+
+// NodeCandidate is a node able to host a new deployment, with the figures
+// placement strategies compare.
+type NodeCandidate struct {
+	Node          string  `json:"node"`
+	FreeMemMB     int64   `json:"free_mem_mb"`
+	CPU           float64 `json:"cpu"` // charge CPU, fraction 0..1
+	StorageFreeGB int64   `json:"storage_free_gb"`
+	GameServers   int     `json:"game_servers"`
+}
+
+func (c NodeCandidate) String() string {
+	return fmt.Sprintf("%s (%d MB free, CPU %.0f%%, %d GB disk free, %d servers)",
+		c.Node, c.FreeMemMB, c.CPU*100, c.StorageFreeGB, c.GameServers)
+}
+
+// PlacementStrategy chooses the node of a deployment among candidates.
+type PlacementStrategy interface {
+	// Name is the identifier used in settings ("spread"...).
+	Name() string
+	// Pick returns the index of the chosen candidate and a short reason.
+	// cands is never empty and is sorted by node name; last is the node
+	// chosen by the previous placement ("" if unknown).
+	Pick(cands []NodeCandidate, last string) (int, string)
+}
+
+// DefaultPlacementStrategy is used when neither the settings nor
+// APP_PLACEMENT_STRATEGY choose one.
+const DefaultPlacementStrategy = "spread"
+
+var placementStrategies = struct {
+	sync.RWMutex
+	m map[string]PlacementStrategy
+}{m: map[string]PlacementStrategy{
+	"spread":      spreadStrategy{},
+	"pack":        packStrategy{},
+	"round-robin": roundRobinStrategy{},
+}}
+
+// RegisterPlacementStrategy makes s selectable under s.Name(), replacing any
+// strategy with the same name.
+func RegisterPlacementStrategy(s PlacementStrategy) {
+	placementStrategies.Lock()
+	defer placementStrategies.Unlock()
+	placementStrategies.m[s.Name()] = s
+}
+
+// LookupPlacementStrategy returns the strategy registered under name.
+func LookupPlacementStrategy(name string) (PlacementStrategy, error) {
+	placementStrategies.RLock()
+	defer placementStrategies.RUnlock()
+	s, ok := placementStrategies.m[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		names := make([]string, 0, len(placementStrategies.m))
+		for n := range placementStrategies.m {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown placement strategy %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return s, nil
+}
+
+// placementStrategyFor resolves the strategy: settings, then
+// APP_PLACEMENT_STRATEGY, defaulting to spread.
+func placementStrategyFor(cfg *config.ProxmoxConfig) (PlacementStrategy, error) {
+	for _, name := range []string{cfg.PlacementStrategy, os.Getenv("APP_PLACEMENT_STRATEGY")} {
+		if strings.TrimSpace(name) != "" {
+			return LookupPlacementStrategy(name)
+		}
+	}
+	return LookupPlacementStrategy(DefaultPlacementStrategy)
+}
+
+// Weights of the placement score terms (their sum is 1).
+const (
+	placementWeightMem     = 0.4
+	placementWeightCPU     = 0.3
+	placementWeightStorage = 0.15
+	placementWeightServers = 0.15
+)
+
+// placementTerms are the figures of a candidate scaled to 0..1: free memory,
+// free storage and game servers relative to the highest value among the
+// candidates, CPU headroom as is. Scaling by the maximum (and not the
+// min-max range) keeps near-equal nodes near-equal.
+type placementTerms struct {
+	mem, cpuFree, storage, servers float64
+}
+
+func scaleCandidates(cands []NodeCandidate) []placementTerms {
+	var maxMem, maxStorage int64
+	maxServers := 0
+	for _, c := range cands {
+		maxMem = max(maxMem, c.FreeMemMB)
+		maxStorage = max(maxStorage, c.StorageFreeGB)
+		maxServers = max(maxServers, c.GameServers)
+	}
+	ratio := func(v, m float64) float64 {
+		if m <= 0 {
+			return 0
+		}
+		return v / m
+	}
+	out := make([]placementTerms, len(cands))
+	for i, c := range cands {
+		out[i] = placementTerms{
+			mem:     ratio(float64(c.FreeMemMB), float64(maxMem)),
+			cpuFree: 1 - min(max(c.CPU, 0), 1),
+			storage: ratio(float64(c.StorageFreeGB), float64(maxStorage)),
+			servers: ratio(float64(c.GameServers), float64(maxServers)),
+		}
+	}
+	return out
+}
+
+// bestScore returns the index of the candidate with the highest score (the
+// first one, by name, on a tie) and its score.
+func bestScore(cands []NodeCandidate, score func(placementTerms) float64) (int, float64) {
+	best, bestScore := 0, -1.0
+	for i, t := range scaleCandidates(cands) {
+		if sc := score(t); sc > bestScore {
+			best, bestScore = i, sc
+		}
+	}
+	return best, bestScore
+}
+
+// spreadStrategy favours the least loaded node: a weighted score of free
+// memory, CPU headroom, free storage and few game servers.
+type spreadStrategy struct{}
+
+func (spreadStrategy) Name() string { return "spread" }
+
+func (spreadStrategy) Pick(cands []NodeCandidate, _ string) (int, string) {
+	i, sc := bestScore(cands, func(t placementTerms) float64 {
+		return placementWeightMem*t.mem + placementWeightCPU*t.cpuFree +
+			placementWeightStorage*t.storage + placementWeightServers*(1-t.servers)
+	})
+	return i, fmt.Sprintf("best spread score %.2f (free memory 40%%, CPU headroom 30%%, free storage 15%%, fewest game servers 15%%)", sc)
+}
+
+// packStrategy fills nodes one after the other: it favours the node with the
+// least free memory and storage and the most game servers that still fits
+// the deployment, CPU headroom still counting.
+type packStrategy struct{}
+
+func (packStrategy) Name() string { return "pack" }
+
+func (packStrategy) Pick(cands []NodeCandidate, _ string) (int, string) {
+	i, sc := bestScore(cands, func(t placementTerms) float64 {
+		return placementWeightMem*(1-t.mem) + placementWeightCPU*t.cpuFree +
+			placementWeightStorage*(1-t.storage) + placementWeightServers*t.servers
+	})
+	return i, fmt.Sprintf("best pack score %.2f (least free memory 40%%, CPU headroom 30%%, least free storage 15%%, most game servers 15%%)", sc)
+}
+
+// roundRobinStrategy takes the next node (by name) after the last one used.
+type roundRobinStrategy struct{}
+
+func (roundRobinStrategy) Name() string { return "round-robin" }
+
+func (roundRobinStrategy) Pick(cands []NodeCandidate, last string) (int, string) {
+	for i, c := range cands {
+		if c.Node > last {
+			return i, fmt.Sprintf("next node after %q", last)
+		}
+	}
+	return 0, fmt.Sprintf("next node after %q (wrapped around)", last)
+}
+
+// placementLastNodeKey stores, in settings, the node of the last placement
+// (used by round-robin).
+const placementLastNodeKey = "placement_last_node"
+
+// Minimum CPU headroom for a node to be a candidate.
+const placementMaxCPU = 0.90
+
+// errNodesBusy is returned by placeDeployment when every candidate node is
+// at its concurrency limit; the worker requeues the job without counting the
+// attempt.
+var errNodesBusy = errors.New("placement: every candidate node is busy")
+
+// placementMu serializes placements so that two deployments placed at the
+// same time see each other in the game-server counts.
+var placementMu sync.Mutex
+
+// placeDeployment chooses the node of a deployment among cfg.AllowedNodes,
+// records it in the deployment request and logs why it was chosen.
+func placeDeployment(ctx context.Context, db Store, api proxmox.API, deploymentID int64, req MinecraftDeploymentRequest, cfg *config.ProxmoxConfig) (string, error) {
+	strategy, err := placementStrategyFor(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	placementMu.Lock()
+	defer placementMu.Unlock()
+
+	nodes, err := api.ListNodes(ctx)
+	if err != nil {
+		return "", fmt.Errorf("placement: list nodes: %w", err)
+	}
+	byName := make(map[string]proxmox.NodeInfo, len(nodes))
+	for _, n := range nodes {
+		byName[n.Node] = n
+	}
+	counts, err := gameServersPerNode(ctx, db, deploymentID, cfg.DefaultNode)
+	if err != nil {
+		return "", err
+	}
+
+	storage := req.Storage
+	if storage == "" {
+		storage = cfg.DefaultStorage
+	}
+	var cands []NodeCandidate
+	var skipped []string
+	for _, name := range cfg.AllowedNodes {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		n, ok := byName[name]
+		switch {
+		case !ok:
+			skipped = append(skipped, name+" (not in cluster)")
+			continue
+		case n.Status != "online":
+			skipped = append(skipped, fmt.Sprintf("%s (%s)", name, n.Status))
+			continue
+		}
+		c := NodeCandidate{Node: name, FreeMemMB: n.FreeMem() >> 20, CPU: n.CPU, GameServers: counts[name]}
+		if c.FreeMemMB < int64(req.MemoryMB) {
+			skipped = append(skipped, fmt.Sprintf("%s (%d MB free, %d MB needed)", name, c.FreeMemMB, req.MemoryMB))
+			continue
+		}
+		if c.CPU > placementMaxCPU {
+			skipped = append(skipped, fmt.Sprintf("%s (CPU %.0f%%)", name, c.CPU*100))
+			continue
+		}
+		if storage != "" {
+			free, err := storageFreeGB(ctx, api, name, storage)
+			if err != nil {
+				skipped = append(skipped, fmt.Sprintf("%s (storage %s: %v)", name, storage, err))
+				continue
+			}
+			if free < int64(req.DiskGB) {
+				skipped = append(skipped, fmt.Sprintf("%s (%d GB free on %s, %d GB needed)", name, free, storage, req.DiskGB))
+				continue
+			}
+			c.StorageFreeGB = free
+		}
+		cands = append(cands, c)
+	}
+	if len(cands) == 0 {
+		return "", fmt.Errorf("placement: no allowed node can host this deployment: %s", strings.Join(skipped, ", "))
+	}
+	sort.Slice(cands, func(i, j int) bool { return cands[i].Node < cands[j].Node })
+
+	var last string
+	_ = db.QueryRowContext(ctx, `SELECT value FROM settings WHERE key = ?`, placementLastNodeKey).Scan(&last)
+	// Le slot du worker suit le node choisi ; un node à sa limite de jobs
+	// concurrents est écarté et le choix refait parmi les autres.
+	slot := nodeSlotFrom(ctx)
+	// Le journal montre tous les candidats, y compris ceux écartés ensuite
+	// pour limite de concurrence.
+	all := append([]NodeCandidate(nil), cands...)
+	var chosen NodeCandidate
+	var reason string
+	for {
+		if len(cands) == 0 {
+			appendLog(ctx, db, deploymentID, "info", "Placement: every allowed node is at its concurrency limit, deployment requeued: "+strings.Join(skipped, ", "))
+			return "", errNodesBusy
+		}
+		var i int
+		i, reason = strategy.Pick(cands, last)
+		if slot.moveTo(cands[i].Node) {
+			chosen = cands[i]
+			break
+		}
+		skipped = append(skipped, cands[i].Node+" (concurrency limit reached)")
+		cands = append(cands[:i], cands[i+1:]...)
+	}
+
+	_, _ = db.ExecContext(ctx, `
+		INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, placementLastNodeKey, chosen.Node)
+	if err := SetRequestNode(ctx, db, deploymentID, chosen.Node, ""); err != nil {
+		return "", err
+	}
+
+	descr := make([]string, len(all))
+	for k, c := range all {
+		descr[k] = c.String()
+	}
+	msg := fmt.Sprintf("Placement (%s): node %s chosen, %s. Candidates: %s", strategy.Name(), chosen.Node, reason, strings.Join(descr, "; "))
+	if len(skipped) > 0 {
+		msg += ". Skipped: " + strings.Join(skipped, ", ")
+	}
+	appendLogData(ctx, db, deploymentID, "info", msg, map[string]any{
+		"type":       "placement",
+		"strategy":   strategy.Name(),
+		"node":       chosen.Node,
+		"reason":     reason,
+		"candidates": all,
+		"skipped":    skipped,
+	})
+	return chosen.Node, nil
+}
+
+// storageFreeGB returns the free space of storage on node.
+func storageFreeGB(ctx context.Context, api proxmox.API, node, storage string) (int64, error) {
+	storages, err := api.ListStorages(ctx, node)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range storages {
+		if s.Storage == storage {
+			return s.Avail >> 30, nil
+		}
+	}
+	return 0, fmt.Errorf("not available")
+}
+
+// gameServersPerNode counts the deployments of each node, except the
+// failed, cancelled and deleting ones and deploymentID itself. Deployments
+// created without node run on defaultNode, unless they are still waiting
+// for their placement.
+func gameServersPerNode(ctx context.Context, db Store, deploymentID int64, defaultNode string) (map[string]int, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT request_json, status FROM deployments WHERE status IN (?, ?, ?) AND id != ?
+	`, string(StatusQueued), string(StatusRunning), string(StatusSuccess), deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var raw, status string
+		if err := rows.Scan(&raw, &status); err != nil {
+			return nil, err
+		}
+		var r struct {
+			Node string `json:"node"`
+		}
+		_ = json.Unmarshal([]byte(raw), &r)
+		switch {
+		case r.Node != "":
+			counts[r.Node]++
+		case status == string(StatusSuccess):
+			counts[defaultNode]++
+		}
+	}
+	return counts, rows.Err()
+}
+
+// SetRequestNode writes node (and storage, if set) into the stored request
+// of a deployment, so that server actions and later attempts target it.
+func SetRequestNode(ctx context.Context, db Store, deploymentID int64, node, storage string) error {
+	var raw string
+	if err := db.QueryRowContext(ctx, `SELECT request_json FROM deployments WHERE id = ?`, deploymentID).Scan(&raw); err != nil {
+		return err
+	}
+	var m map[string]any
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		return err
+	}
+	m["node"] = node
+	if storage != "" {
+		m["storage"] = storage
+	}
+	out, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `UPDATE deployments SET request_json = ?, updated_at = ? WHERE id = ?`, string(out), time.Now().UTC(), deploymentID)
+	return err
+}
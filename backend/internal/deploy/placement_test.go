@@ -0,0 +1,64 @@
+package deploy
+
+import "testing"
+
+func TestPlacementStrategies(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		strategy PlacementStrategy
+		cands    []NodeCandidate
+		want     string
+	}{
+		{
+			// Mémoire quasi égale : la charge CPU départage.
+			name:     "spread cpu",
+			strategy: spreadStrategy{},
+			cands: []NodeCandidate{
+				{Node: "pve1", FreeMemMB: 16010, CPU: 0.75, StorageFreeGB: 500, GameServers: 2},
+				{Node: "pve2", FreeMemMB: 16000, CPU: 0.10, StorageFreeGB: 500, GameServers: 2},
+			},
+			want: "pve2",
+		},
+		{
+			name:     "spread storage",
+			strategy: spreadStrategy{},
+			cands: []NodeCandidate{
+				{Node: "pve1", FreeMemMB: 16000, CPU: 0.20, StorageFreeGB: 40, GameServers: 1},
+				{Node: "pve2", FreeMemMB: 15900, CPU: 0.20, StorageFreeGB: 800, GameServers: 1},
+			},
+			want: "pve2",
+		},
+		{
+			name:     "spread memory",
+			strategy: spreadStrategy{},
+			cands: []NodeCandidate{
+				{Node: "pve1", FreeMemMB: 8000, CPU: 0.20, StorageFreeGB: 500, GameServers: 1},
+				{Node: "pve2", FreeMemMB: 30000, CPU: 0.25, StorageFreeGB: 500, GameServers: 1},
+			},
+			want: "pve2",
+		},
+		{
+			name:     "pack cpu",
+			strategy: packStrategy{},
+			cands: []NodeCandidate{
+				{Node: "pve1", FreeMemMB: 8000, CPU: 0.85, StorageFreeGB: 300, GameServers: 3},
+				{Node: "pve2", FreeMemMB: 8100, CPU: 0.05, StorageFreeGB: 300, GameServers: 3},
+			},
+			want: "pve2",
+		},
+		{
+			name:     "pack memory",
+			strategy: packStrategy{},
+			cands: []NodeCandidate{
+				{Node: "pve1", FreeMemMB: 30000, CPU: 0.20, StorageFreeGB: 300, GameServers: 1},
+				{Node: "pve2", FreeMemMB: 6000, CPU: 0.20, StorageFreeGB: 300, GameServers: 1},
+			},
+			want: "pve2",
+		},
+	} {
+		i, reason := tc.strategy.Pick(tc.cands, "")
+		if got := tc.cands[i].Node; got != tc.want {
+			t.Errorf("%s: picked %s (%s), want %s", tc.name, got, reason, tc.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+)
+
+// ProvisionTarget is the VM to provision.
+type ProvisionTarget struct {
+	Host    string
+	SSHUser string
+}
+
+// SSHUserFor returns the SSH user of a deployment's guest: root for
+// containers (LXC templates have no cloud-init user), otherwise the
+// configured cloud-init user.
+func SSHUserFor(req MinecraftDeploymentRequest, cfg *config.ProxmoxConfig) string {
+	if req.Guest() == proxmox.GuestLXC {
+		return "root"
+	}
+	if cfg == nil {
+		return ""
+	}
+	return cfg.SSHUser
+}
+
+// LogFunc records a provisioning log line; data (optional) is stored as
+// structured data with the line.
+type LogFunc func(level, msg string, data any)
+
+// Provisioner installs and starts the game server on a freshly booted VM.
+type Provisioner interface {
+	// Name is the identifier used in requests and settings ("ansible"...).
+	Name() string
+	// RequiresSSH reports whether the pipeline must wait for SSH on the VM
+	// before calling Provision.
+	RequiresSSH() bool
+	// Provision runs until the server is installed and started. It must be
+	// idempotent: a failed attempt may be replayed.
+	Provision(ctx context.Context, req MinecraftDeploymentRequest, target ProvisionTarget, log LogFunc) error
+}
+
+// DefaultProvisioner is used when neither the request, the settings nor
+// APP_PROVISIONER choose one.
+const DefaultProvisioner = "ansible"
+
+var provisioners = struct {
+	sync.RWMutex
+	m map[string]Provisioner
+}{m: map[string]Provisioner{
+	"ansible":    ansibleProvisioner{},
+	"ssh-script": sshScriptProvisioner{},
+}}
+
+// RegisterProvisioner makes p selectable under p.Name(), replacing any
+// provisioner with the same name.
+func RegisterProvisioner(p Provisioner) {
+	provisioners.Lock()
+	defer provisioners.Unlock()
+	provisioners.m[p.Name()] = p
+}
+
+// ProvisionerNames lists the registered provisioners.
+func ProvisionerNames() []string {
+	provisioners.RLock()
+	defer provisioners.RUnlock()
+	return provisionerNames()
+}
+
+// LookupProvisioner returns the provisioner registered under name.
+func LookupProvisioner(name string) (Provisioner, error) {
+	provisioners.RLock()
+	defer provisioners.RUnlock()
+	p, ok := provisioners.m[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return nil, fmt.Errorf("unknown provisioner %q (available: %s)", name, strings.Join(provisionerNames(), ", "))
+	}
+	return p, nil
+}
+
+// provisionerNames expects provisioners to be locked.
+func provisionerNames() []string {
+	names := make([]string, 0, len(provisioners.m))
+	for n := range provisioners.m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// provisionerFor resolves the provisioner of a deployment: request value
+// first, then the Proxmox settings, then APP_PROVISIONER, defaulting to
+// ansible.
+func provisionerFor(req MinecraftDeploymentRequest, cfg *config.ProxmoxConfig) (Provisioner, error) {
+	cfgName := ""
+	if cfg != nil {
+		cfgName = cfg.Provisioner
+	}
+	for _, name := range []string{req.Provisioner, cfgName, os.Getenv("APP_PROVISIONER")} {
+		if strings.TrimSpace(name) != "" {
+			return LookupProvisioner(name)
+		}
+	}
+	return LookupProvisioner(DefaultProvisioner)
+}
+
+// ansibleProvisioner runs the Ansible playbooks (default).
+type ansibleProvisioner struct{}
+
+func (ansibleProvisioner) Name() string      { return "ansible" }
+func (ansibleProvisioner) RequiresSSH() bool { return true }
+
+func (ansibleProvisioner) Provision(ctx context.Context, req MinecraftDeploymentRequest, target ProvisionTarget, log LogFunc) error {
+	return runAnsibleMinecraft(ctx, req, target.Host, target.SSHUser, func(e ansibleLogEntry) {
+		if e.Task != nil {
+			log(e.Level, e.Message, e.Task)
+			return
+		}
+		log(e.Level, e.Message, nil)
+	})
+}
+
+// FakeProvisioner does nothing on the VM: it records its calls and returns
+// Err. Register it (RegisterProvisioner) to run the pipeline without SSH nor
+// Ansible, e.g. in tests.
+type FakeProvisioner struct {
+	Err error
+
+	mu    sync.Mutex
+	calls []ProvisionTarget
+}
+
+func (f *FakeProvisioner) Name() string      { return "fake" }
+func (f *FakeProvisioner) RequiresSSH() bool { return false }
+
+func (f *FakeProvisioner) Provision(ctx context.Context, req MinecraftDeploymentRequest, target ProvisionTarget, log LogFunc) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, target)
+	f.mu.Unlock()
+	log("info", fmt.Sprintf("fake provisioning of %s on %s", req.Name, target.Host), nil)
+	return f.Err
+}
+
+// Calls returns the targets Provision was called with.
+func (f *FakeProvisioner) Calls() []ProvisionTarget {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ProvisionTarget(nil), f.calls...)
+}
@@ -0,0 +1,207 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/example/proxmox-game-deployer/internal/minecraft"
+	"github.com/example/proxmox-game-deployer/internal/sshexec"
+)
+
+// sshScriptProvisioner installs the server with a shell script sent over SSH
+// (no Ansible needed on the host running the app). It supports vanilla and
+// Fabric servers without modpack and mirrors what the playbook does:
+// Java 21, SFTP admin user chrooted in its home, server.properties, UFW and
+// the "minecraft" systemd service.
+type sshScriptProvisioner struct{}
+
+func (sshScriptProvisioner) Name() string      { return "ssh-script" }
+func (sshScriptProvisioner) RequiresSSH() bool { return true }
+
+func (sshScriptProvisioner) Provision(ctx context.Context, req MinecraftDeploymentRequest, target ProvisionTarget, log LogFunc) error {
+	script, err := minecraftScript(req)
+	if err != nil {
+		return err
+	}
+	user := target.SSHUser
+	if user == "" {
+		user = "root"
+	}
+	aptLock := false
+	var tail tailLines
+	tail.n = 40
+	err = sshexec.RunScript(ctx, target.Host, user, sshexec.KeyPath(), "sudo bash -s", strings.NewReader(script), func(line string) {
+		if strings.TrimSpace(line) == "" {
+			return
+		}
+		tail.add(line)
+		if isAptLockFailure(line) {
+			aptLock = true
+		}
+		level := "info"
+		if strings.HasPrefix(line, "ERROR:") {
+			level = "error"
+		}
+		log(level, line, nil)
+	})
+	if err != nil {
+		if out := strings.TrimSpace(tail.String()); out != "" {
+			err = fmt.Errorf("%w\n\nSortie du script (dernières lignes):\n%s", err, out)
+		}
+		if aptLock {
+			return Retryable(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// unitEscaper escapes text written in an unquoted heredoc. Line breaks are
+// turned into spaces so that a value cannot end the heredoc.
+var unitEscaper = strings.NewReplacer(`\`, `\\`, "$", `\$`, "`", "\\`", "\r", " ", "\n", " ")
+
+// noLineBreaks keeps a server.properties value on its line.
+var noLineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// minecraftScript builds the provisioning script. Every step is idempotent.
+func minecraftScript(req MinecraftDeploymentRequest) (string, error) {
+	mc := req.Minecraft
+	if mc.Modpack != nil || strings.TrimSpace(mc.ModpackURL) != "" {
+		return "", fmt.Errorf("ssh-script provisioner does not support modpacks, use ansible")
+	}
+	mcVer := strings.TrimSpace(mc.Version)
+	if mcVer == "" {
+		return "", fmt.Errorf("ssh-script provisioner requires minecraft.version")
+	}
+	var fabricInstaller, fabricLoader string
+	switch mc.Type {
+	case minecraft.TypeVanilla, "":
+	case minecraft.TypeFabric:
+		var err error
+		fabricInstaller, fabricLoader, err = minecraft.ResolveFabricInstallerParams(mcVer)
+		if err != nil {
+			return "", fmt.Errorf("résolution version Fabric: %w", err)
+		}
+	default:
+		return "", fmt.Errorf("ssh-script provisioner does not support %q servers, use ansible", mc.Type)
+	}
+	jarURL, err := minecraft.ResolveVanillaServerJarURL(mcVer)
+	if err != nil {
+		return "", fmt.Errorf("résolution version vanilla: %w", err)
+	}
+	return renderMinecraftScript(mc, jarURL, fabricInstaller, fabricLoader), nil
+}
+
+// renderMinecraftScript writes the script from the resolved download URLs.
+// Request values are quoted (shellQuote) or escaped (unitEscaper): the
+// script runs as root.
+func renderMinecraftScript(mc minecraft.Config, jarURL, fabricInstaller, fabricLoader string) string {
+	mcVer := strings.TrimSpace(mc.Version)
+	mcUser, mcDir := "minecraft", "/opt/minecraft"
+	if mc.AdminUser != "" {
+		mcUser, mcDir = mc.AdminUser, "/home/"+mc.AdminUser+"/minecraft"
+	}
+	rconPort := mc.RCONPort
+	if rconPort == 0 {
+		rconPort = 25575
+	}
+	ports := append([]int{mc.Port, rconPort}, mc.ExtraPorts...)
+	launchJar := "server.jar"
+	if fabricInstaller != "" {
+		launchJar = "fabric-server-launch.jar"
+	}
+
+	var b strings.Builder
+	w := func(format string, args ...any) { fmt.Fprintf(&b, format+"\n", args...) }
+	w("set -euo pipefail")
+	w("export DEBIAN_FRONTEND=noninteractive")
+	w("trap 'echo \"ERROR: command failed (line $LINENO)\"' ERR")
+	w("MC_USER=%s MC_DIR=%s", shellQuote(mcUser), shellQuote(mcDir))
+	w(`step() { echo "==> $*"; }`)
+	w(`wait_apt() { for i in $(seq 1 90); do fuser /var/lib/dpkg/lock-frontend /var/lib/dpkg/lock /var/lib/apt/lists/lock >/dev/null 2>&1 || return 0; sleep 2; done; echo "Could not get lock /var/lib/dpkg/lock-frontend"; return 1; }`)
+
+	w("step 'Installing Java 21'")
+	w("if ! dpkg -s openjdk-21-jre-headless >/dev/null 2>&1; then wait_apt; apt-get update -q; wait_apt; apt-get install -y -q openjdk-21-jre-headless; fi")
+
+	if mc.AdminUser != "" {
+		w("step 'Creating SFTP admin user'")
+		w(`id "$MC_USER" >/dev/null 2>&1 || useradd -m -d "/home/$MC_USER" -s /bin/bash "$MC_USER"`)
+		if mc.AdminPassword != "" {
+			w(`printf '%%s:%%s\n' "$MC_USER" %s | chpasswd`, shellQuote(mc.AdminPassword))
+		}
+		w(`chown root:root "/home/$MC_USER"; chmod 0755 "/home/$MC_USER"`)
+		w(`sed -i -E 's/^#?PasswordAuthentication\s+.*/PasswordAuthentication yes/; s/^#?KbdInteractiveAuthentication\s+.*/KbdInteractiveAuthentication yes/' /etc/ssh/sshd_config`)
+		w(`if ! grep -q "BEGIN DEPLOYER MANAGED - mcadmin chroot" /etc/ssh/sshd_config; then`)
+		w(`  printf '# BEGIN DEPLOYER MANAGED - mcadmin chroot\nMatch User %%s\n  ChrootDirectory /home/%%s\n  ForceCommand internal-sftp\n  AllowTcpForwarding no\n# END DEPLOYER MANAGED - mcadmin chroot\n' "$MC_USER" "$MC_USER" >> /etc/ssh/sshd_config`)
+		w(`  systemctl restart ssh 2>/dev/null || systemctl restart sshd`)
+		w("fi")
+	} else {
+		w("step 'Creating minecraft user'")
+		w(`getent group minecraft >/dev/null || groupadd minecraft`)
+		w(`id minecraft >/dev/null 2>&1 || useradd -m -s /bin/bash -g minecraft minecraft`)
+	}
+	w(`install -d -o "$MC_USER" -g "$MC_USER" -m 0755 "$MC_DIR"`)
+
+	w("step 'Downloading server jar'")
+	w(`[ -s "$MC_DIR/server.jar" ] || curl -fsSL -o "$MC_DIR/server.jar" %s`, shellQuote(jarURL))
+	if fabricInstaller != "" {
+		w("step %s", shellQuote("Installing Fabric loader "+fabricLoader))
+		w(`[ -s "$MC_DIR/fabric-installer.jar" ] || curl -fsSL -o "$MC_DIR/fabric-installer.jar" %s`, shellQuote(fabricInstaller))
+		w(`chown "$MC_USER:$MC_USER" "$MC_DIR"/*.jar`)
+		w(`[ -s "$MC_DIR/fabric-server-launch.jar" ] || (cd "$MC_DIR" && runuser -u "$MC_USER" -- java -jar fabric-installer.jar server -mcversion %s -loader %s)`, shellQuote(mcVer), shellQuote(fabricLoader))
+	}
+	w(`chown "$MC_USER:$MC_USER" "$MC_DIR"/*.jar`)
+
+	w("step 'Writing eula.txt and server.properties'")
+	w(`echo "eula=%t" > "$MC_DIR/eula.txt"`, mc.EULA)
+	props := []string{
+		fmt.Sprintf("server-port=%d", mc.Port),
+		"motd=" + mc.MOTD,
+		fmt.Sprintf("max-players=%d", mc.MaxPlayers),
+		fmt.Sprintf("online-mode=%t", mc.OnlineMode),
+		fmt.Sprintf("enable-rcon=%t", mc.RCONEnabled),
+		fmt.Sprintf("rcon.port=%d", rconPort),
+		"rcon.password=" + mc.RCONPassword,
+	}
+	for i, p := range props {
+		props[i] = shellQuote(noLineBreaks.Replace(p))
+	}
+	w(`printf '%%s\n' %s > "$MC_DIR/server.properties"`, strings.Join(props, " "))
+	w(`chown "$MC_USER:$MC_USER" "$MC_DIR/eula.txt" "$MC_DIR/server.properties"`)
+
+	w("step 'Opening firewall ports'")
+	w("if command -v ufw >/dev/null 2>&1; then")
+	for _, p := range ports {
+		if p > 0 {
+			w("  ufw allow %d/tcp >/dev/null", p)
+		}
+	}
+	w("fi")
+
+	w("step 'Installing systemd service'")
+	w(`cat > /etc/systemd/system/minecraft.service <<UNIT`)
+	w("[Unit]")
+	w("Description=Minecraft Server")
+	w("After=network.target")
+	w("")
+	w("[Service]")
+	w("WorkingDirectory=$MC_DIR")
+	w("User=$MC_USER")
+	w("Group=$MC_USER")
+	w("Restart=always")
+	w("ExecStart=/usr/bin/java -Xmx%s %s -jar %s nogui", unitEscaper.Replace(mc.JVMHeap), unitEscaper.Replace(mc.JVMFlags), launchJar)
+	w("")
+	w("[Install]")
+	w("WantedBy=multi-user.target")
+	w("UNIT")
+	w("systemctl daemon-reload")
+	w("systemctl enable --now minecraft")
+	w("step 'Minecraft server installed'")
+	return b.String()
+}
@@ -0,0 +1,58 @@
+package deploy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/example/proxmox-game-deployer/internal/minecraft"
+)
+
+func TestRenderMinecraftScriptEscapesRequestValues(t *testing.T) {
+	mc := minecraft.Config{
+		Version:      "1.21.1",
+		Port:         25565,
+		MaxPlayers:   10,
+		MOTD:         "hi\nPROPS\ntouch /tmp/pwned-motd",
+		RCONPassword: "x'; touch /tmp/pwned-rcon; '",
+		JVMHeap:      "2G$(touch /tmp/pwned-heap)",
+		JVMFlags:     "-XX:+UseG1GC\nUNIT\ntouch /tmp/pwned-flags `id`",
+	}
+	script := renderMinecraftScript(mc, "https://example.invalid/server.jar", "", "")
+
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(line, "touch ") || line == "PROPS" {
+			t.Fatalf("request value escaped its quoting: line %q", line)
+		}
+	}
+	if n := strings.Count(script, "\nUNIT\n"); n != 1 {
+		t.Fatalf("unit heredoc terminated %d times, want 1", n)
+	}
+	if !strings.Contains(script, `-Xmx2G\$(touch /tmp/pwned-heap)`) || !strings.Contains(script, "\\`id\\`") {
+		t.Fatalf("ExecStart not escaped:\n%s", script)
+	}
+	if !strings.Contains(script, `'rcon.password=x'\''; touch /tmp/pwned-rcon; '\'''`) {
+		t.Fatalf("rcon password not quoted:\n%s", script)
+	}
+}
+
+func TestValidateMinecraftRequestScriptValues(t *testing.T) {
+	base := MinecraftDeploymentRequest{Name: "mc", Cores: 2, MemoryMB: 4096, DiskGB: 20}
+	base.Minecraft.MaxPlayers = 10
+	for _, tc := range []struct {
+		name string
+		edit func(*MinecraftDeploymentRequest)
+		ok   bool
+	}{
+		{"heap", func(r *MinecraftDeploymentRequest) { r.Minecraft.JVMHeap = "3072M" }, true},
+		{"heap command", func(r *MinecraftDeploymentRequest) { r.Minecraft.JVMHeap = "2G $(id)" }, false},
+		{"flags newline", func(r *MinecraftDeploymentRequest) { r.Minecraft.JVMFlags = "-Xss1M\nUNIT" }, false},
+		{"motd newline", func(r *MinecraftDeploymentRequest) { r.Minecraft.MOTD = "hi\r\nPROPS" }, false},
+		{"rcon newline", func(r *MinecraftDeploymentRequest) { r.Minecraft.RCONPassword = "a\nb" }, false},
+	} {
+		req := base
+		tc.edit(&req)
+		if err := ValidateMinecraftRequest(req); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+)
+
+// RetryPolicy describes how many times a job type may run and how long to
+// wait between two attempts.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// retryPolicies holds the policy per job type. Types not listed run once.
+var retryPolicies = map[string]RetryPolicy{
+	"deploy_minecraft": {MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: 15 * time.Minute},
+}
+
+// retryPolicyFor returns the policy for a job type. APP_JOB_MAX_ATTEMPTS
+// overrides the number of attempts for every type.
+func retryPolicyFor(jobType string) RetryPolicy {
+	p, ok := retryPolicies[jobType]
+	if !ok {
+		p = RetryPolicy{MaxAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Minute}
+	}
+	if n := envInt("APP_JOB_MAX_ATTEMPTS", 0); n > 0 {
+		p.MaxAttempts = n
+	}
+	return p
+}
+
+// Backoff returns the delay before the next attempt, doubling after each
+// failed attempt (attempt starts at 1) and capped at MaxDelay.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if d >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return d
+}
+
+// retryableError marks an error as transient.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// Retryable wraps err so that the worker re-queues the job instead of
+// failing it for good.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+// IsRetryable reports whether err is a transient failure: explicitly marked
+// errors, locked Proxmox resources, other Proxmox 5xx responses and network
+// timeouts. Anything else (validation, not found, DRY_RUN, 4xx...) fails
+// immediately.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var re *retryableError
+	if errors.As(err, &re) {
+		return true
+	}
+	// Proxmox répond 500 à beaucoup d'erreurs définitives (VM absente,
+	// paramètres invalides) : seules les autres erreurs 5xx et les verrous
+	// sont considérés comme transitoires.
+	if errors.Is(err, proxmox.ErrLocked) {
+		return true
+	}
+	if errors.Is(err, proxmox.ErrNotFound) || errors.Is(err, proxmox.ErrValidation) || errors.Is(err, proxmox.ErrUnauthorized) {
+		return false
+	}
+	var se *proxmox.StatusError
+	if errors.As(err, &se) && se.StatusCode >= 500 {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	// Tâche Proxmox échouée faute d'obtenir un verrou (stockage, config VM) :
+	// une autre opération était en cours, on peut réessayer.
+	var te *proxmox.TaskError
+	if errors.As(err, &te) {
+		msg := strings.ToLower(te.ExitStatus + " " + strings.Join(te.Log, " "))
+		return strings.Contains(msg, "got timeout") || strings.Contains(msg, "can't lock")
+	}
+	return false
+}
+
+// aptLockMarkers are Ansible/apt messages caused by another apt process
+// (typically unattended-upgrades right after first boot).
+var aptLockMarkers = []string{
+	"Could not get lock",
+	"Unable to acquire the dpkg frontend lock",
+	"is another process using it",
+	"Failed to lock apt for exclusive operation",
+}
+
+// isAptLockFailure reports whether Ansible output shows a transient apt lock.
+func isAptLockFailure(output string) bool {
+	for _, m := range aptLockMarkers {
+		if strings.Contains(output, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// requeueJob puts a failed job back in the queue after delay and moves its
+// deployment back to "queued". Jobs cancelled in the meantime are left alone.
+func requeueJob(ctx context.Context, db Store, job *Job, policy RetryPolicy, cause error, delay time.Duration) {
+	now := time.Now().UTC()
+	msg := cause.Error()
+	_, _ = db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, run_after = ?, last_error = ?, lease_until = NULL, updated_at = ?
+		WHERE id = ? AND status = ?
+	`, string(JobQueued), now.Add(delay), msg, now, job.ID, string(JobRunning))
+	if job.DeploymentID == nil {
+		return
+	}
+	_, _ = db.ExecContext(ctx, `
+		UPDATE deployments SET status = ?, error_message = ?, updated_at = ?
+		WHERE id = ? AND status IN (?, ?)
+	`, string(StatusQueued), msg, now, *job.DeploymentID, string(StatusQueued), string(StatusRunning))
+	appendLog(ctx, db, *job.DeploymentID, "warn", fmt.Sprintf("Attempt %d/%d failed: %v — retrying in %s", job.Attempts, policy.MaxAttempts, cause, delay))
+}
+
+// deferJob puts a job whose nodes are all busy back in the queue without
+// counting the attempt.
+func deferJob(ctx context.Context, db Store, job *Job, delay time.Duration) {
+	now := time.Now().UTC()
+	_, _ = db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, attempts = MAX(attempts - 1, 0), run_after = ?, lease_until = NULL, updated_at = ?
+		WHERE id = ? AND status = ?
+	`, string(JobQueued), now.Add(delay), now, job.ID, string(JobRunning))
+	if job.DeploymentID == nil {
+		return
+	}
+	_, _ = db.ExecContext(ctx, `
+		UPDATE deployments SET status = ?, updated_at = ? WHERE id = ? AND status = ?
+	`, string(StatusQueued), now, *job.DeploymentID, string(StatusRunning))
+}
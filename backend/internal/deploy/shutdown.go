@@ -0,0 +1,99 @@
+package deploy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// errDraining is returned by the pipeline when it stopped at a checkpoint
+// because the worker is shutting down.
+var errDraining = errors.New("worker shutting down")
+
+type drainKey struct{}
+
+// withDrain attaches the worker stop channel to ctx so that the pipeline can
+// pause at its next checkpoint.
+func withDrain(ctx context.Context, stop <-chan struct{}) context.Context {
+	return context.WithValue(ctx, drainKey{}, stop)
+}
+
+// draining reports whether the worker attached to ctx is shutting down.
+func draining(ctx context.Context) bool {
+	stop, ok := ctx.Value(drainKey{}).(<-chan struct{})
+	if !ok {
+		return false
+	}
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops claiming new jobs and waits for in-flight jobs to reach
+// their next checkpoint, where they pause and go back to the queue. When ctx
+// expires first, the remaining jobs are interrupted (Proxmox waits, Ansible
+// processes) and re-queued as well: they resume from their last checkpoint at
+// next start.
+func (w *Worker) Shutdown(ctx context.Context) error {
+	w.Stop()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	w.mu.Lock()
+	w.aborting = true
+	log.Printf("[worker] shutdown deadline reached, interrupting %d job(s)", len(w.active))
+	for _, aj := range w.active {
+		aj.cancel()
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+	}
+	return ctx.Err()
+}
+
+func (w *Worker) isAborting() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.aborting
+}
+
+// pauseJob puts a job interrupted by a shutdown back in the queue without
+// consuming an attempt; it resumes from its last checkpoint.
+func pauseJob(ctx context.Context, db Store, job *Job) {
+	now := time.Now().UTC()
+	_, _ = db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, attempts = MAX(attempts - 1, 0), run_after = ?, lease_until = NULL, updated_at = ?
+		WHERE id = ? AND status = ?
+	`, string(JobQueued), now, now, job.ID, string(JobRunning))
+	log.Printf("[worker] job id=%d paused for shutdown", job.ID)
+	if job.DeploymentID == nil {
+		return
+	}
+	_, _ = db.ExecContext(ctx, `
+		UPDATE deployments SET status = ?, updated_at = ? WHERE id = ? AND status = ?
+	`, string(StatusQueued), now, *job.DeploymentID, string(StatusRunning))
+	var checkpoint sql.NullString
+	_ = db.QueryRowContext(ctx, `SELECT checkpoint FROM deployments WHERE id = ?`, *job.DeploymentID).Scan(&checkpoint)
+	step := "none"
+	if checkpoint.Valid && checkpoint.String != "" {
+		step = checkpoint.String
+	}
+	appendLog(ctx, db, *job.DeploymentID, "warn", fmt.Sprintf("Server shutting down: deployment paused after step %q, it will resume at next start", step))
+}
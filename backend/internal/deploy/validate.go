@@ -5,9 +5,15 @@ import (
 	"fmt"
 	"net"
 	neturl "net/url"
+	"regexp"
 	"strings"
+
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
 )
 
+// jvmHeapRe is the accepted jvm_heap format (e.g. 2G, 3072M).
+var jvmHeapRe = regexp.MustCompile(`^[0-9]+[MmGg]$`)
+
 // ValidateMinecraftRequest performs basic validation on deployment inputs.
 func ValidateMinecraftRequest(req MinecraftDeploymentRequest) error {
 	if req.Name == "" {
@@ -38,6 +44,36 @@ func ValidateMinecraftRequest(req MinecraftDeploymentRequest) error {
 		return errors.New("disk must be <= 500 GB")
 	}
 
+	guest, err := proxmox.ParseGuestType(req.GuestType)
+	if err != nil {
+		return err
+	}
+	if t := strings.TrimSpace(req.OSTemplate); t != "" {
+		if guest != proxmox.GuestLXC {
+			return errors.New("ostemplate requires guest_type \"lxc\"")
+		}
+		if !strings.Contains(t, ":vztmpl/") {
+			return fmt.Errorf("invalid ostemplate %q (expected storage:vztmpl/file)", t)
+		}
+	}
+
+	mode, err := ParseNetworkMode(req.NetworkMode)
+	if err != nil {
+		return err
+	}
+	if mode == NetworkDHCP && req.IPAddress != "" {
+		return errors.New("ip_address cannot be set with network_mode \"dhcp\"")
+	}
+	if mode == NetworkStatic && req.IPAddress == "" {
+		return errors.New("network_mode \"static\" requires ip_address")
+	}
+	if mode == NetworkPool && req.IPAddress != "" {
+		return errors.New("ip_address cannot be set with network_mode \"pool\"")
+	}
+	if req.IPPool != "" && mode != NetworkPool && (mode != "" || req.IPAddress != "") {
+		return errors.New("ip_pool requires network_mode \"pool\"")
+	}
+
 	// Network: IP/gateway are optional now (auto-allocation).
 	// If provided, validate; otherwise, they will be filled in server-side.
 	if req.IPAddress != "" {
@@ -96,9 +132,30 @@ func ValidateMinecraftRequest(req MinecraftDeploymentRequest) error {
 			return fmt.Errorf("extra port %d must be between 1 and 65535", p)
 		}
 	}
+	if _, err := ParseCleanupPolicy(req.OnFailure); err != nil {
+		return fmt.Errorf("on_failure: %w", err)
+	}
+	if req.Provisioner != "" {
+		if _, err := LookupProvisioner(req.Provisioner); err != nil {
+			return fmt.Errorf("provisioner: %w", err)
+		}
+	}
 	if req.Minecraft.MaxPlayers <= 0 {
 		return errors.New("max_players must be > 0")
 	}
+	// Ces valeurs sont écrites dans le script de provisioning (exécuté en root).
+	if h := req.Minecraft.JVMHeap; h != "" && !jvmHeapRe.MatchString(h) {
+		return fmt.Errorf("invalid jvm_heap %q (expected e.g. 2G or 3072M)", h)
+	}
+	for _, f := range []struct{ name, value string }{
+		{"jvm_flags", req.Minecraft.JVMFlags},
+		{"motd", req.Minecraft.MOTD},
+		{"rcon_password", req.Minecraft.RCONPassword},
+	} {
+		if strings.ContainsAny(f.value, "\r\n") {
+			return fmt.Errorf("%s must not contain line breaks", f.name)
+		}
+	}
 	return nil
 }
 
@@ -3,123 +3,208 @@ package deploy
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/example/proxmox-game-deployer/internal/config"
 )
 
-// Worker polls the jobs table and processes jobs.
+// Worker polls the jobs table and processes jobs with a pool of goroutines.
 type Worker struct {
-	DB         Store
+	DB           Store
 	PollInterval time.Duration
-	StopCh     chan struct{}
+	StopCh       chan struct{}
+	// Concurrency is the number of jobs that can run in parallel.
+	Concurrency int
+	// NodeLimit caps the number of jobs running at the same time on a single
+	// Proxmox node (0 = unlimited). NodeLimits overrides it per node.
+	NodeLimit  int
+	NodeLimits map[string]int
+
+	mu       sync.Mutex
+	running  map[string]int       // jobs en cours par node Proxmox
+	active   map[int64]*activeJob // jobs en cours par deployment_id
+	aborting bool                 // arrêt forcé : les jobs annulés sont mis en pause
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// activeJob tracks a job currently inside ProcessJob.
+type activeJob struct {
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 // NewWorker constructs a worker with sane defaults.
+// The pool size and per-node limits can be tuned with:
+//   - APP_WORKER_CONCURRENCY (default 3)
+//   - APP_WORKER_NODE_LIMIT (default 2, 0 = unlimited)
+//   - APP_WORKER_NODE_LIMITS (e.g. "pve1=1,pve2=4")
 func NewWorker(db Store) *Worker {
 	return &Worker{
-		DB:          db,
+		DB:           db,
 		PollInterval: 5 * time.Second,
-		StopCh:      make(chan struct{}),
+		StopCh:       make(chan struct{}),
+		Concurrency:  envInt("APP_WORKER_CONCURRENCY", 3),
+		NodeLimit:    envInt("APP_WORKER_NODE_LIMIT", 2),
+		NodeLimits:   parseNodeLimits(os.Getenv("APP_WORKER_NODE_LIMITS")),
+		running:      map[string]int{},
+		active:       map[int64]*activeJob{},
 	}
 }
 
-// Start begins the worker loop in a separate goroutine.
+// Start launches Concurrency worker loops, each in its own goroutine.
 func (w *Worker) Start() {
-	go func() {
-		for {
-			select {
-			case <-w.StopCh:
-				return
-			default:
-			}
-			if err := w.processNextJob(context.Background()); err != nil && !errors.Is(err, sql.ErrNoRows) {
-				log.Printf("worker error: %v", err)
-			}
-			time.Sleep(w.PollInterval)
+	n := w.Concurrency
+	if n <= 0 {
+		n = 1
+	}
+	log.Printf("[worker] starting %d worker(s), node limit=%d", n, w.NodeLimit)
+	// Réconciliation au démarrage : les jobs restés "running" après un crash
+	// ou un redémarrage sont re-queued ou passés en échec.
+	if err := w.ReapExpiredJobs(context.Background()); err != nil {
+		log.Printf("[worker] startup reconciliation: %v", err)
+	}
+	go w.reapLoop()
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		go func(slot int) {
+			defer w.wg.Done()
+			w.loop(slot)
+		}(i)
+	}
+}
+
+// loop polls for jobs until the worker is stopped. It only sleeps when no job
+// could be claimed so that a busy queue is drained without delay.
+func (w *Worker) loop(slot int) {
+	for {
+		select {
+		case <-w.StopCh:
+			return
+		default:
+		}
+		err := w.processNextJob(context.Background())
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("worker %d error: %v", slot, err)
 		}
-	}()
+		select {
+		case <-w.StopCh:
+			return
+		case <-time.After(w.PollInterval):
+		}
+	}
 }
 
-// Stop signals the worker to stop.
+// Stop signals the worker to stop claiming jobs. Running jobs pause at their
+// next checkpoint; use Shutdown to wait for them.
 func (w *Worker) Stop() {
-	close(w.StopCh)
+	w.stopOnce.Do(func() { close(w.StopCh) })
 }
 
-// processNextJob attempts to lock and execute a single queued job.
-func (w *Worker) processNextJob(ctx context.Context) error {
-	var job Job
-	var deploymentID sql.NullInt64
-
-	err := w.DB.WithTx(ctx, func(tx *sql.Tx) error {
-		// SQLite ne supporte pas "FOR UPDATE". Comme le worker est
-		// mono-processus dans ce projet, une simple sélection puis mise
-		// à jour en transaction est suffisante pour éviter les collisions.
-		row := tx.QueryRowContext(ctx, `
-			SELECT id, type, payload_json, status, deployment_id, run_after, last_error, attempts, created_at, updated_at
-			FROM jobs
-			WHERE status = ? AND run_after <= ?
-			ORDER BY id
-			LIMIT 1
-		`, string(JobQueued), time.Now().UTC())
+// Cancel aborts the running job of a deployment: in-flight Proxmox calls and
+// the Ansible process are interrupted through the job context. It returns a
+// channel closed once the worker is done with the job (cleanup included), and
+// false if no job of this deployment is running in this worker.
+func (w *Worker) Cancel(deploymentID int64) (<-chan struct{}, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	aj, ok := w.active[deploymentID]
+	if !ok {
+		return nil, false
+	}
+	aj.cancel()
+	return aj.done, true
+}
 
-		var lastErr sql.NullString
-		if err := row.Scan(
-			&job.ID,
-			&job.Type,
-			&job.PayloadJSON,
-			&job.Status,
-			&deploymentID,
-			&job.RunAfter,
-			&lastErr,
-			&job.Attempts,
-			&job.CreatedAt,
-			&job.UpdatedAt,
-		); err != nil {
-			return err
-		}
-		if lastErr.Valid {
-			msg := lastErr.String
-			job.LastError = &msg
-		}
-		if deploymentID.Valid {
-			id := deploymentID.Int64
-			job.DeploymentID = &id
-		}
+// track registers a running job and returns its cancellable context and a
+// function to call when the job is finished.
+func (w *Worker) track(ctx context.Context, job *Job) (context.Context, func()) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	if job.DeploymentID == nil {
+		return jobCtx, cancel
+	}
+	aj := &activeJob{cancel: cancel, done: make(chan struct{})}
+	w.mu.Lock()
+	if w.active == nil {
+		w.active = map[int64]*activeJob{}
+	}
+	w.active[*job.DeploymentID] = aj
+	w.mu.Unlock()
+	return jobCtx, func() {
+		cancel()
+		w.mu.Lock()
+		delete(w.active, *job.DeploymentID)
+		w.mu.Unlock()
+		close(aj.done)
+	}
+}
 
-		// Mark as running.
-		job.Status = JobRunning
-		job.Attempts++
-		job.UpdatedAt = time.Now().UTC()
-		_, err := tx.ExecContext(ctx, `
-			UPDATE jobs
-			SET status = ?, attempts = ?, updated_at = ?
-			WHERE id = ?
-		`, string(job.Status), job.Attempts, job.UpdatedAt, job.ID)
-		return err
-	})
+// processNextJob attempts to claim and execute a single queued job.
+func (w *Worker) processNextJob(ctx context.Context) error {
+	// La config est chargée avant le claim pour connaître le node par défaut
+	// et les nodes de placement (nécessaire pour appliquer les limites par node).
+	cfg, cfgErr := config.LoadProxmoxConfig(ctx, w.DB)
 
+	job, node, err := w.claimNextJob(ctx, cfg)
 	if err != nil {
 		return err
 	}
+	slot := &nodeSlot{w: w, node: node}
+	defer slot.release()
+	stopHeartbeat := w.heartbeat(ctx, job)
+	defer stopHeartbeat()
 
-	log.Printf("[worker] processing job id=%d type=%s deployment_id=%v", job.ID, job.Type, job.DeploymentID)
+	log.Printf("[worker] processing job id=%d type=%s deployment_id=%v node=%s", job.ID, job.Type, job.DeploymentID, node)
 
-	// Load proxmox config.
-	cfg, err := config.LoadProxmoxConfig(ctx, w.DB)
-	if err != nil {
-		log.Printf("[worker] failed to load Proxmox config: %v", err)
-		markJobAndDeploymentFailed(ctx, w.DB, &job, err)
-		errMsg := err.Error()
+	if cfgErr != nil {
+		log.Printf("[worker] failed to load Proxmox config: %v", cfgErr)
+		markJobAndDeploymentFailed(ctx, w.DB, job, cfgErr)
+		errMsg := cfgErr.Error()
 		_, _ = w.DB.ExecContext(ctx, `UPDATE jobs SET status = ?, last_error = ?, updated_at = ? WHERE id = ?`,
 			string(JobFailed), errMsg, time.Now().UTC(), job.ID)
-		return err
+		return cfgErr
 	}
 
 	// ProcessJob can be long running; we run it outside of the transaction.
-	err = ProcessJob(ctx, w.DB, &job, cfg)
+	// It gets its own context so that it can be cancelled, while the
+	// bookkeeping below keeps using ctx.
+	jobCtx, finished := w.track(withNodeSlot(withDrain(ctx, w.StopCh), slot), job)
+	defer finished()
+	err = ProcessJob(jobCtx, w.DB, job, cfg)
+
+	if errors.Is(err, errDraining) || (err != nil && jobCtx.Err() != nil && w.isAborting()) {
+		pauseJob(ctx, w.DB, job)
+		return nil
+	}
+	if errors.Is(err, errNodesBusy) {
+		deferJob(ctx, w.DB, job, w.PollInterval)
+		return nil
+	}
+	if err != nil && jobCtx.Err() != nil {
+		log.Printf("[worker] job id=%d cancelled: %v", job.ID, err)
+		markJobAndDeploymentCancelled(ctx, w.DB, job, cfg)
+		return nil
+	}
+
+	if err != nil && IsRetryable(err) {
+		policy := retryPolicyFor(job.Type)
+		if job.Attempts < policy.MaxAttempts {
+			delay := policy.Backoff(job.Attempts)
+			log.Printf("[worker] job id=%d attempt %d/%d failed, retrying in %s: %v", job.ID, job.Attempts, policy.MaxAttempts, delay, err)
+			requeueJob(ctx, w.DB, job, policy, err, delay)
+			return err
+		}
+	}
 
 	finalStatus := JobDone
 	var lastError *string
@@ -128,7 +213,8 @@ func (w *Worker) processNextJob(ctx context.Context) error {
 		msg := err.Error()
 		lastError = &msg
 		finalStatus = JobFailed
-		markJobAndDeploymentFailed(ctx, w.DB, &job, err)
+		markJobAndDeploymentFailed(ctx, w.DB, job, err)
+		CleanupFailedDeployment(ctx, w.DB, job, cfg)
 	} else {
 		log.Printf("[worker] job id=%d completed successfully", job.ID)
 	}
@@ -142,6 +228,261 @@ func (w *Worker) processNextJob(ctx context.Context) error {
 	return err
 }
 
+// claimNextJob atomically moves the oldest runnable job to "running" and
+// reserves a slot on its target node. Jobs whose node is already at its
+// concurrency limit are skipped (they stay queued for a later poll). Jobs
+// left to the placement engine take the unlimited "" slot, moved to the
+// chosen node by placeDeployment. Returns sql.ErrNoRows when nothing can be
+// claimed.
+func (w *Worker) claimNextJob(ctx context.Context, cfg *config.ProxmoxConfig) (*Job, string, error) {
+	var job *Job
+	var node string
+
+	err := w.DB.WithTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT id, type, payload_json, status, deployment_id, run_after, last_error, attempts, created_at, updated_at
+			FROM jobs
+			WHERE status = ? AND run_after <= ?
+			ORDER BY id
+			LIMIT 50
+		`, string(JobQueued), time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		var candidates []*Job
+		for rows.Next() {
+			j, err := scanJob(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			candidates = append(candidates, j)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, j := range candidates {
+			n := jobNode(j, cfg)
+			if !w.reserveNode(n) {
+				continue
+			}
+			// Le WHERE status = 'queued' garantit qu'un seul worker peut
+			// passer la ligne en "running", même si deux workers ont
+			// sélectionné le même job.
+			now := time.Now().UTC()
+			res, err := tx.ExecContext(ctx, `
+				UPDATE jobs
+				SET status = ?, attempts = attempts + 1, lease_until = ?, updated_at = ?
+				WHERE id = ? AND status = ?
+			`, string(JobRunning), now.Add(leaseDuration), now, j.ID, string(JobQueued))
+			if err != nil {
+				w.releaseNode(n)
+				return err
+			}
+			if affected, _ := res.RowsAffected(); affected != 1 {
+				w.releaseNode(n)
+				continue
+			}
+			j.Status = JobRunning
+			j.Attempts++
+			j.UpdatedAt = now
+			job, node = j, n
+			return nil
+		}
+		return sql.ErrNoRows
+	})
+	if err != nil {
+		// The transaction was rolled back: give back the reserved slot.
+		if job != nil {
+			w.releaseNode(node)
+		}
+		return nil, "", err
+	}
+	return job, node, nil
+}
+
+// reserveNode takes a slot on node if its limit allows it.
+func (w *Worker) reserveNode(node string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reserveNodeLocked(node)
+}
+
+func (w *Worker) reserveNodeLocked(node string) bool {
+	if w.running == nil {
+		w.running = map[string]int{}
+	}
+	limit := w.NodeLimit
+	if l, ok := w.NodeLimits[node]; ok {
+		limit = l
+	}
+	// "" : job pas encore placé, limité une fois son node choisi.
+	if node != "" && limit > 0 && w.running[node] >= limit {
+		return false
+	}
+	w.running[node]++
+	return true
+}
+
+// nodeSlot is the node slot held by a running job.
+type nodeSlot struct {
+	w    *Worker
+	node string
+}
+
+type nodeSlotKey struct{}
+
+// withNodeSlot attaches the slot of the job to ctx for placeDeployment.
+func withNodeSlot(ctx context.Context, s *nodeSlot) context.Context {
+	return context.WithValue(ctx, nodeSlotKey{}, s)
+}
+
+// nodeSlotFrom returns the slot attached to ctx, nil outside the worker.
+func nodeSlotFrom(ctx context.Context) *nodeSlot {
+	s, _ := ctx.Value(nodeSlotKey{}).(*nodeSlot)
+	return s
+}
+
+// moveTo moves the slot to node if its limit allows it. A nil slot (job
+// run outside the worker) always moves.
+func (s *nodeSlot) moveTo(node string) bool {
+	if s == nil {
+		return true
+	}
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	if node == s.node {
+		return true
+	}
+	if !s.w.reserveNodeLocked(node) {
+		return false
+	}
+	if s.w.running[s.node] > 0 {
+		s.w.running[s.node]--
+	}
+	s.node = node
+	return true
+}
+
+// release frees the slot.
+func (s *nodeSlot) release() {
+	s.w.mu.Lock()
+	node := s.node
+	s.w.mu.Unlock()
+	s.w.releaseNode(node)
+}
+
+// releaseNode frees a slot previously taken with reserveNode.
+func (w *Worker) releaseNode(node string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.running[node] > 0 {
+		w.running[node]--
+	}
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanJob reads a jobs row selected with the standard column list.
+func scanJob(rows rowScanner) (*Job, error) {
+	var job Job
+	var deploymentID sql.NullInt64
+	var lastErr sql.NullString
+	if err := rows.Scan(
+		&job.ID,
+		&job.Type,
+		&job.PayloadJSON,
+		&job.Status,
+		&deploymentID,
+		&job.RunAfter,
+		&lastErr,
+		&job.Attempts,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+	if lastErr.Valid {
+		msg := lastErr.String
+		job.LastError = &msg
+	}
+	if deploymentID.Valid {
+		id := deploymentID.Int64
+		job.DeploymentID = &id
+	}
+	return &job, nil
+}
+
+// jobNode returns the Proxmox node a job will run on: request node, "" when
+// the placement engine will choose it (allowed_nodes), else the default node.
+func jobNode(j *Job, cfg *config.ProxmoxConfig) string {
+	var req MinecraftDeploymentRequest
+	if err := json.Unmarshal([]byte(j.PayloadJSON), &req); err == nil && req.Node != "" {
+		return req.Node
+	}
+	if cfg == nil {
+		return ""
+	}
+	if len(cfg.AllowedNodes) > 0 {
+		return ""
+	}
+	return cfg.DefaultNode
+}
+
+// CancelQueuedDeployment cancels a deployment whose job is not running in
+// this process (queued, or waiting for a retry): its job is marked cancelled
+// and the cleanup policy is applied to a VM left by a previous attempt.
+func CancelQueuedDeployment(ctx context.Context, db Store, deploymentID int64) error {
+	row := db.QueryRowContext(ctx, `
+		SELECT id, type, payload_json, status, deployment_id, run_after, last_error, attempts, created_at, updated_at
+		FROM jobs
+		WHERE deployment_id = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`, deploymentID)
+	job, err := scanJob(row)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.LoadProxmoxConfig(ctx, db)
+	if err != nil {
+		cfg = nil
+	}
+	markJobAndDeploymentCancelled(ctx, db, job, cfg)
+	return nil
+}
+
+// markJobAndDeploymentCancelled finalises a job aborted by Cancel. A
+// deployment being deleted is left to the delete handler; otherwise the
+// cleanup policy is applied and the deployment ends up "cancelled".
+func markJobAndDeploymentCancelled(ctx context.Context, db Store, job *Job, cfg *config.ProxmoxConfig) {
+	now := time.Now().UTC()
+	_, _ = db.ExecContext(ctx, `UPDATE jobs SET status = ?, updated_at = ? WHERE id = ?`, string(JobCancelled), now, job.ID)
+	if job.DeploymentID == nil {
+		return
+	}
+	var status string
+	if err := db.QueryRowContext(ctx, `SELECT status FROM deployments WHERE id = ?`, *job.DeploymentID).Scan(&status); err != nil {
+		return
+	}
+	if DeploymentStatus(status) == StatusDeleting {
+		return
+	}
+	appendLog(ctx, db, *job.DeploymentID, "warn", "Deployment cancelled")
+	CleanupFailedDeployment(ctx, db, job, cfg)
+	msg := "cancelled by user"
+	_, _ = db.ExecContext(ctx, `
+		UPDATE deployments SET status = ?, error_message = ?, updated_at = ?
+		WHERE id = ?
+	`, string(StatusCancelled), msg, time.Now().UTC(), *job.DeploymentID)
+	NotifyDeployment(*job.DeploymentID)
+}
+
 func markJobAndDeploymentFailed(ctx context.Context, db Store, job *Job, err error) {
 	if job.DeploymentID == nil {
 		return
@@ -151,5 +492,36 @@ func markJobAndDeploymentFailed(ctx context.Context, db Store, job *Job, err err
 		UPDATE deployments SET status = ?, error_message = ?, updated_at = ?
 		WHERE id = ?
 	`, string(StatusFailed), errMsg, time.Now().UTC(), *job.DeploymentID)
+	NotifyDeployment(*job.DeploymentID)
 }
 
+// envInt reads an integer environment variable, falling back to def.
+func envInt(key string, def int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// parseNodeLimits parses "node=limit" pairs separated by commas.
+func parseNodeLimits(raw string) map[string]int {
+	out := map[string]int{}
+	for _, part := range strings.Split(raw, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil {
+			continue
+		}
+		out[strings.TrimSpace(kv[0])] = n
+	}
+	return out
+}
@@ -0,0 +1,258 @@
+package ipam
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Allocation is an address of a pool held by a deployment.
+type Allocation struct {
+	IP           string `json:"ip_address"`
+	PoolID       int64  `json:"pool_id"`
+	DeploymentID int64  `json:"deployment_id"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// Lease is the result of Allocate: the address and the pool settings the
+// deployment must use.
+type Lease struct {
+	IP   string
+	Pool *Pool
+	// Skipped lists the free addresses passed over because they answered
+	// the conflict check.
+	Skipped []string
+}
+
+// allocMu serialise les insertions d'allocations (pas le sondage réseau)
+// et la création du pool par défaut.
+var allocMu sync.Mutex
+
+// Probe reports whether ip is already in use on the network (answers a ping
+// or is in the ARP cache). Tests may replace it.
+var Probe = func(ctx context.Context, ip string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	// Le ping remplit aussi le cache ARP : un hôte qui filtre l'ICMP mais
+	// répond en ARP est détecté par arpHasEntry.
+	if err := exec.CommandContext(ctx, "ping", "-c", "1", "-W", "1", ip).Run(); err == nil {
+		return true
+	}
+	return arpHasEntry(ip)
+}
+
+// arpHasEntry reports whether the Linux ARP cache has a resolved entry for
+// ip (always false elsewhere).
+func arpHasEntry(ip string) bool {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 4 && fields[0] == ip && fields[2] != "0x0" && fields[3] != "00:00:00:00:00:00" {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictCheckEnabled reports whether addresses are probed before being
+// assigned (APP_IPAM_CONFLICT_CHECK=false disables it).
+func conflictCheckEnabled() bool {
+	v := strings.ToLower(strings.TrimSpace(os.Getenv("APP_IPAM_CONFLICT_CHECK")))
+	return v != "false" && v != "0" && v != "no"
+}
+
+// usedAddresses returns the addresses not to allocate: every allocation and
+// every address recorded on another deployment (static or DHCP ones
+// included).
+func usedAddresses(ctx context.Context, db Store, deploymentID int64) (map[string]bool, error) {
+	used := map[string]bool{}
+	for _, q := range []string{
+		`SELECT ip_address FROM ip_allocations WHERE deployment_id != ?`,
+		`SELECT ip_address FROM deployments WHERE ip_address IS NOT NULL AND ip_address != '' AND id != ?`,
+	} {
+		rows, err := db.QueryContext(ctx, q, deploymentID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var ip string
+			if err := rows.Scan(&ip); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			used[ip] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return used, nil
+}
+
+// maxProbes caps the addresses probed by one allocation: a range full of
+// hosts unknown to the app must not hold the worker for minutes.
+const maxProbes = 16
+
+// Allocate assigns a free address of pool to a deployment. It is
+// idempotent: a deployment that already holds an address gets it back.
+// preferred (the address of a previous run, optional) is taken again when
+// still free; otherwise free addresses that answer the conflict check are
+// skipped. Probes run without allocMu held: the primary key on ip_address
+// settles two deployments racing for the same address.
+func Allocate(ctx context.Context, db Store, pool *Pool, deploymentID int64, preferred string) (*Lease, error) {
+	first, last, err := pool.bounds()
+	if err != nil {
+		return nil, err
+	}
+	excluded := pool.excluded()
+	lease := &Lease{Pool: pool}
+
+	// claim inserts ip for the deployment under allocMu, unless the
+	// deployment got an address meanwhile (returned in held) or ip was
+	// taken.
+	claim := func(ip string) (held *Lease, ok bool, err error) {
+		allocMu.Lock()
+		defer allocMu.Unlock()
+		if a, err := Lookup(ctx, db, deploymentID); err == nil {
+			p := pool
+			if a.PoolID != pool.ID {
+				if p, err = GetPool(ctx, db, a.PoolID); err != nil {
+					return nil, false, err
+				}
+			}
+			return &Lease{IP: a.IP, Pool: p}, false, nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, false, err
+		}
+		if ip == "" {
+			return nil, false, nil
+		}
+		used, err := usedAddresses(ctx, db, deploymentID)
+		if err != nil || used[ip] {
+			return nil, false, err
+		}
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO ip_allocations (ip_address, pool_id, deployment_id, created_at) VALUES (?, ?, ?, ?)
+		`, ip, pool.ID, deploymentID, time.Now().UTC())
+		if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+			return nil, false, nil
+		}
+		return nil, err == nil, err
+	}
+
+	// L'adresse d'un run précédent n'est pas sondée : la VM peut déjà
+	// tourner avec elle.
+	if n, ok := ipv4(preferred); !ok || n < first || n > last || excluded[preferred] {
+		preferred = ""
+	}
+	held, ok, err := claim(preferred)
+	if err != nil || held != nil {
+		return held, err
+	}
+	if ok {
+		lease.IP = preferred
+		return lease, nil
+	}
+
+	used, err := usedAddresses(ctx, db, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	check := conflictCheckEnabled()
+	probes := 0
+	for n := uint64(first); n <= uint64(last); n++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ip := ipString(uint32(n))
+		if used[ip] || excluded[ip] || ip == preferred {
+			continue
+		}
+		if check {
+			if probes == maxProbes {
+				return nil, fmt.Errorf("pool %q: %w (the %d free addresses probed are in use on the network)", pool.Name, ErrPoolExhausted, probes)
+			}
+			probes++
+			if Probe(ctx, ip) {
+				lease.Skipped = append(lease.Skipped, ip)
+				continue
+			}
+		}
+		held, ok, err := claim(ip)
+		if err != nil || held != nil {
+			return held, err
+		}
+		if ok {
+			lease.IP = ip
+			return lease, nil
+		}
+	}
+	return nil, fmt.Errorf("pool %q: %w", pool.Name, ErrPoolExhausted)
+}
+
+// Lookup returns the allocation of a deployment (sql.ErrNoRows if none).
+func Lookup(ctx context.Context, db Store, deploymentID int64) (*Allocation, error) {
+	var a Allocation
+	var created time.Time
+	err := db.QueryRowContext(ctx, `
+		SELECT ip_address, pool_id, deployment_id, created_at FROM ip_allocations WHERE deployment_id = ?
+	`, deploymentID).Scan(&a.IP, &a.PoolID, &a.DeploymentID, &created)
+	if err != nil {
+		return nil, err
+	}
+	a.CreatedAt = created.Format(time.RFC3339)
+	return &a, nil
+}
+
+// Release frees the address of a deployment, if any. Deleting the
+// deployment releases it too (ON DELETE CASCADE).
+func Release(ctx context.Context, db Store, deploymentID int64) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM ip_allocations WHERE deployment_id = ?`, deploymentID)
+	return err
+}
+
+// ListAllocations returns the allocations of a pool, by address.
+func ListAllocations(ctx context.Context, db Store, poolID int64) ([]Allocation, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT ip_address, pool_id, deployment_id, created_at FROM ip_allocations WHERE pool_id = ?
+	`, poolID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Allocation
+	for rows.Next() {
+		var a Allocation
+		var created time.Time
+		if err := rows.Scan(&a.IP, &a.PoolID, &a.DeploymentID, &created); err != nil {
+			return nil, err
+		}
+		a.CreatedAt = created.Format(time.RFC3339)
+		out = append(out, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Tri numérique (10.0.0.9 avant 10.0.0.10).
+	sort.Slice(out, func(i, j int) bool {
+		a, _ := ipv4(out[i].IP)
+		b, _ := ipv4(out[j].IP)
+		return a < b
+	})
+	return out, nil
+}
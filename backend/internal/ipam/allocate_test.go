@@ -0,0 +1,138 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/example/proxmox-game-deployer/internal/db"
+)
+
+func newTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	d, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if err := d.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func addDeployment(t *testing.T, d *db.DB) int64 {
+	t.Helper()
+	res, err := d.ExecContext(context.Background(), `
+		INSERT INTO deployments (game, type, request_json, status, created_at, updated_at)
+		VALUES ('minecraft', 'vm', '{}', 'queued', datetime('now'), datetime('now'))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+func TestResolvePoolLegacyDefault(t *testing.T) {
+	t.Setenv("APP_NET_CIDR", "192.168.1.0/24")
+	t.Setenv("APP_NET_GATEWAY", "192.168.1.1")
+	t.Setenv("APP_NET_DNS", "")
+	d := newTestDB(t)
+	ctx := context.Background()
+
+	// Deux jobs concurrents ne doivent créer qu'un seul pool par défaut.
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = ResolvePool(ctx, d, "")
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("ResolvePool: %v", err)
+		}
+	}
+	pools, err := ListPools(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 1 {
+		t.Fatalf("%d pools created, want 1", len(pools))
+	}
+	p := pools[0]
+	if p.Name != DefaultPoolName || p.RangeStart != "192.168.1.10" || p.RangeEnd != "192.168.1.249" {
+		t.Fatalf("default pool = %s %s-%s, want default 192.168.1.10-192.168.1.249", p.Name, p.RangeStart, p.RangeEnd)
+	}
+}
+
+func TestAllocateSkipsConflicts(t *testing.T) {
+	t.Setenv("APP_IPAM_CONFLICT_CHECK", "")
+	d := newTestDB(t)
+	ctx := context.Background()
+	pool := &Pool{Name: "lan", CIDR: "10.0.0.0/24", Gateway: "10.0.0.1", RangeStart: "10.0.0.1", RangeEnd: "10.0.0.3"}
+	if err := CreatePool(ctx, d, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	// 10.0.0.2 répond sur le réseau sans être connue de l'application.
+	orig := Probe
+	t.Cleanup(func() { Probe = orig })
+	Probe = func(_ context.Context, ip string) bool { return ip == "10.0.0.2" }
+
+	lease, err := Allocate(ctx, d, pool, addDeployment(t, d), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.IP != "10.0.0.3" || len(lease.Skipped) != 1 || lease.Skipped[0] != "10.0.0.2" {
+		t.Fatalf("lease %s skipped %v, want 10.0.0.3 skipping 10.0.0.2", lease.IP, lease.Skipped)
+	}
+	if _, err := Allocate(ctx, d, pool, addDeployment(t, d), ""); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("allocation in a full pool: %v, want ErrPoolExhausted", err)
+	}
+}
+
+func TestAllocateProbesOutsideLock(t *testing.T) {
+	t.Setenv("APP_IPAM_CONFLICT_CHECK", "")
+	d := newTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := &Pool{Name: "lan", CIDR: "10.0.0.0/24", Gateway: "10.0.0.1"}
+	if err := CreatePool(ctx, d, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tout le réseau répond : le nombre de sondes est plafonné et aucune ne
+	// tient allocMu.
+	orig := Probe
+	t.Cleanup(func() { Probe = orig })
+	probes, locked := 0, false
+	Probe = func(context.Context, string) bool {
+		probes++
+		if !allocMu.TryLock() {
+			locked = true
+		} else {
+			allocMu.Unlock()
+		}
+		return true
+	}
+	_, err := Allocate(ctx, d, pool, addDeployment(t, d), "")
+	if !errors.Is(err, ErrPoolExhausted) || probes != maxProbes {
+		t.Fatalf("err = %v after %d probes, want ErrPoolExhausted after %d", err, probes, maxProbes)
+	}
+	if locked {
+		t.Fatal("Probe ran with allocMu held")
+	}
+
+	// Une annulation arrête la recherche entre deux sondes.
+	Probe = func(context.Context, string) bool { cancel(); return true }
+	if _, err := Allocate(ctx, d, pool, addDeployment(t, d), ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
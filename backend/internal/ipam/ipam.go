@@ -0,0 +1,400 @@
+// Package ipam manages the IPv4 pools deployments get their static address
+// from: pools are stored in the database (ip_pools), and each allocation
+// (ip_allocations) is tied to a deployment until it is released.
+package ipam
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Store is the subset of DB operations used by the ipam package.
+type Store interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error
+}
+
+var (
+	// ErrNoPool is returned when no pool matches (or none is configured).
+	ErrNoPool = errors.New("ip pool not found")
+	// ErrPoolInUse is returned when deleting a pool that still has
+	// allocations.
+	ErrPoolInUse = errors.New("ip pool has allocated addresses")
+	// ErrPoolExhausted is returned when a pool has no free address left.
+	ErrPoolExhausted = errors.New("no free address in ip pool")
+	// ErrInvalidPool is returned when the settings of a pool are invalid.
+	ErrInvalidPool = errors.New("invalid ip pool")
+	// ErrPoolExists is returned when another pool has the same name.
+	ErrPoolExists = errors.New("ip pool already exists")
+)
+
+// DefaultPoolName is the pool created from APP_NET_CIDR when none exists.
+const DefaultPoolName = "default"
+
+// Pool is an IPv4 subnet deployments get addresses from. Addresses are
+// allocated between RangeStart and RangeEnd (the whole subnet without the
+// network and broadcast addresses when unset), the gateway and Reserved
+// addresses excluded. Bridge and VLAN, when set, are applied to the
+// deployments of the pool.
+type Pool struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	CIDR       string   `json:"cidr"`
+	Gateway    string   `json:"gateway"`
+	DNS        string   `json:"dns,omitempty"`
+	VLAN       *int     `json:"vlan,omitempty"`
+	Bridge     string   `json:"bridge,omitempty"`
+	RangeStart string   `json:"range_start,omitempty"`
+	RangeEnd   string   `json:"range_end,omitempty"`
+	Reserved   []string `json:"reserved,omitempty"`
+	CreatedAt  string   `json:"created_at,omitempty"`
+	UpdatedAt  string   `json:"updated_at,omitempty"`
+}
+
+// Prefix returns the prefix length of the pool subnet.
+func (p *Pool) Prefix() int {
+	_, ipNet, err := net.ParseCIDR(p.CIDR)
+	if err != nil {
+		return 0
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
+
+// ipv4 parses an IPv4 address into its integer form.
+func ipv4(s string) (uint32, bool) {
+	ip := net.ParseIP(strings.TrimSpace(s)).To4()
+	if ip == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip), true
+}
+
+func ipString(n uint32) string {
+	b := make(net.IP, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b.String()
+}
+
+// bounds returns the first and last allocatable addresses of the pool.
+func (p *Pool) bounds() (uint32, uint32, error) {
+	ip, ipNet, err := net.ParseCIDR(p.CIDR)
+	if err != nil || ip.To4() == nil {
+		return 0, 0, fmt.Errorf("invalid cidr %q (IPv4 expected)", p.CIDR)
+	}
+	ones, _ := ipNet.Mask.Size()
+	if ones > 30 {
+		return 0, 0, fmt.Errorf("cidr %s is too small (at most /30)", p.CIDR)
+	}
+	network := binary.BigEndian.Uint32(ipNet.IP.To4())
+	broadcast := network | ^binary.BigEndian.Uint32(net.IP(ipNet.Mask).To4())
+	first, last := network+1, broadcast-1
+	if p.RangeStart != "" {
+		n, ok := ipv4(p.RangeStart)
+		if !ok || n < first || n > last {
+			return 0, 0, fmt.Errorf("range_start %q is not a host address of %s", p.RangeStart, p.CIDR)
+		}
+		first = n
+	}
+	if p.RangeEnd != "" {
+		n, ok := ipv4(p.RangeEnd)
+		if !ok || n < first || n > last {
+			return 0, 0, fmt.Errorf("range_end %q is not a host address of %s after range_start", p.RangeEnd, p.CIDR)
+		}
+		last = n
+	}
+	return first, last, nil
+}
+
+// excluded returns the addresses of the pool never allocated: the gateway
+// and the reserved ones.
+func (p *Pool) excluded() map[string]bool {
+	out := map[string]bool{p.Gateway: true}
+	for _, r := range p.Reserved {
+		out[strings.TrimSpace(r)] = true
+	}
+	return out
+}
+
+// Size returns the number of allocatable addresses of the pool.
+func (p *Pool) Size() int {
+	first, last, err := p.bounds()
+	if err != nil {
+		return 0
+	}
+	size := int(last - first + 1)
+	for ip := range p.excluded() {
+		if n, ok := ipv4(ip); ok && n >= first && n <= last {
+			size--
+		}
+	}
+	return size
+}
+
+// Contains reports whether ip belongs to the pool subnet.
+func (p *Pool) Contains(ip string) bool {
+	_, ipNet, err := net.ParseCIDR(p.CIDR)
+	addr := net.ParseIP(ip)
+	return err == nil && addr != nil && ipNet.Contains(addr)
+}
+
+// Validate checks and normalizes the pool (CIDR in canonical form, DNS
+// defaulting to the gateway). Errors wrap ErrInvalidPool.
+func (p *Pool) Validate() error {
+	if err := p.validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPool, err)
+	}
+	return nil
+}
+
+func (p *Pool) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	_, ipNet, err := net.ParseCIDR(strings.TrimSpace(p.CIDR))
+	if err != nil || ipNet.IP.To4() == nil {
+		return fmt.Errorf("invalid cidr %q (IPv4 expected)", p.CIDR)
+	}
+	p.CIDR = ipNet.String()
+	first, last, err := p.bounds()
+	if err != nil {
+		return err
+	}
+	gw, ok := ipv4(p.Gateway)
+	if !ok || !p.Contains(p.Gateway) {
+		return fmt.Errorf("gateway %q is not an address of %s", p.Gateway, p.CIDR)
+	}
+	p.Gateway = ipString(gw)
+	if p.DNS == "" {
+		p.DNS = p.Gateway
+	}
+	for _, d := range strings.Split(p.DNS, " ") {
+		if d != "" && net.ParseIP(d) == nil {
+			return fmt.Errorf("invalid dns %q", d)
+		}
+	}
+	if p.VLAN != nil && (*p.VLAN < 1 || *p.VLAN > 4094) {
+		return fmt.Errorf("invalid vlan %d (1-4094)", *p.VLAN)
+	}
+	reserved := p.Reserved[:0]
+	for _, r := range p.Reserved {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		if !p.Contains(r) || net.ParseIP(r).To4() == nil {
+			return fmt.Errorf("reserved address %q is not an address of %s", r, p.CIDR)
+		}
+		reserved = append(reserved, r)
+	}
+	p.Reserved = reserved
+	if p.Size() <= 0 {
+		return fmt.Errorf("range %s-%s has no allocatable address", ipString(first), ipString(last))
+	}
+	return nil
+}
+
+const poolColumns = `id, name, cidr, gateway, dns, vlan, bridge, range_start, range_end, reserved_json, created_at, updated_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPool(row scanner) (*Pool, error) {
+	var p Pool
+	var dns, bridge, start, end, reserved sql.NullString
+	var vlan sql.NullInt64
+	var created, updated time.Time
+	if err := row.Scan(&p.ID, &p.Name, &p.CIDR, &p.Gateway, &dns, &vlan, &bridge, &start, &end, &reserved, &created, &updated); err != nil {
+		return nil, err
+	}
+	p.DNS, p.Bridge, p.RangeStart, p.RangeEnd = dns.String, bridge.String, start.String, end.String
+	if vlan.Valid {
+		v := int(vlan.Int64)
+		p.VLAN = &v
+	}
+	if reserved.String != "" {
+		_ = json.Unmarshal([]byte(reserved.String), &p.Reserved)
+	}
+	p.CreatedAt = created.Format(time.RFC3339)
+	p.UpdatedAt = updated.Format(time.RFC3339)
+	return &p, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullVLAN(v *int) sql.NullInt64 {
+	if v == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*v), Valid: true}
+}
+
+func reservedJSON(r []string) sql.NullString {
+	if len(r) == 0 {
+		return sql.NullString{}
+	}
+	raw, _ := json.Marshal(r)
+	return nullString(string(raw))
+}
+
+// ListPools returns all pools, by ID.
+func ListPools(ctx context.Context, db Store) ([]Pool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+poolColumns+` FROM ip_pools ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Pool
+	for rows.Next() {
+		p, err := scanPool(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *p)
+	}
+	return out, rows.Err()
+}
+
+// GetPool returns a pool by ID.
+func GetPool(ctx context.Context, db Store, id int64) (*Pool, error) {
+	p, err := scanPool(db.QueryRowContext(ctx, `SELECT `+poolColumns+` FROM ip_pools WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("pool %d: %w", id, ErrNoPool)
+	}
+	return p, err
+}
+
+// GetPoolByName returns a pool by name.
+func GetPoolByName(ctx context.Context, db Store, name string) (*Pool, error) {
+	p, err := scanPool(db.QueryRowContext(ctx, `SELECT `+poolColumns+` FROM ip_pools WHERE name = ?`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("pool %q: %w", name, ErrNoPool)
+	}
+	return p, err
+}
+
+// CreatePool validates and stores a new pool.
+func CreatePool(ctx context.Context, db Store, p *Pool) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO ip_pools (name, cidr, gateway, dns, vlan, bridge, range_start, range_end, reserved_json, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, p.Name, p.CIDR, p.Gateway, nullString(p.DNS), nullVLAN(p.VLAN), nullString(p.Bridge),
+		nullString(p.RangeStart), nullString(p.RangeEnd), reservedJSON(p.Reserved), now, now)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return fmt.Errorf("pool %q: %w", p.Name, ErrPoolExists)
+		}
+		return err
+	}
+	p.ID, _ = res.LastInsertId()
+	p.CreatedAt = now.Format(time.RFC3339)
+	p.UpdatedAt = p.CreatedAt
+	return nil
+}
+
+// UpdatePool validates and saves p (matched by ID). Existing allocations are
+// kept even if they fall outside the new range.
+func UpdatePool(ctx context.Context, db Store, p *Pool) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	res, err := db.ExecContext(ctx, `
+		UPDATE ip_pools SET name = ?, cidr = ?, gateway = ?, dns = ?, vlan = ?, bridge = ?, range_start = ?,
+			range_end = ?, reserved_json = ?, updated_at = ?
+		WHERE id = ?
+	`, p.Name, p.CIDR, p.Gateway, nullString(p.DNS), nullVLAN(p.VLAN), nullString(p.Bridge),
+		nullString(p.RangeStart), nullString(p.RangeEnd), reservedJSON(p.Reserved), now, p.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return fmt.Errorf("pool %q: %w", p.Name, ErrPoolExists)
+		}
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("pool %d: %w", p.ID, ErrNoPool)
+	}
+	p.UpdatedAt = now.Format(time.RFC3339)
+	return nil
+}
+
+// DeletePool deletes a pool without allocations.
+func DeletePool(ctx context.Context, db Store, id int64) error {
+	return db.WithTx(ctx, func(tx *sql.Tx) error {
+		var used int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM ip_allocations WHERE pool_id = ?`, id).Scan(&used); err != nil {
+			return err
+		}
+		if used > 0 {
+			return fmt.Errorf("pool %d: %w (%d)", id, ErrPoolInUse, used)
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM ip_pools WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("pool %d: %w", id, ErrNoPool)
+		}
+		return nil
+	})
+}
+
+// ResolvePool returns the pool named name or, when name is empty, the first
+// pool. Without any pool, a "default" pool is created from the legacy
+// environment (APP_NET_CIDR, APP_NET_GATEWAY, APP_NET_DNS), allocating from
+// .10 to .249 as autoNetwork used to.
+func ResolvePool(ctx context.Context, db Store, name string) (*Pool, error) {
+	if name != "" {
+		return GetPoolByName(ctx, db, name)
+	}
+	// Sous allocMu : deux jobs sans pool ne doivent pas créer chacun le pool
+	// par défaut.
+	allocMu.Lock()
+	defer allocMu.Unlock()
+	p, err := scanPool(db.QueryRowContext(ctx, `SELECT `+poolColumns+` FROM ip_pools ORDER BY id LIMIT 1`))
+	if err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return p, err
+	}
+
+	cidr := os.Getenv("APP_NET_CIDR")
+	if cidr == "" {
+		return nil, fmt.Errorf("%w: create one (/api/ipam/pools) or set APP_NET_CIDR", ErrNoPool)
+	}
+	gw := os.Getenv("APP_NET_GATEWAY")
+	if gw == "" {
+		return nil, fmt.Errorf("APP_NET_GATEWAY is not set")
+	}
+	def := &Pool{Name: DefaultPoolName, CIDR: cidr, Gateway: gw, DNS: os.Getenv("APP_NET_DNS")}
+	if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ipNet.IP.To4() != nil {
+		network := binary.BigEndian.Uint32(ipNet.IP.To4())
+		ones, _ := ipNet.Mask.Size()
+		if ones <= 28 {
+			def.RangeStart = ipString(network + 10)
+		}
+		// autoNetwork parcourait le dernier octet de 10 à 249 du premier /24.
+		if ones <= 24 {
+			def.RangeEnd = ipString(network + 249)
+		}
+	}
+	if err := CreatePool(ctx, db, def); err != nil {
+		return nil, fmt.Errorf("default pool from APP_NET_CIDR: %w", err)
+	}
+	return def, nil
+}
@@ -0,0 +1,213 @@
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AgentInterface is a network interface reported by the guest
+// (agent/network-get-interfaces, or /interfaces for containers).
+type AgentInterface struct {
+	Name            string           `json:"name"`
+	HardwareAddress string           `json:"hardware-address"`
+	IPAddresses     []AgentIPAddress `json:"ip-addresses"`
+}
+
+// AgentIPAddress is an address of an AgentInterface.
+type AgentIPAddress struct {
+	Type    string `json:"ip-address-type"` // ipv4, ipv6
+	Address string `json:"ip-address"`
+	Prefix  int    `json:"prefix"`
+}
+
+// AgentFilesystem is a mounted filesystem reported by agent/get-fsinfo.
+type AgentFilesystem struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	TotalBytes int64  `json:"total-bytes"`
+	UsedBytes  int64  `json:"used-bytes"`
+}
+
+// AgentExecStatus is the state of a command started with AgentExec.
+type AgentExecStatus struct {
+	Exited   int    `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	OutData  string `json:"out-data"`
+	ErrData  string `json:"err-data"`
+}
+
+// AgentEnabled reports whether the agent option of a VM config is on
+// ("1", "enabled=1,fstrim_cloned_disks=1"...).
+func AgentEnabled(vmConfig map[string]any) bool {
+	v := strings.TrimSpace(fmt.Sprint(vmConfig["agent"]))
+	for _, part := range strings.Split(v, ",") {
+		if part == "1" || part == "enabled=1" {
+			return true
+		}
+	}
+	return false
+}
+
+// agentPath returns the agent endpoint of a VM; containers have no agent.
+func (c *Client) agentPath(node string, vmid int, cmd string) (string, error) {
+	if c.isLXC() {
+		return "", fmt.Errorf("container %d: %w", vmid, ErrNoAgent)
+	}
+	return c.guestPath(node, vmid) + "/agent/" + cmd, nil
+}
+
+// AgentPing checks that the guest agent answers.
+func (c *Client) AgentPing(ctx context.Context, node string, vmid int) error {
+	path, err := c.agentPath(node, vmid, "ping")
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, path, nil, nil)
+}
+
+// AgentNetworkInterfaces returns the network interfaces of a running guest.
+// Containers need no agent: their interfaces come from /interfaces.
+func (c *Client) AgentNetworkInterfaces(ctx context.Context, node string, vmid int) ([]AgentInterface, error) {
+	if c.isLXC() {
+		var ifaces []struct {
+			Name   string `json:"name"`
+			HWAddr string `json:"hwaddr"`
+			Inet   string `json:"inet"`
+			Inet6  string `json:"inet6"`
+		}
+		if err := c.do(ctx, http.MethodGet, c.guestPath(node, vmid)+"/interfaces", nil, &ifaces); err != nil {
+			return nil, err
+		}
+		out := make([]AgentInterface, 0, len(ifaces))
+		for _, i := range ifaces {
+			ai := AgentInterface{Name: i.Name, HardwareAddress: i.HWAddr}
+			for _, a := range [][2]string{{"ipv4", i.Inet}, {"ipv6", i.Inet6}} {
+				if ip, ipNet, err := net.ParseCIDR(a[1]); err == nil {
+					prefix, _ := ipNet.Mask.Size()
+					ai.IPAddresses = append(ai.IPAddresses, AgentIPAddress{Type: a[0], Address: ip.String(), Prefix: prefix})
+				}
+			}
+			out = append(out, ai)
+		}
+		return out, nil
+	}
+	path, err := c.agentPath(node, vmid, "network-get-interfaces")
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Result []AgentInterface `json:"result"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Result, nil
+}
+
+// AgentFSInfo returns the mounted filesystems of a running VM.
+func (c *Client) AgentFSInfo(ctx context.Context, node string, vmid int) ([]AgentFilesystem, error) {
+	path, err := c.agentPath(node, vmid, "get-fsinfo")
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Result []AgentFilesystem `json:"result"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Result, nil
+}
+
+// AgentExec starts command (program and arguments) in the VM, with input
+// on its stdin, and returns its PID for AgentExecStatus.
+func (c *Client) AgentExec(ctx context.Context, node string, vmid int, command []string, input string) (int, error) {
+	path, err := c.agentPath(node, vmid, "exec")
+	if err != nil {
+		return 0, err
+	}
+	q := url.Values{"command": command}
+	if input != "" {
+		q.Set("input-data", input)
+	}
+	var res struct {
+		PID int `json:"pid"`
+	}
+	if err := c.do(ctx, http.MethodPost, path, q, &res); err != nil {
+		return 0, err
+	}
+	return res.PID, nil
+}
+
+// AgentExecStatus returns the state (and output once exited) of a command
+// started with AgentExec.
+func (c *Client) AgentExecStatus(ctx context.Context, node string, vmid, pid int) (*AgentExecStatus, error) {
+	path, err := c.agentPath(node, vmid, "exec-status")
+	if err != nil {
+		return nil, err
+	}
+	var st AgentExecStatus
+	if err := c.do(ctx, http.MethodGet, path, url.Values{"pid": {fmt.Sprint(pid)}}, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// RunAgentCommand runs command in the VM through the guest agent and waits
+// for it to exit.
+func RunAgentCommand(ctx context.Context, api API, node string, vmid int, command []string, timeout time.Duration) (*AgentExecStatus, error) {
+	pid, err := api.AgentExec(ctx, node, vmid, command, "")
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := api.AgentExecStatus(ctx, node, vmid, pid)
+		if err != nil {
+			return nil, err
+		}
+		if st.Exited == 1 {
+			return st, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("agent exec %q: timeout after %s", strings.Join(command, " "), timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// GuestIPv4 returns the IPv4 addresses of ifaces, loopback and link-local
+// excluded.
+func GuestIPv4(ifaces []AgentInterface) []string {
+	var out []string
+	for _, i := range ifaces {
+		for _, a := range i.IPAddresses {
+			ip := net.ParseIP(a.Address)
+			if a.Type != "ipv4" || ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			out = append(out, a.Address)
+		}
+	}
+	return out
+}
+
+// RootFilesystem returns the filesystem mounted on "/", or nil.
+func RootFilesystem(fs []AgentFilesystem) *AgentFilesystem {
+	for i := range fs {
+		if fs[i].Mountpoint == "/" {
+			return &fs[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// API is the subset of the Proxmox API used by the application. *Client
+// implements it against a real cluster; tests can point a Client at a
+// proxmoxtest.FakeServer or provide their own implementation.
+type API interface {
+	TestConnection(ctx context.Context) error
+	NextID(ctx context.Context) (int, error)
+	CloneVM(ctx context.Context, node string, templateVMID, newVMID int, name, storage string) (string, error)
+	CloneVMWithOptions(ctx context.Context, node string, templateVMID, newVMID int, name string, opts CloneOptions) (string, error)
+	MigrateVM(ctx context.Context, node string, vmid int, target string, online bool, targetStorage string) (string, error)
+	LocateVM(ctx context.Context, vmid int) (string, error)
+	ConfigureVM(ctx context.Context, node string, vmid int, cores, memoryMB, diskGB int, bridge string, vlanTag *int, ipCIDR, gateway string) error
+	UpdateVMConfig(ctx context.Context, node string, vmid, cores, memoryMB int) error
+	GetVMConfig(ctx context.Context, node string, vmid int) (map[string]any, error)
+	GetScsi0SizeGB(ctx context.Context, node string, vmid int) (int, error)
+	ResizeDisk(ctx context.Context, node string, vmid, diskGB int) (string, error)
+	StartVM(ctx context.Context, node string, vmid int) (string, error)
+	StopVM(ctx context.Context, node string, vmid int) (string, error)
+	DeleteVM(ctx context.Context, node string, vmid int) (string, error)
+	GetVMStatusCurrent(ctx context.Context, node string, vmid int) (*VMStatusCurrent, error)
+	WaitForTask(ctx context.Context, node, upid string, timeout time.Duration) error
+	TaskLog(ctx context.Context, node, upid string) ([]string, error)
+
+	ListNodes(ctx context.Context) ([]NodeInfo, error)
+	ListStorages(ctx context.Context, node string) ([]StorageInfo, error)
+	ListBridges(ctx context.Context, node string) ([]BridgeInfo, error)
+	ListTemplates(ctx context.Context) ([]TemplateInfo, error)
+
+	ListSnapshots(ctx context.Context, node string, vmid int) ([]Snapshot, error)
+	CreateSnapshot(ctx context.Context, node string, vmid int, name, description string, vmstate bool) (string, error)
+	RollbackSnapshot(ctx context.Context, node string, vmid int, name string) (string, error)
+	DeleteSnapshot(ctx context.Context, node string, vmid int, name string) (string, error)
+
+	SetCloudInit(ctx context.Context, node string, vmid int, opts CloudInitOptions) error
+	NodeAddress(ctx context.Context, node string) (string, error)
+	StoragePath(ctx context.Context, storage string) (string, error)
+
+	AgentPing(ctx context.Context, node string, vmid int) error
+	AgentNetworkInterfaces(ctx context.Context, node string, vmid int) ([]AgentInterface, error)
+	AgentFSInfo(ctx context.Context, node string, vmid int) ([]AgentFilesystem, error)
+	AgentExec(ctx context.Context, node string, vmid int, command []string, input string) (int, error)
+	AgentExecStatus(ctx context.Context, node string, vmid, pid int) (*AgentExecStatus, error)
+
+	CreateLXC(ctx context.Context, node string, vmid int, opts LXCOptions) (string, error)
+	// ForGuest returns an API whose per-VM methods address guests of type t.
+	ForGuest(t GuestType) API
+}
+
+var _ API = (*Client)(nil)
+
+// WaitForSSH waits until the given host:port is accessible via TCP.
+func WaitForSSH(ctx context.Context, host string, port int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	addr := fmt.Sprintf("%s:%d", host, port)
+	for {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for ssh on %s", addr)
+		}
+		d := net.Dialer{Timeout: 5 * time.Second}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
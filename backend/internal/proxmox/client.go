@@ -4,26 +4,137 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Client is a minimal HTTP client for the Proxmox API.
 type Client struct {
-	baseURL   *url.URL
-	tokenID   string
+	baseURL     *url.URL
+	tokenID     string
 	tokenSecret string
-	http      *http.Client
+	http        *http.Client
+	opts        Options
+
+	// Authentification par ticket (utilisateur/mot de passe), voir ticket.go.
+	// Partagée entre les vues ForGuest d'un même client.
+	username string
+	password string
+	ticket   *ticketState
+
+	// guest is the kind of guest the per-VM methods address (qemu when
+	// empty), see ForGuest.
+	guest GuestType
+}
+
+// GuestType is the kind of Proxmox guest: QEMU virtual machine or LXC
+// container.
+type GuestType string
+
+const (
+	GuestQEMU GuestType = "qemu"
+	GuestLXC  GuestType = "lxc"
+)
+
+// ParseGuestType validates a guest type; empty means qemu.
+func ParseGuestType(s string) (GuestType, error) {
+	switch GuestType(strings.ToLower(strings.TrimSpace(s))) {
+	case GuestQEMU, "":
+		return GuestQEMU, nil
+	case GuestLXC:
+		return GuestLXC, nil
+	}
+	return "", fmt.Errorf("guest_type must be %q or %q", GuestQEMU, GuestLXC)
+}
+
+// ForGuest returns a client whose per-VM methods (config, power, resize,
+// clone, migrate, snapshots...) address guests of type t. It shares the
+// connection and credentials of c.
+func (c *Client) ForGuest(t GuestType) API {
+	cp := *c
+	cp.guest = t
+	return &cp
+}
+
+func (c *Client) isLXC() bool { return c.guest == GuestLXC }
+
+// guestPath returns /nodes/{node}/{qemu|lxc}/{vmid}.
+func (c *Client) guestPath(node string, vmid int) string {
+	kind := c.guest
+	if kind == "" {
+		kind = GuestQEMU
+	}
+	return fmt.Sprintf("/nodes/%s/%s/%d", node, kind, vmid)
+}
+
+// Options tunes the HTTP behaviour of a Client.
+type Options struct {
+	// Timeout bounds each HTTP call (each attempt when retried).
+	Timeout time.Duration
+	// MaxRetries is how many times an idempotent call (GET) is retried after
+	// a connection error or a 5xx response. Calls that never reached the
+	// server (dial errors) are retried whatever their method.
+	MaxRetries int
+	// RetryDelay is the base delay between two attempts, doubled each time,
+	// with jitter.
+	RetryDelay time.Duration
+}
+
+// DefaultOptions returns the options from APP_PROXMOX_TIMEOUT (seconds,
+// default 30) and APP_PROXMOX_RETRIES (default 3).
+func DefaultOptions() Options {
+	o := Options{Timeout: 30 * time.Second, MaxRetries: 3, RetryDelay: 500 * time.Millisecond}
+	if n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("APP_PROXMOX_TIMEOUT"))); err == nil && n > 0 {
+		o.Timeout = time.Duration(n) * time.Second
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("APP_PROXMOX_RETRIES"))); err == nil && n >= 0 {
+		o.MaxRetries = n
+	}
+	return o
 }
 
-// NewClient constructs a new Proxmox API client.
+// NewClient constructs a new Proxmox API client with DefaultOptions.
 func NewClient(rawURL, tokenID, tokenSecret string) (*Client, error) {
+	return NewClientWithOptions(rawURL, tokenID, tokenSecret, DefaultOptions())
+}
+
+// NewClientWithOptions constructs a new Proxmox API client authenticated
+// with an API token.
+func NewClientWithOptions(rawURL, tokenID, tokenSecret string, opts Options) (*Client, error) {
+	c, err := newClient(rawURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.tokenID, c.tokenSecret = tokenID, tokenSecret
+	return c, nil
+}
+
+// NewTicketClient constructs a new Proxmox API client authenticated with a
+// realm user ("user@pve") and its password. It logs in on first use and
+// renews its ticket before it expires.
+func NewTicketClient(rawURL, username, password string, opts Options) (*Client, error) {
+	if username == "" || password == "" {
+		return nil, errors.New("proxmox: username and password are required")
+	}
+	c, err := newClient(rawURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.username, c.password = username, password
+	return c, nil
+}
+
+func newClient(rawURL string, opts Options) (*Client, error) {
 	u, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, err
@@ -31,6 +142,12 @@ func NewClient(rawURL, tokenID, tokenSecret string) (*Client, error) {
 	if u.Scheme == "" {
 		u.Scheme = "https"
 	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = 500 * time.Millisecond
+	}
 	// TLS config: par défaut on vérifie le certificat.
 	// Si APP_PROXMOX_INSECURE_TLS=true, on ignore les erreurs TLS
 	// (pratique pour un lab avec certificat auto-signé).
@@ -42,35 +159,72 @@ func NewClient(rawURL, tokenID, tokenSecret string) (*Client, error) {
 	}
 
 	return &Client{
-		baseURL:   u,
-		tokenID:   tokenID,
-		tokenSecret: tokenSecret,
-		http: &http.Client{
-			Timeout:   30 * time.Second,
-			Transport: tr,
-		},
+		baseURL: u,
+		// Pas de timeout global : chaque appel a le sien (opts.Timeout).
+		http:   &http.Client{Transport: tr},
+		opts:   opts,
+		ticket: &ticketState{},
 	}, nil
 }
 
 // do issues an HTTP request with Proxmox auth headers and decodes JSON.
-func (c *Client) do(ctx context.Context, method, path string, query url.Values, out any) error {
+// Parameters go in the query string for GET/DELETE and in a form-encoded
+// body otherwise, so that long or secret values (cicustom, sshkeys,
+// passwords) never end up in URLs and access logs.
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, out any) error {
+	relogged := false
+	for attempt := 0; ; attempt++ {
+		err := c.doOnce(ctx, method, path, params, out)
+		if c.username != "" && !relogged && errors.Is(err, ErrUnauthorized) {
+			// Ticket révoqué ou expiré côté Proxmox : nouvelle connexion, une fois.
+			c.ticket.reset()
+			relogged = true
+			attempt--
+			continue
+		}
+		if err == nil || attempt >= c.opts.MaxRetries || !c.shouldRetry(method, err) || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retryDelay(c.opts.RetryDelay, attempt)):
+		}
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, method, path string, params url.Values, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
 	u := *c.baseURL
 	u.Path = "/api2/json" + path
-	if len(query) > 0 {
-		u.RawQuery = query.Encode()
+	var body io.Reader
+	form := method == http.MethodPost || method == http.MethodPut
+	if len(params) > 0 {
+		if form {
+			body = strings.NewReader(params.Encode())
+		} else {
+			u.RawQuery = params.Encode()
+		}
 	}
-	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("PVEAPIToken=%s=%s", c.tokenID, c.tokenSecret))
+	if form && body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if err := c.authorize(ctx, req); err != nil {
+		return err
+	}
 	resp, err := c.http.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("proxmox api error: %s", resp.Status)
+		return newStatusError(resp)
 	}
 	if out == nil {
 		return nil
@@ -87,6 +241,29 @@ func (c *Client) do(ctx context.Context, method, path string, query url.Values,
 	return json.Unmarshal(wrapper.Data, out)
 }
 
+// shouldRetry reports whether a failed call may be sent again.
+func (c *Client) shouldRetry(method string, err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true // la requête n'a jamais atteint Proxmox
+	}
+	if method != http.MethodGet {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500 && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrValidation) && !errors.Is(err, ErrNoAgent)
+	}
+	// Erreur réseau (connexion coupée, timeout de l'appel...).
+	return true
+}
+
+// retryDelay returns base*2^attempt plus up to 50% of random jitter.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	d := base << attempt
+	return d + rand.N(d/2+1)
+}
+
 // TestConnection simply calls /nodes to ensure credentials are valid.
 func (c *Client) TestConnection(ctx context.Context) error {
 	var nodes []map[string]any
@@ -108,14 +285,74 @@ func (c *Client) NextID(ctx context.Context) (int, error) {
 
 // CloneVM clones a VM from a template VMID on a given node.
 func (c *Client) CloneVM(ctx context.Context, node string, templateVMID, newVMID int, name, storage string) (string, error) {
-	// POST /nodes/{node}/qemu/{vmid}/clone
-	path := fmt.Sprintf("/nodes/%s/qemu/%d/clone", node, templateVMID)
-	q := url.Values{}
-	q.Set("newid", fmt.Sprintf("%d", newVMID))
-	q.Set("name", name)
 	// NOTE: on ne force plus le storage ici pour éviter les combinaisons
 	// invalides selon le type de template (linked/full clone). Proxmox
 	// utilisera le même storage que le template par défaut.
+	return c.CloneVMWithOptions(ctx, node, templateVMID, newVMID, name, CloneOptions{})
+}
+
+// CloneOptions are the optional parameters of a clone.
+type CloneOptions struct {
+	// Target is the node the clone is created on; Proxmox only allows it
+	// when the template disks are on shared storage.
+	Target string
+	// Full requests a full clone instead of a linked one.
+	Full bool
+	// Storage is the storage of the clone disks (full clones only).
+	Storage string
+}
+
+// CloneVMWithOptions clones templateVMID, which lives on node, into newVMID.
+func (c *Client) CloneVMWithOptions(ctx context.Context, node string, templateVMID, newVMID int, name string, opts CloneOptions) (string, error) {
+	// POST /nodes/{node}/{qemu|lxc}/{vmid}/clone
+	path := c.guestPath(node, templateVMID) + "/clone"
+	q := url.Values{}
+	q.Set("newid", fmt.Sprintf("%d", newVMID))
+	if c.isLXC() {
+		q.Set("hostname", name)
+	} else {
+		q.Set("name", name)
+	}
+	if opts.Target != "" && opts.Target != node {
+		q.Set("target", opts.Target)
+	}
+	if opts.Full {
+		q.Set("full", "1")
+		if opts.Storage != "" {
+			q.Set("storage", opts.Storage)
+		}
+	}
+	var taskID string
+	if err := c.do(ctx, http.MethodPost, path, q, &taskID); err != nil {
+		return "", err
+	}
+	return taskID, nil
+}
+
+// MigrateVM moves a VM to another node. Offline migrations copy local disks
+// to targetStorage (or to a storage with the same name when empty); online
+// ones live-migrate a running VM (containers are restarted on the target).
+func (c *Client) MigrateVM(ctx context.Context, node string, vmid int, target string, online bool, targetStorage string) (string, error) {
+	path := c.guestPath(node, vmid) + "/migrate"
+	q := url.Values{}
+	q.Set("target", target)
+	if c.isLXC() {
+		// Pas de migration à chaud pour un conteneur : restart migration.
+		if online {
+			q.Set("restart", "1")
+		}
+		if targetStorage != "" {
+			q.Set("target-storage", targetStorage)
+		}
+	} else {
+		if online {
+			q.Set("online", "1")
+		}
+		q.Set("with-local-disks", "1")
+		if targetStorage != "" {
+			q.Set("targetstorage", targetStorage)
+		}
+	}
 	var taskID string
 	if err := c.do(ctx, http.MethodPost, path, q, &taskID); err != nil {
 		return "", err
@@ -123,9 +360,31 @@ func (c *Client) CloneVM(ctx context.Context, node string, templateVMID, newVMID
 	return taskID, nil
 }
 
-// ConfigureVM sets CPU, memory and network including cloud-init ipconfig0.
+// LocateVM returns the node a VM (or template) currently lives on.
+func (c *Client) LocateVM(ctx context.Context, vmid int) (string, error) {
+	var resources []struct {
+		VMID int    `json:"vmid"`
+		Node string `json:"node"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/cluster/resources", url.Values{"type": {"vm"}}, &resources); err != nil {
+		return "", err
+	}
+	for _, r := range resources {
+		if r.VMID == vmid {
+			return r.Node, nil
+		}
+	}
+	return "", fmt.Errorf("vm %d: %w", vmid, ErrNotFound)
+}
+
+// DHCP is the ipCIDR of ConfigureVM (and LXCOptions.IPCIDR) for guests
+// that get their address by DHCP.
+const DHCP = "dhcp"
+
+// ConfigureVM sets CPU, memory and network including cloud-init ipconfig0
+// (for containers the static IP goes in net0). ipCIDR may be DHCP.
 func (c *Client) ConfigureVM(ctx context.Context, node string, vmid int, cores, memoryMB, diskGB int, bridge string, vlanTag *int, ipCIDR, gateway string) error {
-	path := fmt.Sprintf("/nodes/%s/qemu/%d/config", node, vmid)
+	path := c.guestPath(node, vmid) + "/config"
 	q := url.Values{}
 	if cores > 0 {
 		q.Set("cores", fmt.Sprintf("%d", cores))
@@ -133,22 +392,37 @@ func (c *Client) ConfigureVM(ctx context.Context, node string, vmid int, cores,
 	if memoryMB > 0 {
 		q.Set("memory", fmt.Sprintf("%d", memoryMB))
 	}
-	net := fmt.Sprintf("virtio,bridge=%s", bridge)
-	if vlanTag != nil {
-		net = net + fmt.Sprintf(",tag=%d", *vlanTag)
-	}
-	q.Set("net0", net)
-	if ipCIDR != "" && gateway != "" {
-		q.Set("ipconfig0", fmt.Sprintf("ip=%s,gw=%s", ipCIDR, gateway))
+	if c.isLXC() {
+		q.Set("net0", lxcNet0(bridge, vlanTag, ipCIDR, gateway))
+	} else {
+		net := fmt.Sprintf("virtio,bridge=%s", bridge)
+		if vlanTag != nil {
+			net = net + fmt.Sprintf(",tag=%d", *vlanTag)
+		}
+		q.Set("net0", net)
+		if ipCIDR == DHCP {
+			q.Set("ipconfig0", "ip=dhcp")
+		} else if ipCIDR != "" && gateway != "" {
+			q.Set("ipconfig0", fmt.Sprintf("ip=%s,gw=%s", ipCIDR, gateway))
+		}
 	}
 	// Tag VMs déployées par l'application pour les filtrer facilement.
 	q.Set("tags", "Minecraft-Auto-Serveur")
-	return c.do(ctx, http.MethodPost, path, q, nil)
+	return c.do(ctx, c.configMethod(), path, q, nil)
+}
+
+// configMethod is the method of config updates: POST (asynchronous) for
+// VMs, PUT for containers which have no POST.
+func (c *Client) configMethod() string {
+	if c.isLXC() {
+		return http.MethodPut
+	}
+	return http.MethodPost
 }
 
 // UpdateVMConfig updates CPU and memory of an existing VM (partial config update).
 func (c *Client) UpdateVMConfig(ctx context.Context, node string, vmid, cores, memoryMB int) error {
-	path := fmt.Sprintf("/nodes/%s/qemu/%d/config", node, vmid)
+	path := c.guestPath(node, vmid) + "/config"
 	q := url.Values{}
 	if cores > 0 {
 		q.Set("cores", fmt.Sprintf("%d", cores))
@@ -156,18 +430,29 @@ func (c *Client) UpdateVMConfig(ctx context.Context, node string, vmid, cores, m
 	if memoryMB > 0 {
 		q.Set("memory", fmt.Sprintf("%d", memoryMB))
 	}
-	return c.do(ctx, http.MethodPost, path, q, nil)
+	return c.do(ctx, c.configMethod(), path, q, nil)
 }
 
-// GetScsi0SizeGB returns the current size in GB of the scsi0 disk from the VM config.
+// GetVMConfig returns the raw configuration of a VM ({qemu|lxc}/{vmid}/config).
+func (c *Client) GetVMConfig(ctx context.Context, node string, vmid int) (map[string]any, error) {
+	path := c.guestPath(node, vmid) + "/config"
+	var config map[string]any
+	if err := c.do(ctx, http.MethodGet, path, nil, &config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// GetScsi0SizeGB returns the current size in GB of the scsi0 disk (rootfs for
+// containers) from the VM config.
 // The config value is like "local-lvm:vm-100-disk-0,size=32G". Returns 0 if not found or parse error.
 func (c *Client) GetScsi0SizeGB(ctx context.Context, node string, vmid int) (int, error) {
-	path := fmt.Sprintf("/nodes/%s/qemu/%d/config", node, vmid)
+	path := c.guestPath(node, vmid) + "/config"
 	var config map[string]interface{}
 	if err := c.do(ctx, http.MethodGet, path, nil, &config); err != nil {
 		return 0, err
 	}
-	raw, ok := config["scsi0"]
+	raw, ok := config[c.rootDisk()]
 	if !ok {
 		return 0, nil
 	}
@@ -188,16 +473,24 @@ func (c *Client) GetScsi0SizeGB(ctx context.Context, node string, vmid int) (int
 	return n, nil
 }
 
+// rootDisk is the system disk: scsi0 for VMs, rootfs for containers.
+func (c *Client) rootDisk() string {
+	if c.isLXC() {
+		return "rootfs"
+	}
+	return "scsi0"
+}
+
 // ResizeDisk adjusts the size of a VM disk using the Proxmox resize endpoint.
-// For simplicity we resize scsi0 to an absolute size in gigabytes, similar to:
+// For simplicity we resize scsi0 (rootfs) to an absolute size in gigabytes, similar to:
 //   qm resize <vmid> scsi0 100G
 func (c *Client) ResizeDisk(ctx context.Context, node string, vmid, diskGB int) (string, error) {
 	if diskGB <= 0 {
 		return "", nil
 	}
-	path := fmt.Sprintf("/nodes/%s/qemu/%d/resize", node, vmid)
+	path := c.guestPath(node, vmid) + "/resize"
 	q := url.Values{}
-	q.Set("disk", "scsi0")
+	q.Set("disk", c.rootDisk())
 	q.Set("size", fmt.Sprintf("%dG", diskGB))
 	var taskID string
 	// L'API Proxmox attend une requête PUT sur /resize (équivalent à qm resize).
@@ -209,7 +502,7 @@ func (c *Client) ResizeDisk(ctx context.Context, node string, vmid, diskGB int)
 
 // StartVM starts the VM.
 func (c *Client) StartVM(ctx context.Context, node string, vmid int) (string, error) {
-	path := fmt.Sprintf("/nodes/%s/qemu/%d/status/start", node, vmid)
+	path := c.guestPath(node, vmid) + "/status/start"
 	var taskID string
 	if err := c.do(ctx, http.MethodPost, path, nil, &taskID); err != nil {
 		return "", err
@@ -219,7 +512,7 @@ func (c *Client) StartVM(ctx context.Context, node string, vmid int) (string, er
 
 // StopVM stops the VM.
 func (c *Client) StopVM(ctx context.Context, node string, vmid int) (string, error) {
-	path := fmt.Sprintf("/nodes/%s/qemu/%d/status/stop", node, vmid)
+	path := c.guestPath(node, vmid) + "/status/stop"
 	var taskID string
 	if err := c.do(ctx, http.MethodPost, path, nil, &taskID); err != nil {
 		return "", err
@@ -229,7 +522,7 @@ func (c *Client) StopVM(ctx context.Context, node string, vmid int) (string, err
 
 // DeleteVM removes the VM from Proxmox.
 func (c *Client) DeleteVM(ctx context.Context, node string, vmid int) (string, error) {
-	path := fmt.Sprintf("/nodes/%s/qemu/%d", node, vmid)
+	path := c.guestPath(node, vmid)
 	var taskID string
 	if err := c.do(ctx, http.MethodDelete, path, nil, &taskID); err != nil {
 		return "", err
@@ -249,7 +542,7 @@ type VMStatusCurrent struct {
 
 // GetVMStatusCurrent returns current CPU, memory and disk usage for a VM (same as Proxmox UI).
 func (c *Client) GetVMStatusCurrent(ctx context.Context, node string, vmid int) (*VMStatusCurrent, error) {
-	path := fmt.Sprintf("/nodes/%s/qemu/%d/status/current", node, vmid)
+	path := c.guestPath(node, vmid) + "/status/current"
 	var out VMStatusCurrent
 	if err := c.do(ctx, http.MethodGet, path, nil, &out); err != nil {
 		return nil, err
@@ -257,49 +550,115 @@ func (c *Client) GetVMStatusCurrent(ctx context.Context, node string, vmid int)
 	return &out, nil
 }
 
-// WaitForTask waits for a Proxmox task to complete.
+// taskPollInterval is the delay between two task status checks.
+const taskPollInterval = 3 * time.Second
+
+// WaitForTask waits for a Proxmox task to complete. A task that stops with an
+// exit status other than "OK" (or "WARNINGS: n") returns a *TaskError holding
+// the end of its log. It returns early when ctx is cancelled.
 func (c *Client) WaitForTask(ctx context.Context, node, upid string, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(taskPollInterval)
+	defer ticker.Stop()
 	for {
-		if time.Now().After(deadline) {
-			return fmt.Errorf("timeout waiting for proxmox task %s", upid)
-		}
 		var task struct {
-			Status string `json:"status"`
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
 		}
 		// Important: Proxmox attend l'UPID brut dans l'URL (avec les ':'),
 		// et n'aime pas forcément la version échappée. On utilise donc
 		// directement la chaîne telle que renvoyée par l'API.
 		path := fmt.Sprintf("/nodes/%s/tasks/%s/status", node, upid)
 		if err := c.do(ctx, http.MethodGet, path, nil, &task); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("timeout waiting for proxmox task %s", upid)
+			}
 			return err
 		}
 		if task.Status == "stopped" || task.Status == "OK" {
-			return nil
-		}
-		time.Sleep(3 * time.Second)
-	}
-}
-
-// WaitForSSH waits until the given host:port is accessible via TCP.
-func (c *Client) WaitForSSH(ctx context.Context, host string, port int, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
-	addr := fmt.Sprintf("%s:%d", host, port)
-	for {
-		if time.Now().After(deadline) {
-			return fmt.Errorf("timeout waiting for ssh on %s", addr)
-		}
-		d := net.Dialer{Timeout: 5 * time.Second}
-		conn, err := d.DialContext(ctx, "tcp", addr)
-		if err == nil {
-			_ = conn.Close()
-			return nil
+			if taskSucceeded(task.ExitStatus) {
+				return nil
+			}
+			// Le contexte d'attente peut être presque écoulé : lecture du log avec son propre délai.
+			logCtx, logCancel := context.WithTimeout(context.WithoutCancel(ctx), 15*time.Second)
+			lines, _ := c.TaskLog(logCtx, node, upid)
+			logCancel()
+			return &TaskError{UPID: upid, ExitStatus: task.ExitStatus, Log: relevantTaskLines(lines)}
 		}
 		select {
 		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("timeout waiting for proxmox task %s", upid)
+			}
 			return ctx.Err()
-		case <-time.After(3 * time.Second):
+		case <-ticker.C:
 		}
 	}
 }
 
+// taskSucceeded reports whether a task exit status means success. Older
+// Proxmox versions may leave it empty.
+func taskSucceeded(exitStatus string) bool {
+	return exitStatus == "" || exitStatus == "OK" || strings.HasPrefix(exitStatus, "WARNINGS")
+}
+
+// TaskError is returned when a Proxmox task finishes with an error.
+type TaskError struct {
+	UPID       string
+	ExitStatus string
+	Log        []string // dernières lignes utiles du log de la tâche
+}
+
+func (e *TaskError) Error() string {
+	msg := fmt.Sprintf("proxmox task %s failed: %s", e.UPID, e.ExitStatus)
+	if len(e.Log) > 0 {
+		msg += "\n" + strings.Join(e.Log, "\n")
+	}
+	return msg
+}
+
+// TaskLog returns the log lines of a task (/nodes/{node}/tasks/{upid}/log).
+func (c *Client) TaskLog(ctx context.Context, node, upid string) ([]string, error) {
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/log", node, upid)
+	q := url.Values{}
+	q.Set("start", "0")
+	q.Set("limit", "1000")
+	var entries []struct {
+		N int    `json:"n"`
+		T string `json:"t"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, q, &entries); err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		lines = append(lines, e.T)
+	}
+	return lines, nil
+}
+
+// relevantTaskLines keeps the error lines of a task log, or its last lines
+// when none stands out.
+func relevantTaskLines(lines []string) []string {
+	const maxLines = 20
+	var errs []string
+	for _, l := range lines {
+		low := strings.ToLower(l)
+		if strings.Contains(low, "error") || strings.Contains(low, "failed") || strings.Contains(low, "can't") || strings.Contains(low, "unable") {
+			errs = append(errs, l)
+		}
+	}
+	if len(errs) == 0 {
+		errs = lines
+	}
+	if len(errs) > maxLines {
+		errs = errs[len(errs)-maxLines:]
+	}
+	return errs
+}
+
+// WaitForSSH waits until the given host:port is accessible via TCP.
+func (c *Client) WaitForSSH(ctx context.Context, host string, port int, timeout time.Duration) error {
+	return WaitForSSH(ctx, host, port, timeout)
+}
@@ -0,0 +1,90 @@
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CloudInitOptions are the cloud-init settings of a VM besides ipconfig0.
+// Empty fields are left untouched.
+type CloudInitOptions struct {
+	// Hostname is applied through the VM name (cloud-init derives the
+	// hostname from it) or the container hostname.
+	Hostname     string
+	Nameserver   string
+	SearchDomain string
+	// SSHKeys are the public keys (one per line) of the cloud-init user.
+	SSHKeys string
+	// CICustom references custom cloud-init files, e.g.
+	// "user=local:snippets/deployer-12-user.yaml". It replaces the user-data
+	// generated by Proxmox (user, sshkeys...).
+	CICustom string
+}
+
+// SetCloudInit applies o to a VM. For containers only the hostname and DNS
+// settings apply.
+func (c *Client) SetCloudInit(ctx context.Context, node string, vmid int, o CloudInitOptions) error {
+	q := url.Values{}
+	if o.Hostname != "" {
+		if c.isLXC() {
+			q.Set("hostname", o.Hostname)
+		} else {
+			q.Set("name", o.Hostname)
+		}
+	}
+	if o.Nameserver != "" {
+		q.Set("nameserver", o.Nameserver)
+	}
+	if o.SearchDomain != "" {
+		q.Set("searchdomain", o.SearchDomain)
+	}
+	if !c.isLXC() {
+		if keys := strings.TrimSpace(o.SSHKeys); keys != "" {
+			// Proxmox attend la valeur déjà encodée (encodeURIComponent).
+			q.Set("sshkeys", strings.ReplaceAll(url.QueryEscape(keys+"\n"), "+", "%20"))
+		}
+		if o.CICustom != "" {
+			q.Set("cicustom", o.CICustom)
+		}
+	}
+	if len(q) == 0 {
+		return nil
+	}
+	return c.do(ctx, c.configMethod(), c.guestPath(node, vmid)+"/config", q, nil)
+}
+
+// NodeAddress returns the cluster IP address of a node (GET /cluster/status).
+func (c *Client) NodeAddress(ctx context.Context, node string) (string, error) {
+	var status []struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+		IP   string `json:"ip"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/cluster/status", nil, &status); err != nil {
+		return "", err
+	}
+	for _, s := range status {
+		if s.Type == "node" && s.Name == node && s.IP != "" {
+			return s.IP, nil
+		}
+	}
+	return "", fmt.Errorf("node %s: %w", node, ErrNotFound)
+}
+
+// StoragePath returns the directory of a file-based storage (dir, NFS,
+// CephFS...), e.g. "/var/lib/vz" for "local".
+func (c *Client) StoragePath(ctx context.Context, storage string) (string, error) {
+	var cfg struct {
+		Path string `json:"path"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/storage/"+url.PathEscape(storage), nil, &cfg); err != nil {
+		return "", err
+	}
+	if cfg.Path == "" {
+		return "", fmt.Errorf("storage %s has no path (not a file-based storage)", storage)
+	}
+	return cfg.Path, nil
+}
@@ -0,0 +1,112 @@
+package proxmox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Error kinds, to be tested with errors.Is on errors returned by the client.
+var (
+	ErrNotFound     = errors.New("proxmox: not found")
+	ErrUnauthorized = errors.New("proxmox: unauthorized")
+	ErrLocked       = errors.New("proxmox: resource locked")
+	ErrValidation   = errors.New("proxmox: invalid parameters")
+	// ErrNoAgent: the QEMU guest agent is not configured or not running.
+	ErrNoAgent = errors.New("proxmox: guest agent not available")
+)
+
+// StatusError is returned when the Proxmox API answers with a non-2xx status.
+// Message and Errors come from the response: Proxmox explains the failure in
+// the status line and/or the JSON body ("message", per-field "errors").
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Message    string
+	Errors     map[string]string
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("proxmox api error: %s", e.Status)
+	if e.Message != "" && !strings.Contains(e.Status, e.Message) {
+		msg += ": " + e.Message
+	}
+	if len(e.Errors) > 0 {
+		msg += " (" + e.FieldErrors() + ")"
+	}
+	return msg
+}
+
+// FieldErrors formats the per-field errors as "field: message; ...".
+func (e *StatusError) FieldErrors() string {
+	keys := make([]string, 0, len(e.Errors))
+	for k := range e.Errors {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+": "+e.Errors[k])
+	}
+	return strings.Join(parts, "; ")
+}
+
+// notFoundRe matches the 500 messages Proxmox uses for a missing guest,
+// storage, snapshot or task. Other "does not exist" errors (a bridge, a
+// volume referenced by the config...) are configuration problems and must
+// not make the guest look deleted.
+var notFoundRe = regexp.MustCompile(`configuration file '[^']*\.conf' does not exist|` +
+	`unable to find configuration file for vm|` +
+	`(storage|snapshot) '[^']*' does not exist|` +
+	`no such (vm|machine|task|snapshot|storage)\b`)
+
+// Is matches the error kinds (ErrNotFound...). Proxmox answers most
+// failures with a 500 and a message, so the message is inspected too.
+func (e *StatusError) Is(target error) bool {
+	text := strings.ToLower(e.Status + " " + e.Message)
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrValidation:
+		return e.StatusCode == http.StatusBadRequest || len(e.Errors) > 0
+	case ErrLocked:
+		return strings.Contains(text, "is locked") || strings.Contains(text, "can't lock file")
+	case ErrNoAgent:
+		return strings.Contains(text, "guest agent is not running") || strings.Contains(text, "no qemu guest agent configured")
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound || notFoundRe.MatchString(text)
+	}
+	return false
+}
+
+// newStatusError builds a StatusError from a failed response.
+func newStatusError(resp *http.Response) *StatusError {
+	e := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	// Proxmox place souvent la raison dans la ligne de statut ("500 VM 100 is locked").
+	reason := strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode)))
+	if reason != http.StatusText(resp.StatusCode) {
+		e.Message = reason
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var payload struct {
+		Message string            `json:"message"`
+		Errors  map[string]string `json:"errors"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		if m := strings.TrimSpace(payload.Message); m != "" {
+			e.Message = m
+		}
+		if len(payload.Errors) > 0 {
+			e.Errors = make(map[string]string, len(payload.Errors))
+			for k, v := range payload.Errors {
+				e.Errors[k] = strings.TrimSpace(v)
+			}
+		}
+	}
+	return e
+}
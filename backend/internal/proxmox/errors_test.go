@@ -0,0 +1,30 @@
+package proxmox
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestStatusErrorNotFound(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		msg  string
+		want bool
+	}{
+		{http.StatusNotFound, "", true},
+		{http.StatusInternalServerError, "Configuration file 'nodes/pve/qemu-server/100.conf' does not exist", true},
+		{http.StatusInternalServerError, "Configuration file 'nodes/pve/lxc/101.conf' does not exist", true},
+		{http.StatusInternalServerError, "storage 'fast' does not exist", true},
+		{http.StatusInternalServerError, "snapshot 'before-update' does not exist", true},
+		{http.StatusInternalServerError, "no such task", true},
+		{http.StatusInternalServerError, "bridge 'vmbr9' does not exist", false},
+		{http.StatusInternalServerError, "can't open file - No such file or directory", false},
+		{http.StatusInternalServerError, "VM 100 is locked (backup)", false},
+	} {
+		e := &StatusError{StatusCode: tc.code, Status: http.StatusText(tc.code), Message: tc.msg}
+		if got := errors.Is(e, ErrNotFound); got != tc.want {
+			t.Errorf("%d %q: Is(ErrNotFound) = %v, want %v", tc.code, tc.msg, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// NodeInfo is a cluster node with its resource usage (GET /nodes).
+type NodeInfo struct {
+	Node    string  `json:"node"`
+	Status  string  `json:"status"` // online, offline, unknown
+	CPU     float64 `json:"cpu"`    // fraction 0..1
+	MaxCPU  int     `json:"maxcpu"`
+	Mem     int64   `json:"mem"`
+	MaxMem  int64   `json:"maxmem"`
+	Disk    int64   `json:"disk"`
+	MaxDisk int64   `json:"maxdisk"`
+	Uptime  int64   `json:"uptime"`
+}
+
+// FreeMem returns the free memory in bytes.
+func (n NodeInfo) FreeMem() int64 { return n.MaxMem - n.Mem }
+
+// StorageInfo is a storage available on a node (GET /nodes/{node}/storage).
+type StorageInfo struct {
+	Storage string `json:"storage"`
+	Type    string `json:"type"`    // dir, lvmthin, zfspool, nfs...
+	Content string `json:"content"` // comma separated: images,rootdir,iso...
+	Active  int    `json:"active"`
+	Enabled int    `json:"enabled"`
+	Shared  int    `json:"shared"`
+	Avail   int64  `json:"avail"`
+	Used    int64  `json:"used"`
+	Total   int64  `json:"total"`
+}
+
+// HasContent reports whether the storage accepts the content type (e.g.
+// "images" for VM disks).
+func (s StorageInfo) HasContent(content string) bool {
+	for _, c := range strings.Split(s.Content, ",") {
+		if strings.TrimSpace(c) == content {
+			return true
+		}
+	}
+	return false
+}
+
+// BridgeInfo is a network bridge of a node (GET /nodes/{node}/network).
+type BridgeInfo struct {
+	Iface     string `json:"iface"`
+	Type      string `json:"type"` // bridge, OVSBridge
+	Active    int    `json:"active"`
+	VLANAware int    `json:"bridge_vlan_aware"`
+	CIDR      string `json:"cidr,omitempty"`
+	Comments  string `json:"comments,omitempty"`
+}
+
+// TemplateInfo is a guest flagged as template (GET /cluster/resources).
+type TemplateInfo struct {
+	VMID int    `json:"vmid"`
+	Name string `json:"name"`
+	Node string `json:"node"`
+	Type string `json:"type"` // qemu, lxc
+}
+
+// ListNodes returns the cluster nodes.
+func (c *Client) ListNodes(ctx context.Context) ([]NodeInfo, error) {
+	var nodes []NodeInfo
+	if err := c.do(ctx, http.MethodGet, "/nodes", nil, &nodes); err != nil {
+		return nil, err
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	return nodes, nil
+}
+
+// ListStorages returns the enabled storages of a node.
+func (c *Client) ListStorages(ctx context.Context, node string) ([]StorageInfo, error) {
+	var storages []StorageInfo
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/nodes/%s/storage", url.PathEscape(node)), url.Values{"enabled": {"1"}}, &storages); err != nil {
+		return nil, err
+	}
+	sort.Slice(storages, func(i, j int) bool { return storages[i].Storage < storages[j].Storage })
+	return storages, nil
+}
+
+// ListBridges returns the Linux and OVS bridges of a node.
+func (c *Client) ListBridges(ctx context.Context, node string) ([]BridgeInfo, error) {
+	var bridges []BridgeInfo
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/nodes/%s/network", url.PathEscape(node)), url.Values{"type": {"any_bridge"}}, &bridges); err != nil {
+		return nil, err
+	}
+	sort.Slice(bridges, func(i, j int) bool { return bridges[i].Iface < bridges[j].Iface })
+	return bridges, nil
+}
+
+// ListTemplates returns the guests flagged as templates in the cluster.
+func (c *Client) ListTemplates(ctx context.Context) ([]TemplateInfo, error) {
+	var resources []struct {
+		TemplateInfo
+		Template int `json:"template"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/cluster/resources", url.Values{"type": {"vm"}}, &resources); err != nil {
+		return nil, err
+	}
+	out := make([]TemplateInfo, 0)
+	for _, r := range resources {
+		if r.Template == 1 {
+			out = append(out, r.TemplateInfo)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].VMID < out[j].VMID })
+	return out, nil
+}
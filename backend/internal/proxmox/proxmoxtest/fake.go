@@ -0,0 +1,980 @@
+package proxmoxtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+)
+
+// FakeServer is an in-process Proxmox API (httptest) covering the endpoints
+// used by the deployment pipeline: nodes, nextid, clone, config, resize,
+// start/stop/delete, status/current, guest agent and tasks, for VMs and
+// containers.
+// Tasks complete immediately.
+// Point a Client at URL to run deployments without a cluster:
+//
+//	fake := proxmoxtest.NewFakeServer("pve1")
+//	defer fake.Close()
+//	c, _ := proxmox.NewClient(fake.URL, "root@pam!test", "secret")
+//
+// Any API token is accepted; ticket logins need a user added with AddUser.
+type FakeServer struct {
+	URL string
+
+	srv     *httptest.Server
+	mu      sync.Mutex
+	nodes   []string
+	nextID  int
+	vms     map[int]*FakeVM
+	tasks   map[string]*fakeTask
+	seq     int
+	fail    map[string]int  // opération -> code HTTP renvoyé au prochain appel
+	failTk  map[string]bool // opération -> prochaine tâche en erreur
+	users   map[string]string
+	tickets map[string]string // ticket -> jeton CSRF
+}
+
+// FakeVM is a VM, container (or template) known to the fake server.
+type FakeVM struct {
+	Type      proxmox.GuestType // qemu (défaut) ou lxc
+	Node      string
+	Name      string
+	Template  bool
+	Status    string // running, stopped
+	Config    map[string]string
+	Snapshots []proxmox.Snapshot
+	// Execs are the commands run through the guest agent. The agent answers
+	// when Config["agent"] is "1" and the VM is running; it reports the IP
+	// of ipconfig0 (or net0), or a fake DHCP lease.
+	Execs [][]string
+}
+
+type fakeTask struct {
+	node       string
+	op         string
+	exitStatus string
+	log        []string
+}
+
+// NewFakeServer starts a fake Proxmox API with the given nodes (default
+// "pve"). Template 9000 exists on the first node. Every node has 16 CPUs,
+// 64 GiB of memory, the storages "local" (ISO, snippets, backups),
+// "local-lvm" (VM disks) and "nfs" (shared, VM disks), and a VLAN-aware
+// bridge "vmbr0".
+func NewFakeServer(nodes ...string) *FakeServer {
+	if len(nodes) == 0 {
+		nodes = []string{"pve"}
+	}
+	f := &FakeServer{
+		nodes:   nodes,
+		nextID:  100,
+		vms:     make(map[int]*FakeVM),
+		tasks:   make(map[string]*fakeTask),
+		fail:    make(map[string]int),
+		failTk:  make(map[string]bool),
+		users:   make(map[string]string),
+		tickets: make(map[string]string),
+	}
+	f.vms[9000] = &FakeVM{Node: nodes[0], Name: "template", Template: true, Status: "stopped", Config: map[string]string{
+		"name":  "template",
+		"scsi0": "local-lvm:base-9000-disk-0,size=10G",
+		"agent": "1",
+	}}
+	f.srv = httptest.NewServer(f.routes())
+	f.URL = f.srv.URL
+	return f
+}
+
+// Close shuts the server down.
+func (f *FakeServer) Close() { f.srv.Close() }
+
+// AddVM registers a VM or template.
+func (f *FakeServer) AddVM(vmid int, vm FakeVM) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if vm.Config == nil {
+		vm.Config = map[string]string{}
+	}
+	if vm.Status == "" {
+		vm.Status = "stopped"
+	}
+	f.vms[vmid] = &vm
+}
+
+// VM returns a copy of a VM, or false if it does not exist.
+func (f *FakeServer) VM(vmid int) (FakeVM, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vm, ok := f.vms[vmid]
+	if !ok {
+		return FakeVM{}, false
+	}
+	cp := *vm
+	cp.Config = make(map[string]string, len(vm.Config))
+	for k, v := range vm.Config {
+		cp.Config[k] = v
+	}
+	cp.Snapshots = append([]proxmox.Snapshot(nil), vm.Snapshots...)
+	cp.Execs = append([][]string(nil), vm.Execs...)
+	return cp, true
+}
+
+// FailRequest makes the next call of op (nextid, create, clone, config, resize,
+// start, stop, delete, status, migrate, snapshot) answer with the HTTP status code.
+func (f *FakeServer) FailRequest(op string, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail[op] = code
+}
+
+// AddUser allows ticket logins (POST /access/ticket) for username.
+func (f *FakeServer) AddUser(username, password string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users[username] = password
+}
+
+// ExpireTickets invalidates every ticket issued so far, as if they had
+// expired.
+func (f *FakeServer) ExpireTickets() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tickets = make(map[string]string)
+}
+
+// FailTask makes the next task of op (create, clone, resize, start, stop, destroy,
+// migrate, snapshot, rollback, delsnapshot) finish with an error exit status.
+func (f *FakeServer) FailTask(op string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failTk[op] = true
+}
+
+func (f *FakeServer) routes() http.Handler {
+	r := chi.NewRouter()
+	r.Route("/api2/json", func(r chi.Router) {
+		r.Post("/access/ticket", f.handleTicket)
+		r.Group(func(r chi.Router) {
+			r.Use(f.auth)
+			r.Get("/nodes", f.handleNodes)
+			r.Get("/cluster/nextid", f.handleNextID)
+			r.Get("/cluster/resources", f.handleResources)
+			r.Get("/cluster/status", f.handleClusterStatus)
+			r.Get("/storage/{storage}", f.handleStorageConfig)
+			r.Route("/nodes/{node}", func(r chi.Router) {
+				r.Get("/storage", f.handleStorage)
+				r.Get("/network", f.handleNetwork)
+				r.Get("/tasks/{upid}/status", f.handleTaskStatus)
+				r.Get("/tasks/{upid}/log", f.handleTaskLog)
+				r.Post("/lxc", f.handleCreateLXC)
+				r.Route("/{kind:qemu|lxc}/{vmid}", func(r chi.Router) {
+					r.Delete("/", f.handleDelete)
+					r.Post("/clone", f.handleClone)
+					r.Get("/config", f.handleGetConfig)
+					r.Post("/config", f.handleSetConfig)
+					r.Put("/config", f.handleSetConfig)
+					r.Put("/resize", f.handleResize)
+					r.Post("/status/start", f.handlePower("start", "running"))
+					r.Post("/status/stop", f.handlePower("stop", "stopped"))
+					r.Get("/status/current", f.handleStatusCurrent)
+					r.Post("/migrate", f.handleMigrate)
+					r.Get("/snapshot", f.handleListSnapshots)
+					r.Post("/snapshot", f.handleCreateSnapshot)
+					r.Post("/snapshot/{snap}/rollback", f.handleRollbackSnapshot)
+					r.Delete("/snapshot/{snap}", f.handleDeleteSnapshot)
+					r.Post("/agent/ping", f.handleAgentPing)
+					r.Get("/agent/network-get-interfaces", f.handleAgentInterfaces)
+					r.Get("/agent/get-fsinfo", f.handleAgentFSInfo)
+					r.Post("/agent/exec", f.handleAgentExec)
+					r.Get("/agent/exec-status", f.handleAgentExecStatus)
+					r.Get("/interfaces", f.handleAgentInterfaces)
+				})
+			})
+		})
+	})
+	return r
+}
+
+// auth accepts any API token, or a ticket cookie issued by handleTicket
+// (with its CSRF token for write requests).
+func (f *FakeServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Authorization"), "PVEAPIToken=") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie("PVEAuthCookie")
+		if err != nil {
+			fakeError(w, http.StatusUnauthorized, "authentication failure")
+			return
+		}
+		f.mu.Lock()
+		csrf, ok := f.tickets[cookie.Value]
+		f.mu.Unlock()
+		if !ok {
+			fakeError(w, http.StatusUnauthorized, "invalid ticket")
+			return
+		}
+		if r.Method != http.MethodGet && r.Header.Get("CSRFPreventionToken") != csrf {
+			fakeError(w, http.StatusUnauthorized, "Permission check failed (invalid csrf token)")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *FakeServer) handleTicket(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	user, password := r.Form.Get("username"), r.Form.Get("password")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	want, ok := f.users[user]
+	_, renew := f.tickets[password]
+	if !ok || (password != want && !renew) {
+		fakeError(w, http.StatusUnauthorized, "authentication failure")
+		return
+	}
+	f.seq++
+	ticket := fmt.Sprintf("PVE:%s:%08X::fake", user, f.seq)
+	csrf := fmt.Sprintf("%08X:fake", f.seq)
+	f.tickets[ticket] = csrf
+	fakeData(w, map[string]any{"username": user, "ticket": ticket, "CSRFPreventionToken": csrf})
+}
+
+func fakeData(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func fakeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{"data": nil, "message": msg + "\n"})
+}
+
+// failed consumes an injected HTTP failure for op. Caller holds f.mu.
+func (f *FakeServer) failed(w http.ResponseWriter, op string) bool {
+	code, ok := f.fail[op]
+	if !ok {
+		return false
+	}
+	delete(f.fail, op)
+	fakeError(w, code, "injected failure for "+op)
+	return true
+}
+
+// vm returns the VM addressed by the request, writing a 500 like Proxmox
+// does when it does not exist on that node. Caller holds f.mu.
+func (f *FakeServer) vm(w http.ResponseWriter, r *http.Request) (int, *FakeVM, bool) {
+	vmid, err := strconv.Atoi(chi.URLParam(r, "vmid"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "invalid vmid")
+		return 0, nil, false
+	}
+	vm, ok := f.vms[vmid]
+	kind := proxmox.GuestType(chi.URLParam(r, "kind"))
+	if !ok || vm.Node != chi.URLParam(r, "node") || vm.guestType() != kind {
+		dir := "qemu-server"
+		if kind == proxmox.GuestLXC {
+			dir = "lxc"
+		}
+		fakeError(w, http.StatusInternalServerError, fmt.Sprintf("Configuration file 'nodes/%s/%s/%d.conf' does not exist", chi.URLParam(r, "node"), dir, vmid))
+		return 0, nil, false
+	}
+	return vmid, vm, true
+}
+
+func (vm *FakeVM) guestType() proxmox.GuestType {
+	if vm.Type == "" {
+		return proxmox.GuestQEMU
+	}
+	return vm.Type
+}
+
+// rootDisk is the config key of the system disk.
+func (vm *FakeVM) rootDisk() string {
+	if vm.guestType() == proxmox.GuestLXC {
+		return "rootfs"
+	}
+	return "scsi0"
+}
+
+// newTask records a finished task and returns its UPID. Caller holds f.mu.
+func (f *FakeServer) newTask(node, op string, vmid int) string {
+	f.seq++
+	upid := fmt.Sprintf("UPID:%s:%08X:%08X:%08X:qm%s:%d:root@pam:", node, 1000+f.seq, f.seq, time.Now().Unix(), op, vmid)
+	t := &fakeTask{node: node, op: op, exitStatus: "OK", log: []string{fmt.Sprintf("%s %d", op, vmid), "TASK OK"}}
+	if f.failTk[op] {
+		delete(f.failTk, op)
+		t.exitStatus = "injected task failure"
+		t.log = []string{fmt.Sprintf("%s %d", op, vmid), "TASK ERROR: injected task failure"}
+	}
+	f.tasks[upid] = t
+	return upid
+}
+
+func (f *FakeServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]map[string]any, 0, len(f.nodes))
+	for _, n := range f.nodes {
+		var mem int64
+		for _, vm := range f.vms {
+			if vm.Node == n && vm.Status == "running" {
+				mb, _ := strconv.ParseInt(vm.Config["memory"], 10, 64)
+				mem += mb << 20
+			}
+		}
+		out = append(out, map[string]any{
+			"node": n, "status": "online", "type": "node",
+			"cpu": 0.05, "maxcpu": 16, "mem": mem, "maxmem": int64(64) << 30,
+			"disk": int64(10) << 30, "maxdisk": int64(100) << 30, "uptime": 3600,
+		})
+	}
+	fakeData(w, out)
+}
+
+// hasNode writes a 500 like Proxmox when the node does not exist. Caller
+// holds f.mu.
+func (f *FakeServer) hasNode(w http.ResponseWriter, r *http.Request) bool {
+	node := chi.URLParam(r, "node")
+	for _, n := range f.nodes {
+		if n == node {
+			return true
+		}
+	}
+	fakeError(w, http.StatusInternalServerError, fmt.Sprintf("hostname lookup '%s' failed - failed to get address info for: %s: Name or service not known", node, node))
+	return false
+}
+
+func (f *FakeServer) handleStorage(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.hasNode(w, r) {
+		return
+	}
+	fakeData(w, []map[string]any{
+		{"storage": "local", "type": "dir", "content": "iso,vztmpl,backup,snippets", "active": 1, "enabled": 1, "shared": 0,
+			"total": int64(100) << 30, "used": int64(10) << 30, "avail": int64(90) << 30},
+		{"storage": "local-lvm", "type": "lvmthin", "content": "images,rootdir", "active": 1, "enabled": 1, "shared": 0,
+			"total": int64(500) << 30, "used": int64(50) << 30, "avail": int64(450) << 30},
+		{"storage": "nfs", "type": "nfs", "content": "images", "active": 1, "enabled": 1, "shared": 1,
+			"total": int64(2000) << 30, "used": int64(500) << 30, "avail": int64(1500) << 30},
+	})
+}
+
+func (f *FakeServer) handleNetwork(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.hasNode(w, r) {
+		return
+	}
+	fakeData(w, []map[string]any{
+		{"iface": "vmbr0", "type": "bridge", "active": 1, "bridge_vlan_aware": 1, "cidr": "192.168.1.10/24"},
+	})
+}
+
+func (f *FakeServer) handleResources(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]map[string]any, 0, len(f.vms))
+	for vmid, vm := range f.vms {
+		tpl := 0
+		if vm.Template {
+			tpl = 1
+		}
+		out = append(out, map[string]any{
+			"id": fmt.Sprintf("%s/%d", vm.guestType(), vmid), "type": string(vm.guestType()), "vmid": vmid,
+			"name": vm.Name, "node": vm.Node, "status": vm.Status, "template": tpl,
+		})
+	}
+	fakeData(w, out)
+}
+
+// handleClusterStatus lists the nodes with addresses 192.0.2.1, .2...
+func (f *FakeServer) handleClusterStatus(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := []map[string]any{{"type": "cluster", "name": "fake", "nodes": len(f.nodes)}}
+	for i, n := range f.nodes {
+		out = append(out, map[string]any{"type": "node", "name": n, "ip": fmt.Sprintf("192.0.2.%d", i+1), "online": 1})
+	}
+	fakeData(w, out)
+}
+
+func (f *FakeServer) handleStorageConfig(w http.ResponseWriter, r *http.Request) {
+	paths := map[string]string{"local": "/var/lib/vz", "local-lvm": "", "nfs": "/mnt/pve/nfs"}
+	st := chi.URLParam(r, "storage")
+	path, ok := paths[st]
+	if !ok {
+		fakeError(w, http.StatusInternalServerError, fmt.Sprintf("storage '%s' does not exist", st))
+		return
+	}
+	out := map[string]any{"storage": st}
+	if path != "" {
+		out["path"] = path
+	}
+	fakeData(w, out)
+}
+
+func (f *FakeServer) handleNextID(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed(w, "nextid") {
+		return
+	}
+	id := f.nextID
+	for f.vms[id] != nil {
+		id++
+	}
+	fakeData(w, strconv.Itoa(id))
+}
+
+func (f *FakeServer) handleClone(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed(w, "clone") {
+		return
+	}
+	_, tpl, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	newID, err := strconv.Atoi(r.Form.Get("newid"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "newid: invalid format")
+		return
+	}
+	if f.vms[newID] != nil {
+		fakeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d already exists", newID))
+		return
+	}
+	node := tpl.Node
+	if target := r.Form.Get("target"); target != "" && target != tpl.Node {
+		if st := fakeDiskStorage(tpl.Config[tpl.rootDisk()]); st != "nfs" {
+			fakeError(w, http.StatusInternalServerError, fmt.Sprintf("Can't clone to other node: storage '%s' is not shared", st))
+			return
+		}
+		node = target
+	}
+	cfg := make(map[string]string, len(tpl.Config))
+	for k, v := range tpl.Config {
+		cfg[k] = v
+	}
+	name, nameKey := r.Form.Get("name"), "name"
+	if tpl.guestType() == proxmox.GuestLXC {
+		name, nameKey = r.Form.Get("hostname"), "hostname"
+	}
+	cfg[nameKey] = name
+	disk := tpl.rootDisk()
+	if d, ok := cfg[disk]; ok {
+		cfg[disk] = regexp.MustCompile(`(base|vm)-\d+-`).ReplaceAllString(d, fmt.Sprintf("vm-%d-", newID))
+		if st := r.Form.Get("storage"); st != "" && r.Form.Get("full") == "1" {
+			cfg[disk] = st + ":" + strings.SplitN(cfg[disk], ":", 2)[1]
+		}
+	}
+	f.vms[newID] = &FakeVM{Type: tpl.Type, Node: node, Name: name, Status: "stopped", Config: cfg}
+	fakeData(w, f.newTask(tpl.Node, "clone", newID))
+}
+
+func (f *FakeServer) handleCreateLXC(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed(w, "create") {
+		return
+	}
+	if !f.hasNode(w, r) {
+		return
+	}
+	vmid, err := strconv.Atoi(r.Form.Get("vmid"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "vmid: invalid format")
+		return
+	}
+	if f.vms[vmid] != nil {
+		fakeError(w, http.StatusInternalServerError, fmt.Sprintf("CT %d already exists", vmid))
+		return
+	}
+	tpl := r.Form.Get("ostemplate")
+	if !strings.Contains(tpl, ":vztmpl/") {
+		fakeError(w, http.StatusBadRequest, "ostemplate: invalid volume ID")
+		return
+	}
+	cfg := map[string]string{}
+	for k := range r.Form {
+		switch k {
+		case "vmid", "ostemplate", "ssh-public-keys":
+		case "rootfs":
+			st, size, _ := strings.Cut(r.Form.Get(k), ":")
+			cfg[k] = fmt.Sprintf("%s:vm-%d-disk-0,size=%sG", st, vmid, size)
+		case "net0":
+			cfg[k] = fakeNet0(vmid, proxmox.GuestLXC, r.Form.Get(k))
+		default:
+			cfg[k] = r.Form.Get(k)
+		}
+	}
+	f.vms[vmid] = &FakeVM{Type: proxmox.GuestLXC, Node: chi.URLParam(r, "node"), Name: cfg["hostname"], Status: "stopped", Config: cfg}
+	fakeData(w, f.newTask(chi.URLParam(r, "node"), "create", vmid))
+}
+
+// fakeDiskStorage returns the storage of a disk ("local-lvm:vm-100-disk-0,...").
+func fakeDiskStorage(disk string) string {
+	st, _, _ := strings.Cut(disk, ":")
+	return st
+}
+
+func (f *FakeServer) handleMigrate(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed(w, "migrate") {
+		return
+	}
+	vmid, vm, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	target := r.Form.Get("target")
+	known := false
+	for _, n := range f.nodes {
+		known = known || n == target
+	}
+	if !known || target == vm.Node {
+		fakeError(w, http.StatusBadRequest, fmt.Sprintf("target: invalid node '%s'", target))
+		return
+	}
+	online, storageParam := "online", "targetstorage"
+	if vm.guestType() == proxmox.GuestLXC {
+		online, storageParam = "restart", "target-storage"
+	}
+	if vm.Status == "running" && r.Form.Get(online) != "1" {
+		fakeError(w, http.StatusInternalServerError, fmt.Sprintf("can't migrate running VM without --%s", online))
+		return
+	}
+	if st := r.Form.Get(storageParam); st != "" {
+		if d, ok := vm.Config[vm.rootDisk()]; ok {
+			vm.Config[vm.rootDisk()] = st + ":" + strings.SplitN(d, ":", 2)[1]
+		}
+	}
+	upid := f.newTask(vm.Node, "migrate", vmid)
+	if f.tasks[upid].exitStatus == "OK" {
+		vm.Node = target
+	}
+	fakeData(w, upid)
+}
+
+func (f *FakeServer) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, vm, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	fakeData(w, vm.Config)
+}
+
+func (f *FakeServer) handleSetConfig(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed(w, "config") {
+		return
+	}
+	vmid, vm, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	for k := range r.Form {
+		if k == "delete" {
+			for _, d := range strings.Split(r.Form.Get(k), ",") {
+				delete(vm.Config, strings.TrimSpace(d))
+			}
+			continue
+		}
+		vm.Config[k] = r.Form.Get(k)
+		if k == "net0" {
+			vm.Config[k] = fakeNet0(vmid, vm.guestType(), r.Form.Get(k))
+		}
+		if k == "name" || k == "hostname" {
+			vm.Name = r.Form.Get(k)
+		}
+	}
+	if r.Method == http.MethodPost {
+		// POST /config est asynchrone côté Proxmox : il renvoie un UPID.
+		fakeData(w, f.newTask(vm.Node, "config", 0))
+		return
+	}
+	fakeData(w, nil)
+}
+
+var fakeSizeRe = regexp.MustCompile(`size=(\d+)G`)
+
+func (f *FakeServer) handleResize(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed(w, "resize") {
+		return
+	}
+	vmid, vm, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	disk := r.Form.Get("disk")
+	size := strings.TrimSuffix(r.Form.Get("size"), "G")
+	newGB, err := strconv.Atoi(strings.TrimPrefix(size, "+"))
+	if disk == "" || err != nil {
+		fakeError(w, http.StatusBadRequest, "invalid disk or size")
+		return
+	}
+	cur := vm.Config[disk]
+	curGB := 0
+	if m := fakeSizeRe.FindStringSubmatch(cur); len(m) == 2 {
+		curGB, _ = strconv.Atoi(m[1])
+	}
+	if strings.HasPrefix(size, "+") {
+		newGB += curGB
+	}
+	if newGB < curGB {
+		fakeError(w, http.StatusInternalServerError, "shrinking disks is not supported")
+		return
+	}
+	if cur == "" {
+		vm.Config[disk] = fmt.Sprintf("local-lvm:vm-%d-disk-0,size=%dG", vmid, newGB)
+	} else {
+		vm.Config[disk] = fakeSizeRe.ReplaceAllString(cur, fmt.Sprintf("size=%dG", newGB))
+	}
+	fakeData(w, f.newTask(vm.Node, "resize", vmid))
+}
+
+func (f *FakeServer) handlePower(op, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.failed(w, op) {
+			return
+		}
+		vmid, vm, ok := f.vm(w, r)
+		if !ok {
+			return
+		}
+		upid := f.newTask(vm.Node, op, vmid)
+		if f.tasks[upid].exitStatus == "OK" {
+			vm.Status = status
+		}
+		fakeData(w, upid)
+	}
+}
+
+func (f *FakeServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed(w, "delete") {
+		return
+	}
+	vmid, vm, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	if vm.Status == "running" {
+		fakeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d is running - destroy failed", vmid))
+		return
+	}
+	upid := f.newTask(vm.Node, "destroy", vmid)
+	if f.tasks[upid].exitStatus == "OK" {
+		delete(f.vms, vmid)
+	}
+	fakeData(w, upid)
+}
+
+func (f *FakeServer) handleListSnapshots(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, vm, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	out := append([]proxmox.Snapshot(nil), vm.Snapshots...)
+	out = append(out, proxmox.Snapshot{Name: "current", Description: "You are here!"})
+	fakeData(w, out)
+}
+
+func (f *FakeServer) handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed(w, "snapshot") {
+		return
+	}
+	vmid, vm, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	name := r.Form.Get("snapname")
+	for _, s := range vm.Snapshots {
+		if s.Name == name {
+			fakeError(w, http.StatusInternalServerError, fmt.Sprintf("snapshot name '%s' already used", name))
+			return
+		}
+	}
+	snap := proxmox.Snapshot{Name: name, Description: r.Form.Get("description"), SnapTime: time.Now().Unix()}
+	if r.Form.Get("vmstate") == "1" && vm.Status == "running" {
+		snap.VMState = 1
+	}
+	if n := len(vm.Snapshots); n > 0 {
+		snap.Parent = vm.Snapshots[n-1].Name
+	}
+	upid := f.newTask(vm.Node, "snapshot", vmid)
+	if f.tasks[upid].exitStatus == "OK" {
+		vm.Snapshots = append(vm.Snapshots, snap)
+	}
+	fakeData(w, upid)
+}
+
+// fakeSnapshotIndex returns the index of the snapshot addressed by the
+// request. Caller holds f.mu.
+func fakeSnapshotIndex(w http.ResponseWriter, r *http.Request, vm *FakeVM) (int, bool) {
+	name := chi.URLParam(r, "snap")
+	for i, s := range vm.Snapshots {
+		if s.Name == name {
+			return i, true
+		}
+	}
+	fakeError(w, http.StatusInternalServerError, fmt.Sprintf("snapshot '%s' does not exist", name))
+	return 0, false
+}
+
+func (f *FakeServer) handleRollbackSnapshot(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vmid, vm, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	i, ok := fakeSnapshotIndex(w, r, vm)
+	if !ok {
+		return
+	}
+	upid := f.newTask(vm.Node, "rollback", vmid)
+	if f.tasks[upid].exitStatus == "OK" {
+		vm.Status = "stopped"
+		if vm.Snapshots[i].VMState == 1 {
+			vm.Status = "running"
+		}
+	}
+	fakeData(w, upid)
+}
+
+func (f *FakeServer) handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vmid, vm, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	i, ok := fakeSnapshotIndex(w, r, vm)
+	if !ok {
+		return
+	}
+	upid := f.newTask(vm.Node, "delsnapshot", vmid)
+	if f.tasks[upid].exitStatus == "OK" {
+		vm.Snapshots = append(vm.Snapshots[:i], vm.Snapshots[i+1:]...)
+	}
+	fakeData(w, upid)
+}
+
+// agent returns the running VM addressed by the request if its guest agent
+// answers (always for containers, which need none). Caller holds f.mu.
+func (f *FakeServer) agent(w http.ResponseWriter, r *http.Request) (int, *FakeVM, bool) {
+	vmid, vm, ok := f.vm(w, r)
+	if !ok {
+		return 0, nil, false
+	}
+	if vm.guestType() == proxmox.GuestQEMU && !strings.HasPrefix(vm.Config["agent"], "1") {
+		fakeError(w, http.StatusInternalServerError, "No QEMU guest agent configured")
+		return 0, nil, false
+	}
+	if vm.Status != "running" {
+		fakeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d is not running", vmid))
+		return 0, nil, false
+	}
+	return vmid, vm, true
+}
+
+// fakeMAC is the MAC address of net0 of a guest, derived from its VMID.
+func fakeMAC(vmid int) string {
+	return fmt.Sprintf("bc:24:11:00:%02x:%02x", vmid>>8&0xff, vmid&0xff)
+}
+
+// fakeNet0 adds a MAC address to a net0 value that has none, as Proxmox
+// does ("virtio=MAC,..." for VMs, "hwaddr=MAC" for containers).
+func fakeNet0(vmid int, t proxmox.GuestType, net0 string) string {
+	if t == proxmox.GuestLXC {
+		if strings.Contains(net0, "hwaddr=") {
+			return net0
+		}
+		return net0 + ",hwaddr=" + strings.ToUpper(fakeMAC(vmid))
+	}
+	model, rest, hasRest := strings.Cut(net0, ",")
+	if strings.Contains(model, "=") {
+		return net0
+	}
+	model += "=" + strings.ToUpper(fakeMAC(vmid))
+	if hasRest {
+		model += "," + rest
+	}
+	return model
+}
+
+var fakeIPRe = regexp.MustCompile(`(?:^|,)ip=([^,]+)`)
+
+// fakeGuestIP returns the address of the guest: the static IP of ipconfig0
+// or net0, else a DHCP lease in 10.10.0.0/16.
+func fakeGuestIP(vmid int, vm *FakeVM) string {
+	for _, key := range []string{"ipconfig0", "net0"} {
+		if m := fakeIPRe.FindStringSubmatch(vm.Config[key]); len(m) == 2 && m[1] != "dhcp" {
+			return m[1]
+		}
+	}
+	return fmt.Sprintf("10.10.%d.%d/16", vmid/250, vmid%250+1)
+}
+
+func (f *FakeServer) handleAgentPing(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, _, ok := f.agent(w, r); ok {
+		fakeData(w, map[string]any{"result": map[string]any{}})
+	}
+}
+
+func (f *FakeServer) handleAgentInterfaces(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vmid, vm, ok := f.agent(w, r)
+	if !ok {
+		return
+	}
+	ip, ipNet, _ := net.ParseCIDR(fakeGuestIP(vmid, vm))
+	prefix, _ := ipNet.Mask.Size()
+	if vm.guestType() == proxmox.GuestLXC {
+		fakeData(w, []map[string]any{
+			{"name": "lo", "hwaddr": "00:00:00:00:00:00", "inet": "127.0.0.1/8"},
+			{"name": "eth0", "hwaddr": fakeMAC(vmid), "inet": fmt.Sprintf("%s/%d", ip, prefix)},
+		})
+		return
+	}
+	fakeData(w, map[string]any{"result": []proxmox.AgentInterface{
+		{Name: "lo", HardwareAddress: "00:00:00:00:00:00", IPAddresses: []proxmox.AgentIPAddress{{Type: "ipv4", Address: "127.0.0.1", Prefix: 8}}},
+		{Name: "eth0", HardwareAddress: fakeMAC(vmid), IPAddresses: []proxmox.AgentIPAddress{
+			{Type: "ipv4", Address: ip.String(), Prefix: prefix},
+			{Type: "ipv6", Address: "fe80::be24:11ff:fe00:1", Prefix: 64},
+		}},
+	}})
+}
+
+func (f *FakeServer) handleAgentFSInfo(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, vm, ok := f.agent(w, r)
+	if !ok {
+		return
+	}
+	var total int64 = 10 << 30
+	if m := fakeSizeRe.FindStringSubmatch(vm.Config[vm.rootDisk()]); len(m) == 2 {
+		gb, _ := strconv.ParseInt(m[1], 10, 64)
+		total = gb << 30
+	}
+	fakeData(w, map[string]any{"result": []proxmox.AgentFilesystem{
+		{Name: "sda1", Mountpoint: "/", Type: "ext4", TotalBytes: total, UsedBytes: total / 4},
+		{Name: "sda15", Mountpoint: "/boot/efi", Type: "vfat", TotalBytes: 100 << 20, UsedBytes: 6 << 20},
+	}})
+}
+
+func (f *FakeServer) handleAgentExec(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, vm, ok := f.agent(w, r)
+	if !ok {
+		return
+	}
+	vm.Execs = append(vm.Execs, r.Form["command"])
+	fakeData(w, map[string]any{"pid": 1000 + len(vm.Execs)})
+}
+
+// handleAgentExecStatus: commands run by the fake exit at once with status 0.
+func (f *FakeServer) handleAgentExecStatus(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, _, ok := f.agent(w, r); ok {
+		fakeData(w, proxmox.AgentExecStatus{Exited: 1})
+	}
+}
+
+func (f *FakeServer) handleStatusCurrent(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed(w, "status") {
+		return
+	}
+	_, vm, ok := f.vm(w, r)
+	if !ok {
+		return
+	}
+	maxMem := int64(2048) << 20
+	if m, err := strconv.ParseInt(vm.Config["memory"], 10, 64); err == nil {
+		maxMem = m << 20
+	}
+	cur := proxmox.VMStatusCurrent{Status: vm.Status, MaxMem: maxMem}
+	if vm.Status == "running" {
+		cur.CPU = 0.05
+		cur.Mem = maxMem / 4
+	}
+	fakeData(w, cur)
+}
+
+func (f *FakeServer) task(w http.ResponseWriter, r *http.Request) (*fakeTask, bool) {
+	t, ok := f.tasks[chi.URLParam(r, "upid")]
+	if !ok || t.node != chi.URLParam(r, "node") {
+		fakeError(w, http.StatusInternalServerError, "no such task")
+		return nil, false
+	}
+	return t, true
+}
+
+func (f *FakeServer) handleTaskStatus(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.task(w, r)
+	if !ok {
+		return
+	}
+	fakeData(w, map[string]any{"status": "stopped", "exitstatus": t.exitStatus, "type": "qm" + t.op, "node": t.node})
+}
+
+func (f *FakeServer) handleTaskLog(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.task(w, r)
+	if !ok {
+		return
+	}
+	out := make([]map[string]any, 0, len(t.log))
+	for i, l := range t.log {
+		out = append(out, map[string]any{"n": i + 1, "t": l})
+	}
+	fakeData(w, out)
+}
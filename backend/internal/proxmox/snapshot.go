@@ -0,0 +1,73 @@
+package proxmox
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Snapshot is a VM snapshot (GET /nodes/{node}/{qemu|lxc}/{vmid}/snapshot).
+type Snapshot struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parent      string `json:"parent,omitempty"`
+	SnapTime    int64  `json:"snaptime,omitempty"` // unix time
+	VMState     int    `json:"vmstate,omitempty"`  // 1 if RAM state is included
+}
+
+// ListSnapshots returns the snapshots of a VM, oldest first (without the
+// "current" pseudo-snapshot Proxmox adds).
+func (c *Client) ListSnapshots(ctx context.Context, node string, vmid int) ([]Snapshot, error) {
+	var snaps []Snapshot
+	if err := c.do(ctx, http.MethodGet, c.guestPath(node, vmid)+"/snapshot", nil, &snaps); err != nil {
+		return nil, err
+	}
+	out := snaps[:0]
+	for _, s := range snaps {
+		if s.Name != "current" {
+			out = append(out, s)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].SnapTime < out[j].SnapTime })
+	return out, nil
+}
+
+// CreateSnapshot snapshots a VM; vmstate also saves the RAM of a running VM
+// (ignored for containers, which cannot save it).
+func (c *Client) CreateSnapshot(ctx context.Context, node string, vmid int, name, description string, vmstate bool) (string, error) {
+	q := url.Values{}
+	q.Set("snapname", name)
+	if description != "" {
+		q.Set("description", description)
+	}
+	if vmstate && !c.isLXC() {
+		q.Set("vmstate", "1")
+	}
+	var taskID string
+	if err := c.do(ctx, http.MethodPost, c.guestPath(node, vmid)+"/snapshot", q, &taskID); err != nil {
+		return "", err
+	}
+	return taskID, nil
+}
+
+// RollbackSnapshot restores a VM to a snapshot. Without RAM state the VM is
+// left stopped.
+func (c *Client) RollbackSnapshot(ctx context.Context, node string, vmid int, name string) (string, error) {
+	var taskID string
+	path := c.guestPath(node, vmid) + "/snapshot/" + url.PathEscape(name) + "/rollback"
+	if err := c.do(ctx, http.MethodPost, path, nil, &taskID); err != nil {
+		return "", err
+	}
+	return taskID, nil
+}
+
+// DeleteSnapshot removes a snapshot.
+func (c *Client) DeleteSnapshot(ctx context.Context, node string, vmid int, name string) (string, error) {
+	var taskID string
+	path := c.guestPath(node, vmid) + "/snapshot/" + url.PathEscape(name)
+	if err := c.do(ctx, http.MethodDelete, path, nil, &taskID); err != nil {
+		return "", err
+	}
+	return taskID, nil
+}
@@ -0,0 +1,111 @@
+package proxmox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proxmox tickets are valid for 2 hours; they are renewed well before.
+const ticketRenewAfter = 90 * time.Minute
+
+// ticketState is the current ticket of a Client using username/password
+// authentication.
+type ticketState struct {
+	mu       sync.Mutex
+	ticket   string
+	csrf     string
+	issuedAt time.Time
+}
+
+func (t *ticketState) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ticket, t.csrf = "", ""
+}
+
+// authorize sets the authentication headers of req: the API token, or the
+// ticket cookie plus the CSRF token for write requests.
+func (c *Client) authorize(ctx context.Context, req *http.Request) error {
+	if c.username == "" {
+		req.Header.Set("Authorization", fmt.Sprintf("PVEAPIToken=%s=%s", c.tokenID, c.tokenSecret))
+		return nil
+	}
+	ticket, csrf, err := c.currentTicket(ctx)
+	if err != nil {
+		return err
+	}
+	req.AddCookie(&http.Cookie{Name: "PVEAuthCookie", Value: ticket})
+	if req.Method != http.MethodGet {
+		req.Header.Set("CSRFPreventionToken", csrf)
+	}
+	return nil
+}
+
+// currentTicket returns a valid ticket, logging in or renewing it if needed.
+func (c *Client) currentTicket(ctx context.Context) (string, string, error) {
+	c.ticket.mu.Lock()
+	defer c.ticket.mu.Unlock()
+	if c.ticket.ticket != "" && time.Since(c.ticket.issuedAt) < ticketRenewAfter {
+		return c.ticket.ticket, c.ticket.csrf, nil
+	}
+	var (
+		ticket, csrf string
+		err          error
+	)
+	if c.ticket.ticket != "" {
+		// Renouvellement : Proxmox accepte le ticket courant comme mot de passe.
+		ticket, csrf, err = c.login(ctx, c.ticket.ticket)
+	}
+	if c.ticket.ticket == "" || err != nil {
+		ticket, csrf, err = c.login(ctx, c.password)
+	}
+	if err != nil {
+		c.ticket.ticket, c.ticket.csrf = "", ""
+		return "", "", err
+	}
+	c.ticket.ticket, c.ticket.csrf, c.ticket.issuedAt = ticket, csrf, time.Now()
+	return ticket, csrf, nil
+}
+
+// login calls POST /access/ticket.
+func (c *Client) login(ctx context.Context, password string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	u := *c.baseURL
+	u.Path = "/api2/json/access/ticket"
+	form := url.Values{"username": {c.username}, "password": {password}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", "", fmt.Errorf("proxmox login as %s: %w", c.username, newStatusError(resp))
+	}
+	var out struct {
+		Data struct {
+			Ticket string `json:"ticket"`
+			CSRF   string `json:"CSRFPreventionToken"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", "", err
+	}
+	if out.Data.Ticket == "" {
+		// Proxmox répond 200 sans données quand un second facteur est exigé.
+		return "", "", fmt.Errorf("proxmox login as %s: %w: no ticket returned (two-factor authentication is not supported)", c.username, ErrUnauthorized)
+	}
+	return out.Data.Ticket, out.Data.CSRF, nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -27,9 +29,29 @@ func (s *Server) handleValidateDeployment(w http.ResponseWriter, r *http.Request
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := s.validateInventory(r.Context(), req); err != nil {
+		var ie *deploy.InventoryError
+		if errors.As(err, &ie) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusBadGateway, proxmoxFailure("vérification Proxmox", err))
+		return
+	}
 	writeJSON(w, http.StatusOK, genericOKResponse{OK: true})
 }
 
+// validateInventory checks the request against the cluster inventory.
+func (s *Server) validateInventory(ctx context.Context, req deploy.MinecraftDeploymentRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	api, cfg, err := s.proxmoxAPI(ctx)
+	if err != nil {
+		return err
+	}
+	return deploy.ValidateAgainstInventory(ctx, api, req, cfg)
+}
+
 // handleCreateDeployment validates and enqueues a deployment.
 func (s *Server) handleCreateDeployment(w http.ResponseWriter, r *http.Request) {
 	var req deploy.MinecraftDeploymentRequest
@@ -41,6 +63,15 @@ func (s *Server) handleCreateDeployment(w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// Proxmox injoignable : on met quand même en file, le job réessaiera.
+	if err := s.validateInventory(r.Context(), req); err != nil {
+		var ie *deploy.InventoryError
+		if errors.As(err, &ie) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("deployment %q: inventory check skipped: %v", req.Name, err)
+	}
 	id, err := deploy.EnqueueMinecraftDeployment(r.Context(), s.DB, req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -108,7 +139,7 @@ func (s *Server) handleGetDeployment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	row := s.DB.Sql().QueryRowContext(r.Context(), `
-		SELECT id, game, type, request_json, result_json, vmid, ip_address, status, error_message, assigned_to_user_id, created_at, updated_at
+		SELECT id, game, type, request_json, result_json, vmid, ip_address, status, error_message, assigned_to_user_id, checkpoint, created_at, updated_at
 		FROM deployments
 		WHERE id = ?
 	`, id)
@@ -123,20 +154,25 @@ func (s *Server) handleGetDeployment(w http.ResponseWriter, r *http.Request) {
 		Status           string  `json:"status"`
 		Error            *string `json:"error_message,omitempty"`
 		AssignedToUserID *int64  `json:"assigned_to_user_id,omitempty"`
+		Checkpoint       *string `json:"checkpoint,omitempty"`
 		CreatedAt        string  `json:"created_at"`
 		UpdatedAt        string  `json:"updated_at"`
+		// AnsibleTasks : résultat de chaque tâche Ansible (durée, statut, message).
+		AnsibleTasks []deploy.AnsibleTask `json:"ansible_tasks,omitempty"`
+		FailedTask   *deploy.AnsibleTask  `json:"failed_task,omitempty"`
 	}
 	var vmid sql.NullInt64
 	var ip sql.NullString
 	var result sql.NullString
 	var errMsg sql.NullString
 	var assignedTo sql.NullInt64
+	var checkpoint sql.NullString
 	var created, updated time.Time
 	if err := row.Scan(
 		&record.ID, &record.Game, &record.Type,
 		&record.RequestJSON, &result,
 		&vmid, &ip, &record.Status, &errMsg,
-		&assignedTo, &created, &updated,
+		&assignedTo, &checkpoint, &created, &updated,
 	); err != nil {
 		if err == sql.ErrNoRows {
 			http.NotFound(w, r)
@@ -165,8 +201,23 @@ func (s *Server) handleGetDeployment(w http.ResponseWriter, r *http.Request) {
 		v := assignedTo.Int64
 		record.AssignedToUserID = &v
 	}
+	if checkpoint.Valid {
+		str := checkpoint.String
+		record.Checkpoint = &str
+	}
 	record.CreatedAt = created.Format(time.RFC3339)
 	record.UpdatedAt = updated.Format(time.RFC3339)
+	if tasks, err := deploy.LoadAnsibleTasks(r.Context(), s.DB, id); err == nil {
+		record.AnsibleTasks = tasks
+		if record.Status == string(deploy.StatusFailed) {
+			for i := len(tasks) - 1; i >= 0; i-- {
+				if (tasks[i].Status == "failed" || tasks[i].Status == "unreachable") && !tasks[i].Ignored {
+					record.FailedTask = &tasks[i]
+					break
+				}
+			}
+		}
+	}
 	writeJSON(w, http.StatusOK, record)
 }
 
@@ -187,14 +238,14 @@ func (s *Server) handleGetDeploymentLogs(w http.ResponseWriter, r *http.Request)
 			return
 		}
 		rows, err = s.DB.Sql().QueryContext(r.Context(), `
-			SELECT id, ts, level, message
+			SELECT id, ts, level, message, data_json
 			FROM deployment_logs
 			WHERE deployment_id = ? AND id > ?
 			ORDER BY id ASC
 		`, deploymentID, afterID)
 	} else {
 		rows, err = s.DB.Sql().QueryContext(r.Context(), `
-			SELECT id, ts, level, message
+			SELECT id, ts, level, message, data_json
 			FROM deployment_logs
 			WHERE deployment_id = ?
 			ORDER BY id ASC
@@ -207,25 +258,172 @@ func (s *Server) handleGetDeploymentLogs(w http.ResponseWriter, r *http.Request)
 	defer rows.Close()
 
 	type logItem struct {
-		ID      int64  `json:"id"`
-		Time    string `json:"ts"`
-		Level   string `json:"level"`
-		Message string `json:"message"`
+		ID      int64           `json:"id"`
+		Time    string          `json:"ts"`
+		Level   string          `json:"level"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data,omitempty"`
 	}
 	var out []logItem
 	for rows.Next() {
 		var it logItem
 		var ts time.Time
-		if err := rows.Scan(&it.ID, &ts, &it.Level, &it.Message); err != nil {
+		var data sql.NullString
+		if err := rows.Scan(&it.ID, &ts, &it.Level, &it.Message, &data); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		it.Time = ts.Format(time.RFC3339)
+		if data.Valid {
+			it.Data = json.RawMessage(data.String)
+		}
 		out = append(out, it)
 	}
 	writeJSON(w, http.StatusOK, out)
 }
 
+// handleStreamDeploymentLogs streams the deployment logs as Server-Sent
+// Events: existing lines are replayed (after Last-Event-ID or after_id when
+// reconnecting), then new lines and status changes are pushed as they are
+// written. Events: "log" (id = log id) and "status"; the stream ends once the
+// deployment reaches a final status or is deleted.
+func (s *Server) handleStreamDeploymentLogs(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	deploymentID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	var lastID int64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		lastID, _ = strconv.ParseInt(v, 10, 64)
+	} else if v := r.URL.Query().Get("after_id"); v != "" {
+		if lastID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "invalid after_id", http.StatusBadRequest)
+			return
+		}
+	}
+	ctx := r.Context()
+	var status string
+	if err := s.DB.Sql().QueryRowContext(ctx, `SELECT status FROM deployments WHERE id = ?`, deploymentID).Scan(&status); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// S'abonner avant la relecture : aucune ligne écrite entre les deux n'est perdue.
+	changed, stop := deploy.WatchDeployment(deploymentID)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher, _ := w.(http.Flusher)
+
+	type logItem struct {
+		ID      int64           `json:"id"`
+		Time    string          `json:"ts"`
+		Level   string          `json:"level"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data,omitempty"`
+	}
+	send := func(event, id string, v any) error {
+		data, _ := json.Marshal(v)
+		msg := "event: " + event + "\n"
+		if id != "" {
+			msg += "id: " + id + "\n"
+		}
+		msg += "data: " + string(data) + "\n\n"
+		if _, err := w.Write([]byte(msg)); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	sendNewLogs := func() error {
+		rows, err := s.DB.Sql().QueryContext(ctx, `
+			SELECT id, ts, level, message, data_json
+			FROM deployment_logs
+			WHERE deployment_id = ? AND id > ?
+			ORDER BY id ASC
+		`, deploymentID, lastID)
+		if err != nil {
+			return err
+		}
+		var items []logItem
+		for rows.Next() {
+			var it logItem
+			var ts time.Time
+			var data sql.NullString
+			if err := rows.Scan(&it.ID, &ts, &it.Level, &it.Message, &data); err != nil {
+				rows.Close()
+				return err
+			}
+			it.Time = ts.Format(time.RFC3339)
+			if data.Valid {
+				it.Data = json.RawMessage(data.String)
+			}
+			items = append(items, it)
+		}
+		rows.Close()
+		for _, it := range items {
+			if err := send("log", strconv.FormatInt(it.ID, 10), it); err != nil {
+				return err
+			}
+			lastID = it.ID
+		}
+		return nil
+	}
+
+	sentStatus := ""
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		if err := sendNewLogs(); err != nil {
+			return
+		}
+		var errMsg sql.NullString
+		err := s.DB.Sql().QueryRowContext(ctx, `SELECT status, error_message FROM deployments WHERE id = ?`, deploymentID).Scan(&status, &errMsg)
+		if err == sql.ErrNoRows {
+			_ = send("status", "", map[string]any{"status": "deleted"})
+			return
+		}
+		if err != nil {
+			return
+		}
+		if status != sentStatus {
+			if send("status", "", map[string]any{"status": status, "error_message": errMsg.String}) != nil {
+				return
+			}
+			sentStatus = status
+		}
+		switch deploy.DeploymentStatus(status) {
+		case deploy.StatusSuccess, deploy.StatusFailed, deploy.StatusCancelled:
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-keepalive.C:
+			// Relit aussi l'état : certains changements (suppression) ne notifient pas.
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
 // Helper to avoid unused import errors for auth in this file.
 var _ = auth.User{}
 
@@ -271,6 +469,33 @@ func (s *Server) handleDeleteDeployment(w http.ResponseWriter, r *http.Request)
 		WHERE deployment_id = ? AND status IN ('queued', 'running')
 	`, string(deploy.JobCancelled), now, deploymentID)
 
+	// Un job en cours est interrompu ; la suppression attend qu'il se
+	// termine pour relire le VMID éventuellement alloué entre-temps.
+	if s.Worker != nil && (status == string(deploy.StatusRunning) || status == string(deploy.StatusQueued)) {
+		_, _ = s.DB.Sql().ExecContext(ctx, `
+			UPDATE deployments SET status = ?, updated_at = ? WHERE id = ?
+		`, string(deploy.StatusDeleting), now, deploymentID)
+		if done, ok := s.Worker.Cancel(deploymentID); ok {
+			go func(depID int64) {
+				select {
+				case <-done:
+				case <-time.After(5 * time.Minute):
+				}
+				bg := context.Background()
+				var vmid sql.NullInt64
+				var reqJSON string
+				err := s.DB.Sql().QueryRowContext(bg, `SELECT vmid, request_json FROM deployments WHERE id = ?`, depID).Scan(&vmid, &reqJSON)
+				if err == nil && vmid.Valid {
+					s.deleteVMAndDeployment(bg, depID, vmid.Int64, reqJSON)
+					return
+				}
+				_, _ = s.DB.Sql().ExecContext(bg, `DELETE FROM deployments WHERE id = ?`, depID)
+			}(deploymentID)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+
 	if vmid.Valid {
 		// VM exists: mark as deleting and run destruction in background.
 		_, _ = s.DB.Sql().ExecContext(ctx, `
@@ -291,13 +516,56 @@ func (s *Server) handleDeleteDeployment(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handleCancelDeployment stops a queued or running deployment. A running job
+// is interrupted (Proxmox waits, Ansible process) and its VM goes through the
+// cleanup policy; the deployment ends up "cancelled". Returns 202.
+func (s *Server) handleCancelDeployment(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	deploymentID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	var status string
+	if err := s.DB.Sql().QueryRowContext(ctx, `SELECT status FROM deployments WHERE id = ?`, deploymentID).Scan(&status); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status != string(deploy.StatusQueued) && status != string(deploy.StatusRunning) {
+		http.Error(w, "deployment is not in progress", http.StatusConflict)
+		return
+	}
+	_, _ = s.DB.Sql().ExecContext(ctx, `
+		UPDATE jobs
+		SET status = ?, updated_at = ?
+		WHERE deployment_id = ? AND status IN ('queued', 'running')
+	`, string(deploy.JobCancelled), time.Now().UTC(), deploymentID)
+
+	if s.Worker != nil {
+		if _, ok := s.Worker.Cancel(deploymentID); ok {
+			writeJSON(w, http.StatusAccepted, genericOKResponse{OK: true})
+			return
+		}
+	}
+	// Aucun job en cours : le déploiement attendait dans la file (ou un retry).
+	go func(depID int64) {
+		_ = deploy.CancelQueuedDeployment(context.Background(), s.DB, depID)
+	}(deploymentID)
+	writeJSON(w, http.StatusAccepted, genericOKResponse{OK: true})
+}
+
 func (s *Server) deleteVMAndDeployment(ctx context.Context, deploymentID int64, vmid int64, reqJSON string) {
 	cfg, err := config.LoadProxmoxConfig(ctx, s.DB)
 	if err != nil {
 		_, _ = s.DB.Sql().ExecContext(ctx, `DELETE FROM deployments WHERE id = ?`, deploymentID)
 		return
 	}
-	cl, err := proxmox.NewClient(cfg.APIURL, cfg.APITokenID, cfg.APITokenSecret)
+	cl, err := deploy.NewProxmoxClient(cfg)
 	if err != nil {
 		_, _ = s.DB.Sql().ExecContext(ctx, `DELETE FROM deployments WHERE id = ?`, deploymentID)
 		return
@@ -308,8 +576,14 @@ func (s *Server) deleteVMAndDeployment(ctx context.Context, deploymentID int64,
 	if node == "" {
 		node = cfg.DefaultNode
 	}
-	_, _ = cl.StopVM(ctx, node, int(vmid))
-	_, _ = cl.DeleteVM(ctx, node, int(vmid))
+	guest := cl.ForGuest(req.Guest())
+	_, _ = guest.StopVM(ctx, node, int(vmid))
+	_, _ = guest.DeleteVM(ctx, node, int(vmid))
+	if req.Guest() == proxmox.GuestQEMU {
+		if err := deploy.RemoveUserData(ctx, guest, cfg, node, deploymentID); err != nil {
+			log.Printf("deployment %d: %v", deploymentID, err)
+		}
+	}
 	_, _ = s.DB.Sql().ExecContext(ctx, `DELETE FROM deployments WHERE id = ?`, deploymentID)
 }
 
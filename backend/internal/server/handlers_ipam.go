@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/example/proxmox-game-deployer/internal/ipam"
+)
+
+// ipPoolResponse is a pool with its usage.
+type ipPoolResponse struct {
+	ipam.Pool
+	Size int `json:"size"`
+	Used int `json:"used"`
+}
+
+// poolID parses the {id} URL parameter of the IPAM routes.
+func poolID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// ipamError maps ipam errors to HTTP statuses (validation errors are 400,
+// database errors 500).
+func ipamError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ipam.ErrInvalidPool):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ipam.ErrNoPool):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ipam.ErrPoolInUse), errors.Is(err, ipam.ErrPoolExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleListIPPools returns the IPAM pools with their size and number of
+// allocated addresses.
+func (s *Server) handleListIPPools(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pools, err := ipam.ListPools(ctx, s.DB)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	used := map[int64]int{}
+	rows, err := s.DB.QueryContext(ctx, `SELECT pool_id, COUNT(*) FROM ip_allocations GROUP BY pool_id`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var n int
+		if err := rows.Scan(&id, &n); err == nil {
+			used[id] = n
+		}
+	}
+	out := make([]ipPoolResponse, len(pools))
+	for i := range pools {
+		out[i] = ipPoolResponse{Pool: pools[i], Size: pools[i].Size(), Used: used[pools[i].ID]}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleCreateIPPool creates an IPAM pool.
+func (s *Server) handleCreateIPPool(w http.ResponseWriter, r *http.Request) {
+	var p ipam.Pool
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if err := ipam.CreatePool(r.Context(), s.DB, &p); err != nil {
+		ipamError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, ipPoolResponse{Pool: p, Size: p.Size()})
+}
+
+// handleUpdateIPPool replaces the settings of an IPAM pool. Addresses
+// already allocated are kept.
+func (s *Server) handleUpdateIPPool(w http.ResponseWriter, r *http.Request) {
+	id, ok := poolID(w, r)
+	if !ok {
+		return
+	}
+	var p ipam.Pool
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	p.ID = id
+	if err := ipam.UpdatePool(r.Context(), s.DB, &p); err != nil {
+		ipamError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ipPoolResponse{Pool: p, Size: p.Size()})
+}
+
+// handleDeleteIPPool deletes an IPAM pool; 409 while addresses are allocated.
+func (s *Server) handleDeleteIPPool(w http.ResponseWriter, r *http.Request) {
+	id, ok := poolID(w, r)
+	if !ok {
+		return
+	}
+	if err := ipam.DeletePool(r.Context(), s.DB, id); err != nil {
+		ipamError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListIPAllocations returns the allocated addresses of a pool.
+func (s *Server) handleListIPAllocations(w http.ResponseWriter, r *http.Request) {
+	id, ok := poolID(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	if _, err := ipam.GetPool(ctx, s.DB, id); err != nil {
+		ipamError(w, err)
+		return
+	}
+	list, err := ipam.ListAllocations(ctx, s.DB, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if list == nil {
+		list = []ipam.Allocation{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorcon/rcon"
+
+	"github.com/example/proxmox-game-deployer/internal/deploy"
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+)
+
+// nodeMigrations holds the servers being moved to another node.
+var nodeMigrations sync.Map
+
+type nodeMigrateRequest struct {
+	TargetNode    string `json:"target_node"`
+	TargetStorage string `json:"target_storage,omitempty"`
+	// Online live-migrates a running VM (default). With online=false a
+	// running server is warned over RCON, stopped, moved and started again.
+	Online *bool `json:"online,omitempty"`
+	// WarningSeconds is the delay between the RCON warning and the stop
+	// (offline migration only, default 30, max 300).
+	WarningSeconds int `json:"warning_seconds,omitempty"`
+}
+
+// handleServerNodeMigrate moves the server VM to another Proxmox node. The
+// migration runs in the background (it can take much longer than an HTTP
+// request); its outcome is recorded in server_action_logs. Returns 202.
+func (s *Server) handleServerNodeMigrate(w http.ResponseWriter, r *http.Request) {
+	deploymentID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	var body nodeMigrateRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	body.TargetNode = strings.TrimSpace(body.TargetNode)
+	if body.TargetNode == "" {
+		http.Error(w, "target_node is required", http.StatusBadRequest)
+		return
+	}
+	if body.WarningSeconds < 0 || body.WarningSeconds > 300 {
+		http.Error(w, "warning_seconds must be between 0 and 300", http.StatusBadRequest)
+		return
+	}
+	if body.WarningSeconds == 0 {
+		body.WarningSeconds = 30
+	}
+
+	ctx := r.Context()
+	node, vmid, req, err := s.getServerProxmoxTarget(ctx, deploymentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	cl, cfg, err := s.proxmoxAPI(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	api := cl.ForGuest(req.Guest())
+	// La VM a pu être déplacée à la main depuis Proxmox.
+	node = s.relocateServer(ctx, deploymentID, api, int(vmid), node)
+	if body.TargetNode == node {
+		http.Error(w, fmt.Sprintf("server is already on node %s", node), http.StatusBadRequest)
+		return
+	}
+	check := req
+	check.Node, check.TemplateVM = body.TargetNode, 0
+	if body.TargetStorage != "" {
+		check.Storage = body.TargetStorage
+	}
+	if err := deploy.ValidateAgainstInventory(ctx, api, check, cfg); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"ok": false, "error": err.Error()})
+		return
+	}
+	cur, err := api.GetVMStatusCurrent(ctx, node, int(vmid))
+	if err != nil {
+		writeJSON(w, http.StatusOK, proxmoxFailure("Statut de la VM", err))
+		return
+	}
+	running := cur.Status == "running"
+	online := running
+	if body.Online != nil {
+		online = *body.Online && running
+	}
+
+	if _, busy := nodeMigrations.LoadOrStore(deploymentID, struct{}{}); busy {
+		http.Error(w, "a migration is already in progress for this server", http.StatusConflict)
+		return
+	}
+	// La migration continue côté Proxmox même si le serveur s'arrête : son
+	// contexte n'est pas annulé au shutdown, et un arrêt du process en cours
+	// de route est rattrapé par relocateServer.
+	go func() {
+		defer nodeMigrations.Delete(deploymentID)
+		s.migrateServerNode(context.WithoutCancel(s.baseCtx), deploymentID, api, int(vmid), node, body, running, online)
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]any{"ok": true, "from": node, "to": body.TargetNode, "online": online})
+}
+
+// migrateServerNode runs a node migration started by handleServerNodeMigrate.
+func (s *Server) migrateServerNode(ctx context.Context, deploymentID int64, api proxmox.API, vmid int, node string, body nodeMigrateRequest, running, online bool) {
+	mode := "offline"
+	if online {
+		mode = "online"
+	}
+	details := fmt.Sprintf("%s -> %s (%s)", node, body.TargetNode, mode)
+	fail := func(step string, err error) {
+		log.Printf("server %d: node migration %s: %s: %v", deploymentID, details, step, err)
+		s.logServerAction(ctx, deploymentID, "vm_migrate", details, false, step+": "+err.Error())
+	}
+
+	if running && !online {
+		s.warnPlayers(ctx, deploymentID, fmt.Sprintf("Server maintenance: the server will stop in %d seconds and be back in a few minutes.", body.WarningSeconds))
+		select {
+		case <-ctx.Done():
+			fail("warning", ctx.Err())
+			return
+		case <-time.After(time.Duration(body.WarningSeconds) * time.Second):
+		}
+		upid, err := api.StopVM(ctx, node, vmid)
+		if err == nil && upid != "" {
+			err = api.WaitForTask(ctx, node, upid, 5*time.Minute)
+		}
+		if err != nil {
+			fail("stop", err)
+			return
+		}
+	}
+
+	upid, err := api.MigrateVM(ctx, node, vmid, body.TargetNode, online, body.TargetStorage)
+	if err == nil {
+		err = api.WaitForTask(ctx, node, upid, 2*time.Hour)
+	}
+	if err != nil {
+		fail("migrate", err)
+		// La VM est restée sur le node d'origine : on la relance.
+		if running && !online {
+			if upid, err := api.StartVM(ctx, node, vmid); err == nil && upid != "" {
+				_ = api.WaitForTask(ctx, node, upid, 3*time.Minute)
+			}
+		}
+		return
+	}
+
+	if err := deploy.SetRequestNode(ctx, s.DB, deploymentID, body.TargetNode, body.TargetStorage); err != nil {
+		fail("update request", err)
+		return
+	}
+
+	if running && !online {
+		upid, err := api.StartVM(ctx, body.TargetNode, vmid)
+		if err == nil && upid != "" {
+			err = api.WaitForTask(ctx, body.TargetNode, upid, 3*time.Minute)
+		}
+		if err != nil {
+			fail("start on "+body.TargetNode, err)
+			return
+		}
+	}
+	s.logServerAction(ctx, deploymentID, "vm_migrate", details, true, fmt.Sprintf("VM %d moved to node %s", vmid, body.TargetNode))
+}
+
+// warnPlayers broadcasts msg in game over RCON and saves the world. Errors
+// are ignored: the server may have no player or RCON disabled.
+func (s *Server) warnPlayers(ctx context.Context, deploymentID int64, msg string) {
+	ip, _, err := s.getServerSSHTarget(ctx, deploymentID)
+	if err != nil {
+		return
+	}
+	port, password, err := s.getServerRCONConfig(ctx, deploymentID)
+	if err != nil {
+		return
+	}
+	client, err := rcon.Dial(fmt.Sprintf("%s:%d", ip, port), password)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	_, _ = client.Execute("say " + msg)
+	_, _ = client.Execute("save-all")
+}
+
+// relocateServer returns the node the VM of a server is actually on and
+// records it in the stored request when it differs from node (VM moved by
+// hand, or migration interrupted by a restart of the app). Falls back to
+// node when the VM cannot be located.
+func (s *Server) relocateServer(ctx context.Context, deploymentID int64, api proxmox.API, vmid int, node string) string {
+	actual, err := api.LocateVM(ctx, vmid)
+	if err != nil || actual == node {
+		return node
+	}
+	if err := deploy.SetRequestNode(ctx, s.DB, deploymentID, actual, ""); err != nil {
+		log.Printf("server %d: recording node %s: %v", deploymentID, actual, err)
+		return actual
+	}
+	log.Printf("server %d: VM %d found on node %s instead of %s, request updated", deploymentID, vmid, actual, node)
+	return actual
+}
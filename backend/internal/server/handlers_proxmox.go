@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+	"github.com/example/proxmox-game-deployer/internal/deploy"
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+)
+
+// proxmoxAPI builds a Proxmox client from the stored configuration.
+func (s *Server) proxmoxAPI(ctx context.Context) (proxmox.API, *config.ProxmoxConfig, error) {
+	cfg, err := config.LoadProxmoxConfig(ctx, s.DB)
+	if err != nil {
+		return nil, nil, err
+	}
+	api, err := deploy.NewProxmoxClient(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return api, cfg, nil
+}
+
+// writeInventory runs list against the configured cluster and writes its
+// result, or a 502 if Proxmox could not be queried.
+func (s *Server) writeInventory(w http.ResponseWriter, r *http.Request, list func(ctx context.Context, api proxmox.API) (any, error)) {
+	api, _, err := s.proxmoxAPI(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := list(r.Context(), api)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, proxmoxFailure("inventaire Proxmox", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleListProxmoxNodes lists the cluster nodes with their free resources.
+func (s *Server) handleListProxmoxNodes(w http.ResponseWriter, r *http.Request) {
+	s.writeInventory(w, r, func(ctx context.Context, api proxmox.API) (any, error) {
+		nodes, err := api.ListNodes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]map[string]any, 0, len(nodes))
+		for _, n := range nodes {
+			out = append(out, map[string]any{
+				"node":      n.Node,
+				"status":    n.Status,
+				"cpu":       n.CPU,
+				"maxcpu":    n.MaxCPU,
+				"mem":       n.Mem,
+				"maxmem":    n.MaxMem,
+				"free_mem":  n.FreeMem(),
+				"disk":      n.Disk,
+				"maxdisk":   n.MaxDisk,
+				"free_disk": n.MaxDisk - n.Disk,
+				"uptime":    n.Uptime,
+			})
+		}
+		return out, nil
+	})
+}
+
+// handleListProxmoxStorages lists the storages of a node.
+func (s *Server) handleListProxmoxStorages(w http.ResponseWriter, r *http.Request) {
+	node := chi.URLParam(r, "node")
+	s.writeInventory(w, r, func(ctx context.Context, api proxmox.API) (any, error) {
+		return api.ListStorages(ctx, node)
+	})
+}
+
+// handleListProxmoxBridges lists the network bridges of a node.
+func (s *Server) handleListProxmoxBridges(w http.ResponseWriter, r *http.Request) {
+	node := chi.URLParam(r, "node")
+	s.writeInventory(w, r, func(ctx context.Context, api proxmox.API) (any, error) {
+		return api.ListBridges(ctx, node)
+	})
+}
+
+// handleListProxmoxTemplates lists the VMs flagged as templates.
+func (s *Server) handleListProxmoxTemplates(w http.ResponseWriter, r *http.Request) {
+	s.writeInventory(w, r, func(ctx context.Context, api proxmox.API) (any, error) {
+		return api.ListTemplates(ctx)
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os/exec"
@@ -459,7 +460,7 @@ func (s *Server) handleServerMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ctx := r.Context()
-	node, vmid, _, err := s.getServerProxmoxTarget(ctx, deploymentID)
+	node, vmid, req, err := s.getServerProxmoxTarget(ctx, deploymentID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -469,12 +470,13 @@ func (s *Server) handleServerMetrics(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	client, err := proxmox.NewClient(cfg.APIURL, cfg.APITokenID, cfg.APITokenSecret)
+	client, err := deploy.NewProxmoxClient(cfg)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	status, err := client.GetVMStatusCurrent(ctx, node, int(vmid))
+	guest := client.ForGuest(req.Guest())
+	status, err := guest.GetVMStatusCurrent(ctx, node, int(vmid))
 	if err != nil {
 		writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": err.Error()})
 		return
@@ -497,8 +499,19 @@ func (s *Server) handleServerMetrics(w http.ResponseWriter, r *http.Request) {
 	if status.MaxDisk > 0 {
 		out["disk_available_bytes"] = status.MaxDisk - status.Disk
 	}
-	// If disk usage not reported by Proxmox (0), fallback to SSH df for disk only
+	out["disk_source"] = "proxmox"
+	// If disk usage not reported by Proxmox (0), ask the guest agent, then
+	// fallback to SSH df for disk only
 	if status.MaxDisk == 0 || status.Disk == 0 {
+		out["disk_source"] = "none"
+		if root := agentRootFS(ctx, guest, node, int(vmid)); root != nil {
+			out["disk_total_bytes"] = root.TotalBytes
+			out["disk_used_bytes"] = root.UsedBytes
+			out["disk_available_bytes"] = root.TotalBytes - root.UsedBytes
+			out["disk_source"] = "agent"
+		}
+	}
+	if out["disk_source"] == "none" {
 		ip, sshUser, err := s.getServerSSHTarget(ctx, deploymentID)
 		if err == nil {
 			keyPath := sshexec.KeyPath()
@@ -511,6 +524,7 @@ func (s *Server) handleServerMetrics(w http.ResponseWriter, r *http.Request) {
 				out["disk_total_bytes"] = total
 				out["disk_used_bytes"] = used
 				out["disk_available_bytes"] = avail
+				out["disk_source"] = "ssh"
 			}
 		}
 	}
@@ -639,11 +653,12 @@ func (s *Server) handleUpdateServerConfig(w http.ResponseWriter, r *http.Request
 // getServerSSHTarget returns ip and ssh_user for a successful Minecraft deployment.
 func (s *Server) getServerSSHTarget(ctx context.Context, deploymentID int64) (ip, sshUser string, err error) {
 	row := s.DB.Sql().QueryRowContext(ctx, `
-		SELECT ip_address FROM deployments
+		SELECT ip_address, request_json FROM deployments
 		WHERE id = ? AND game = ? AND status = ?
 	`, deploymentID, "minecraft", string(deploy.StatusSuccess))
 	var ipAddr sql.NullString
-	if err := row.Scan(&ipAddr); err != nil {
+	var reqJSON string
+	if err := row.Scan(&ipAddr, &reqJSON); err != nil {
 		return "", "", err
 	}
 	if !ipAddr.Valid || ipAddr.String == "" {
@@ -653,7 +668,9 @@ func (s *Server) getServerSSHTarget(ctx context.Context, deploymentID int64) (ip
 	if err != nil {
 		return "", "", err
 	}
-	user := cfg.SSHUser
+	var req deploy.MinecraftDeploymentRequest
+	_ = json.Unmarshal([]byte(reqJSON), &req)
+	user := deploy.SSHUserFor(req, cfg)
 	if user == "" {
 		user = "ubuntu"
 	}
@@ -849,13 +866,27 @@ func (s *Server) handleUpdateServerSpecs(w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	client, err := proxmox.NewClient(cfg.APIURL, cfg.APITokenID, cfg.APITokenSecret)
+	cl, err := deploy.NewProxmoxClient(cfg)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	client := cl.ForGuest(req.Guest())
 	cpuOrRamChanged := body.Cores != req.Cores || body.MemoryMB != req.MemoryMB
 	ramChanged := body.MemoryMB != req.MemoryMB
+	if body.DiskGB < req.DiskGB {
+		writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": "Le rétrécissement du disque n'est pas supporté par Proxmox. Indiquez une taille supérieure ou égale à la taille actuelle."})
+		return
+	}
+	if !cpuOrRamChanged && body.DiskGB == req.DiskGB {
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true, "message": "Aucun changement."})
+		return
+	}
+	// Snapshot seulement une fois la demande validée et s'il y a un changement.
+	if err := s.autoSnapshot(ctx, deploymentID, "specs"); err != nil {
+		writeJSON(w, http.StatusOK, proxmoxFailure("Snapshot avant changement de specs", err))
+		return
+	}
 	var newHeap string
 	if ramChanged {
 		newHeap = calcMinecraftHeap(body.MemoryMB)
@@ -863,22 +894,18 @@ func (s *Server) handleUpdateServerSpecs(w http.ResponseWriter, r *http.Request)
 	}
 
 	if err := client.UpdateVMConfig(ctx, node, int(vmid), body.Cores, body.MemoryMB); err != nil {
-		writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": "Proxmox config: " + err.Error()})
+		writeJSON(w, http.StatusOK, proxmoxFailure("Proxmox config", err))
 		return
 	}
 	if body.DiskGB != req.DiskGB {
-		if body.DiskGB < req.DiskGB {
-			writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": "Le rétrécissement du disque n'est pas supporté par Proxmox. Indiquez une taille supérieure ou égale à la taille actuelle."})
-			return
-		}
 		upid, err := client.ResizeDisk(ctx, node, int(vmid), body.DiskGB)
 		if err != nil {
-			writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": "Resize disk: " + err.Error()})
+			writeJSON(w, http.StatusOK, proxmoxFailure("Resize disk", err))
 			return
 		}
 		if upid != "" {
 			if err := client.WaitForTask(ctx, node, upid, 30*time.Minute); err != nil {
-				writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": "Resize task: " + err.Error()})
+				writeJSON(w, http.StatusOK, proxmoxFailure("Resize task", err))
 				return
 			}
 		}
@@ -892,23 +919,23 @@ func (s *Server) handleUpdateServerSpecs(w http.ResponseWriter, r *http.Request)
 		if errStatus == nil && cur != nil && cur.Status == "running" {
 			upidStop, errStop := client.StopVM(ctx, node, int(vmid))
 			if errStop != nil {
-				writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": "Arrêt de la VM pour appliquer CPU/RAM: " + errStop.Error()})
+				writeJSON(w, http.StatusOK, proxmoxFailure("Arrêt de la VM pour appliquer CPU/RAM", errStop))
 				return
 			}
 			if upidStop != "" {
 				if err := client.WaitForTask(ctx, node, upidStop, 5*time.Minute); err != nil {
-					writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": "Attente arrêt VM: " + err.Error()})
+					writeJSON(w, http.StatusOK, proxmoxFailure("Attente arrêt VM", err))
 					return
 				}
 			}
 			upidStart, errStart := client.StartVM(ctx, node, int(vmid))
 			if errStart != nil {
-				writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": "Redémarrage de la VM: " + errStart.Error()})
+				writeJSON(w, http.StatusOK, proxmoxFailure("Redémarrage de la VM", errStart))
 				return
 			}
 			if upidStart != "" {
 				if err := client.WaitForTask(ctx, node, upidStart, 3*time.Minute); err != nil {
-					writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": "Attente démarrage VM: " + err.Error()})
+					writeJSON(w, http.StatusOK, proxmoxFailure("Attente démarrage VM", err))
 					return
 				}
 			}
@@ -931,7 +958,7 @@ func (s *Server) handleUpdateServerSpecs(w http.ResponseWriter, r *http.Request)
 		if errStatus == nil && cur != nil && cur.Status == "running" {
 			ip, _, errSSH := s.getServerSSHTarget(ctx, deploymentID)
 			if errSSH == nil && ip != "" {
-				_ = client.WaitForSSH(ctx, ip, 22, 5*time.Minute)
+				_ = proxmox.WaitForSSH(ctx, ip, 22, 5*time.Minute)
 				if err := s.applyMinecraftHeapOnVM(ctx, deploymentID, newHeap); err == nil {
 					heapApplied = true
 				} else {
@@ -1225,6 +1252,11 @@ func (s *Server) handleServerMigrate(w http.ResponseWriter, r *http.Request) {
 	}
 	keyPath := sshexec.KeyPath()
 
+	if err := s.autoSnapshot(ctx, deploymentID, "migrate"); err != nil {
+		writeJSON(w, http.StatusOK, proxmoxFailure("Snapshot avant migration", err))
+		return
+	}
+
 	// 1. Stop the service
 	if stdout, stderr, err := sshexec.RunCommand(ctx, ip, sshUser, keyPath, "sudo systemctl stop minecraft"); err != nil {
 		s.logServerAction(ctx, deploymentID, "migrate", version, false, "arrêt du service: "+err.Error())
@@ -1578,3 +1610,26 @@ func execCommandWithStdin(ctx context.Context, host, user, keyPath, command, std
 	cmd.Stdin = strings.NewReader(stdinContent)
 	return cmd
 }
+
+// proxmoxFailure builds the {"ok": false} response of a failed Proxmox call
+// with an actionable message: locked VM, rejected parameters (with the
+// per-field errors), missing VM or invalid credentials.
+func proxmoxFailure(action string, err error) map[string]any {
+	out := map[string]any{"ok": false}
+	msg := action + ": " + err.Error()
+	var se *proxmox.StatusError
+	switch {
+	case errors.Is(err, proxmox.ErrLocked):
+		msg = action + " : la VM est verrouillée par une autre opération Proxmox (sauvegarde, snapshot, migration...). Réessayez dans quelques instants."
+		out["retryable"] = true
+	case errors.As(err, &se) && len(se.Errors) > 0:
+		msg = action + " : paramètres refusés par Proxmox (" + se.FieldErrors() + ")"
+		out["field_errors"] = se.Errors
+	case errors.Is(err, proxmox.ErrNotFound):
+		msg = action + " : la VM est introuvable sur Proxmox (supprimée ou migrée ?)."
+	case errors.Is(err, proxmox.ErrUnauthorized):
+		msg = action + " : accès refusé par Proxmox, vérifiez le token API et ses permissions."
+	}
+	out["error"] = msg
+	return out
+}
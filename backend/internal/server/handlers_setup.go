@@ -4,13 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/example/proxmox-game-deployer/internal/auth"
 	"github.com/example/proxmox-game-deployer/internal/config"
-	"github.com/example/proxmox-game-deployer/internal/proxmox"
+	"github.com/example/proxmox-game-deployer/internal/deploy"
 	"github.com/example/proxmox-game-deployer/internal/sshkeys"
 )
 
@@ -36,8 +38,11 @@ func (s *Server) handleSetupStatus(w http.ResponseWriter, r *http.Request) {
 
 type testProxmoxRequest struct {
 	APIURL         string   `json:"api_url"`
+	AuthMode       string   `json:"auth_mode,omitempty"`
 	APITokenID     string   `json:"api_token_id"`
 	APITokenSecret string   `json:"api_token_secret"`
+	Username       string   `json:"username,omitempty"`
+	Password       string   `json:"password,omitempty"`
 }
 
 type genericOKResponse struct {
@@ -56,7 +61,14 @@ func (s *Server) handleTestProxmox(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid json", http.StatusBadRequest)
 		return
 	}
-	cl, err := proxmox.NewClient(req.APIURL, req.APITokenID, req.APITokenSecret)
+	cl, err := deploy.NewProxmoxClient(&config.ProxmoxConfig{
+		APIURL:         req.APIURL,
+		AuthMode:       req.AuthMode,
+		APITokenID:     req.APITokenID,
+		APITokenSecret: req.APITokenSecret,
+		Username:       req.Username,
+		Password:       req.Password,
+	})
 	if err != nil {
 		writeJSON(w, http.StatusOK, genericOKResponse{OK: false, Error: err.Error()})
 		return
@@ -80,7 +92,7 @@ func (s *Server) handleTestProxmoxCurrent(w http.ResponseWriter, r *http.Request
 		writeJSON(w, http.StatusOK, genericOKResponse{OK: false, Error: err.Error()})
 		return
 	}
-	cl, err := proxmox.NewClient(cfg.APIURL, cfg.APITokenID, cfg.APITokenSecret)
+	cl, err := deploy.NewProxmoxClient(cfg)
 	if err != nil {
 		writeJSON(w, http.StatusOK, genericOKResponse{OK: false, Error: err.Error()})
 		return
@@ -127,6 +139,10 @@ func (s *Server) handleInitialize(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "admin username/password required", http.StatusBadRequest)
 		return
 	}
+	if err := validateProxmoxAuth(req.Proxmox); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	err = s.DB.WithTx(ctx, func(tx *sql.Tx) error {
 		if err := config.SaveProxmoxConfig(ctx, tx, req.Proxmox); err != nil {
@@ -197,6 +213,47 @@ func (s *Server) handleUpdateProxmoxConfig(w http.ResponseWriter, r *http.Reques
 	if req.Proxmox.APITokenSecret == "" && existing != nil {
 		req.Proxmox.APITokenSecret = existing.APITokenSecret
 	}
+	if req.Proxmox.Password == "" && existing != nil && req.Proxmox.Username == existing.Username {
+		req.Proxmox.Password = existing.Password
+	}
+	if err := validateProxmoxAuth(req.Proxmox); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := deploy.ParseCleanupPolicy(req.Proxmox.FailureCleanup); err != nil {
+		http.Error(w, "failure_cleanup: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Proxmox.APITimeoutSeconds < 0 || req.Proxmox.APIRetries < 0 {
+		http.Error(w, "api_timeout_seconds and api_retries must be >= 0", http.StatusBadRequest)
+		return
+	}
+	if req.Proxmox.PlacementStrategy != "" {
+		if _, err := deploy.LookupPlacementStrategy(req.Proxmox.PlacementStrategy); err != nil {
+			http.Error(w, "placement_strategy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Proxmox.Provisioner != "" {
+		if _, err := deploy.LookupProvisioner(req.Proxmox.Provisioner); err != nil {
+			http.Error(w, "provisioner: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if t := req.Proxmox.LXCTemplate; t != "" && !strings.Contains(t, ":vztmpl/") {
+		http.Error(w, "lxc_template must be a vztmpl volume (storage:vztmpl/file)", http.StatusBadRequest)
+		return
+	}
+	if _, err := deploy.ParseNetworkMode(req.Proxmox.NetworkMode); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Proxmox.CloudInitConfig) != "" {
+		if err := deploy.ValidateCloudInitTemplate(req.Proxmox.CloudInitConfig); err != nil {
+			http.Error(w, "cloud_init_config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	if err := config.SaveProxmoxConfig(ctx, s.DB, req.Proxmox); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -206,6 +263,24 @@ func (s *Server) handleUpdateProxmoxConfig(w http.ResponseWriter, r *http.Reques
 	writeJSON(w, http.StatusOK, genericOKResponse{OK: true})
 }
 
+// validateProxmoxAuth checks the auth mode and, for ticket auth, that the
+// user credentials are present.
+func validateProxmoxAuth(cfg config.ProxmoxConfig) error {
+	switch cfg.AuthMode {
+	case config.AuthModeToken, "":
+	case config.AuthModeTicket:
+		if cfg.Username == "" || cfg.Password == "" {
+			return errors.New("username and password are required for ticket auth")
+		}
+		if !strings.Contains(cfg.Username, "@") {
+			return errors.New("username must include the realm (e.g. deployer@pve)")
+		}
+	default:
+		return fmt.Errorf("auth_mode must be %q or %q", config.AuthModeToken, config.AuthModeTicket)
+	}
+	return nil
+}
+
 // handleGetSSHKey returns the app-managed SSH public key, generating it if needed.
 func (s *Server) handleGetSSHKey(w http.ResponseWriter, r *http.Request) {
 	pub, err := sshkeys.EnsureKeyPair()
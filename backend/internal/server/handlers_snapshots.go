@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/example/proxmox-game-deployer/internal/config"
+	"github.com/example/proxmox-game-deployer/internal/proxmox"
+)
+
+// Proxmox snapshot names: a letter then letters, digits, - or _ (40 max).
+var snapshotNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{1,39}$`)
+
+// Prefix of the snapshots taken before risky operations, and how many of
+// them are kept per server.
+const (
+	autoSnapshotPrefix = "auto-"
+	autoSnapshotKeep   = 3
+)
+
+// snapshotTaskWait is how long a snapshot request waits for its Proxmox task
+// before answering 202 (RAM snapshots of big VMs take minutes).
+const snapshotTaskWait = 45 * time.Second
+
+// snapshotTarget resolves the Proxmox client, node and VMID of a server.
+func (s *Server) snapshotTarget(ctx context.Context, deploymentID int64) (proxmox.API, string, int, error) {
+	node, vmid, req, err := s.getServerProxmoxTarget(ctx, deploymentID)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	api, _, err := s.proxmoxAPI(ctx)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return api.ForGuest(req.Guest()), node, int(vmid), nil
+}
+
+// runSnapshotTask waits for a snapshot task and records the outcome in
+// server_action_logs. The wait goes on in the background after
+// snapshotTaskWait; done is then false.
+func (s *Server) runSnapshotTask(ctx context.Context, api proxmox.API, deploymentID int64, node, upid, action, details string) (done bool, err error) {
+	result := make(chan error, 1)
+	go func() {
+		err := api.WaitForTask(s.baseCtx, node, upid, time.Hour)
+		if err != nil {
+			s.logServerAction(s.baseCtx, deploymentID, action, details, false, err.Error())
+		} else {
+			s.logServerAction(s.baseCtx, deploymentID, action, details, true, "OK")
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return true, err
+	case <-time.After(snapshotTaskWait):
+		return false, nil
+	case <-ctx.Done():
+		return false, nil
+	}
+}
+
+// writeSnapshotResult answers a snapshot action.
+func writeSnapshotResult(w http.ResponseWriter, action string, done bool, err error, extra map[string]any) {
+	if err != nil {
+		writeJSON(w, http.StatusOK, proxmoxFailure(action, err))
+		return
+	}
+	out := map[string]any{"ok": true}
+	for k, v := range extra {
+		out[k] = v
+	}
+	if !done {
+		out["pending"] = true
+		writeJSON(w, http.StatusAccepted, out)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleListSnapshots lists the Proxmox snapshots of the server VM.
+func (s *Server) handleListSnapshots(w http.ResponseWriter, r *http.Request) {
+	deploymentID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	api, node, vmid, err := s.snapshotTarget(r.Context(), deploymentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	snaps, err := api.ListSnapshots(r.Context(), node, vmid)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, proxmoxFailure("Liste des snapshots", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, snaps)
+}
+
+// handleCreateSnapshot takes a snapshot of the server VM. Body: name
+// (optional), description, include_ram.
+func (s *Server) handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	deploymentID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		IncludeRAM  bool   `json:"include_ram"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = "snap-" + time.Now().Format("20060102-150405")
+	}
+	if !snapshotNameRe.MatchString(name) || name == "current" {
+		http.Error(w, "name must start with a letter and contain only letters, digits, - and _ (2 to 40 characters)", http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(name, autoSnapshotPrefix) {
+		http.Error(w, fmt.Sprintf("names starting with %q are reserved for automatic snapshots", autoSnapshotPrefix), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	api, node, vmid, err := s.snapshotTarget(ctx, deploymentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	details := name
+	if body.IncludeRAM {
+		details += " (with RAM)"
+	}
+	upid, err := api.CreateSnapshot(ctx, node, vmid, name, body.Description, body.IncludeRAM)
+	if err != nil {
+		s.logServerAction(ctx, deploymentID, "snapshot_create", details, false, err.Error())
+		writeJSON(w, http.StatusOK, proxmoxFailure("Snapshot", err))
+		return
+	}
+	done, err := s.runSnapshotTask(ctx, api, deploymentID, node, upid, "snapshot_create", details)
+	writeSnapshotResult(w, "Snapshot", done, err, map[string]any{"name": name})
+}
+
+// handleRollbackSnapshot restores the server VM to a snapshot. A VM that was
+// running is started again when the snapshot has no RAM state.
+func (s *Server) handleRollbackSnapshot(w http.ResponseWriter, r *http.Request) {
+	deploymentID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	name := chi.URLParam(r, "name")
+	ctx := r.Context()
+	api, node, vmid, err := s.snapshotTarget(ctx, deploymentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	wasRunning := false
+	if cur, err := api.GetVMStatusCurrent(ctx, node, vmid); err == nil {
+		wasRunning = cur.Status == "running"
+	}
+	upid, err := api.RollbackSnapshot(ctx, node, vmid, name)
+	if err != nil {
+		s.logServerAction(ctx, deploymentID, "snapshot_rollback", name, false, err.Error())
+		writeJSON(w, http.StatusOK, proxmoxFailure("Rollback", err))
+		return
+	}
+	done, err := s.runSnapshotTask(ctx, api, deploymentID, node, upid, "snapshot_rollback", name)
+	if done && err == nil && wasRunning {
+		if cur, errStatus := api.GetVMStatusCurrent(ctx, node, vmid); errStatus == nil && cur.Status != "running" {
+			if upid, errStart := api.StartVM(ctx, node, vmid); errStart == nil && upid != "" {
+				_ = api.WaitForTask(ctx, node, upid, 30*time.Second)
+			}
+		}
+	}
+	writeSnapshotResult(w, "Rollback", done, err, nil)
+}
+
+// handleDeleteSnapshot removes a snapshot of the server VM.
+func (s *Server) handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	deploymentID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	name := chi.URLParam(r, "name")
+	ctx := r.Context()
+	api, node, vmid, err := s.snapshotTarget(ctx, deploymentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	upid, err := api.DeleteSnapshot(ctx, node, vmid, name)
+	if err != nil {
+		s.logServerAction(ctx, deploymentID, "snapshot_delete", name, false, err.Error())
+		writeJSON(w, http.StatusOK, proxmoxFailure("Suppression du snapshot", err))
+		return
+	}
+	done, err := s.runSnapshotTask(ctx, api, deploymentID, node, upid, "snapshot_delete", name)
+	writeSnapshotResult(w, "Suppression du snapshot", done, err, nil)
+}
+
+// autoSnapshotEnabled reports whether snapshots are taken before risky
+// operations.
+func autoSnapshotEnabled(cfg *config.ProxmoxConfig) bool {
+	return (cfg != nil && cfg.AutoSnapshot) || os.Getenv("APP_AUTO_SNAPSHOT") == "true"
+}
+
+// autoSnapshot takes a disk snapshot of the server VM before a risky
+// operation (reason: "migrate", "specs"...), when enabled, and prunes the
+// oldest automatic snapshots. The operation must not go on if it fails.
+func (s *Server) autoSnapshot(ctx context.Context, deploymentID int64, reason string) error {
+	cfg, err := config.LoadProxmoxConfig(ctx, s.DB)
+	if err != nil || !autoSnapshotEnabled(cfg) {
+		return nil
+	}
+	api, node, vmid, err := s.snapshotTarget(ctx, deploymentID)
+	if err != nil {
+		return err
+	}
+	name := autoSnapshotPrefix + reason + "-" + time.Now().Format("20060102-150405")
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	upid, err := api.CreateSnapshot(ctx, node, vmid, name, "Automatic snapshot before "+reason, false)
+	if err == nil {
+		err = api.WaitForTask(ctx, node, upid, 10*time.Minute)
+	}
+	if err != nil {
+		s.logServerAction(ctx, deploymentID, "snapshot_create", name+" (auto)", false, err.Error())
+		return fmt.Errorf("automatic snapshot before %s: %w", reason, err)
+	}
+	s.logServerAction(ctx, deploymentID, "snapshot_create", name+" (auto)", true, "OK")
+
+	snaps, err := api.ListSnapshots(ctx, node, vmid)
+	if err != nil {
+		return nil
+	}
+	var autos []proxmox.Snapshot
+	for _, sn := range snaps {
+		if strings.HasPrefix(sn.Name, autoSnapshotPrefix) {
+			autos = append(autos, sn)
+		}
+	}
+	for len(autos) > autoSnapshotKeep {
+		old := autos[0]
+		autos = autos[1:]
+		upid, err := api.DeleteSnapshot(ctx, node, vmid, old.Name)
+		if err == nil {
+			err = api.WaitForTask(ctx, node, upid, 10*time.Minute)
+		}
+		if err != nil {
+			s.logServerAction(ctx, deploymentID, "snapshot_delete", old.Name+" (auto)", false, err.Error())
+			break
+		}
+		s.logServerAction(ctx, deploymentID, "snapshot_delete", old.Name+" (auto)", true, "OK")
+	}
+	return nil
+}
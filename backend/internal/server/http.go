@@ -4,9 +4,11 @@ import (
 	"context"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -23,6 +25,17 @@ import (
 type Server struct {
 	DB     *db.DB
 	Router *chi.Mux
+	// Worker is the background job worker, used to cancel running deployments.
+	Worker *deploy.Worker
+
+	httpServer *http.Server
+	// baseCtx is the parent context of every request; it is cancelled on
+	// shutdown so that long-lived streams (SSE) end.
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
+	stopCh     chan struct{} // arrête le collecteur de monitoring
+	monitorWG  sync.WaitGroup
+	stopOnce   sync.Once
 }
 
 // New constructs a Server, applies migrations and routes.
@@ -35,21 +48,31 @@ func New(ctx context.Context, dbPath string) (*Server, error) {
 		return nil, err
 	}
 
-	s := &Server{DB: database}
-	go s.RunMonitoringCollector()
+	s := &Server{DB: database, stopCh: make(chan struct{})}
+	s.baseCtx, s.cancelBase = context.WithCancel(context.Background())
+	s.monitorWG.Add(1)
+	go func() {
+		defer s.monitorWG.Done()
+		s.RunMonitoringCollector()
+	}()
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	// Timeout 60s for most routes; exclude long-lived SSE (console stream)
+	// Timeout 60s for most routes; exclude long-lived SSE (console and deployment log streams)
+	// and give server operations waiting for Proxmox tasks (automatic snapshot, resize) more time.
 	r.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			if req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/servers/") && strings.HasSuffix(req.URL.Path, "/console") {
+			if req.Method == http.MethodGet && isStreamPath(req.URL.Path) {
 				next.ServeHTTP(w, req)
 				return
 			}
-			middleware.Timeout(60 * time.Second)(next).ServeHTTP(w, req)
+			timeout := 60 * time.Second
+			if isLongOperation(req.Method, req.URL.Path) {
+				timeout = longOperationTimeout
+			}
+			middleware.Timeout(timeout)(next).ServeHTTP(w, req)
 		})
 	})
 
@@ -83,20 +106,35 @@ func New(ctx context.Context, dbPath string) (*Server, error) {
 				r.Use(s.requireAdminOrOwner)
 				r.Get("/users", s.handleListUsers)
 			})
+			// IPAM : pools d'adresses des déploiements (admin ou propriétaire)
+			r.Group(func(r chi.Router) {
+				r.Use(s.requireAdminOrOwner)
+				r.Get("/ipam/pools", s.handleListIPPools)
+				r.Post("/ipam/pools", s.handleCreateIPPool)
+				r.Put("/ipam/pools/{id}", s.handleUpdateIPPool)
+				r.Delete("/ipam/pools/{id}", s.handleDeleteIPPool)
+				r.Get("/ipam/pools/{id}/allocations", s.handleListIPAllocations)
+			})
 			r.Group(func(r chi.Router) {
 				r.Use(s.requireOwner)
 				r.Post("/users", s.handleCreateUser)
 				r.Put("/users/{id}/role", s.handleUpdateUserRole)
 				r.Delete("/users/{id}", s.handleDeleteUser)
 			})
-			// Déploiements : créer, lister, détail, logs, supprimer, assigner (admin ou propriétaire)
+			// Déploiements : inventaire Proxmox (listes du formulaire), créer, lister, détail, logs, supprimer, assigner (admin ou propriétaire)
 			r.Group(func(r chi.Router) {
 				r.Use(s.requireCanDeploy)
+				r.Get("/proxmox/nodes", s.handleListProxmoxNodes)
+				r.Get("/proxmox/nodes/{node}/storages", s.handleListProxmoxStorages)
+				r.Get("/proxmox/nodes/{node}/bridges", s.handleListProxmoxBridges)
+				r.Get("/proxmox/templates", s.handleListProxmoxTemplates)
 				r.Post("/deployments/validate", s.handleValidateDeployment)
 				r.Post("/deployments", s.handleCreateDeployment)
 				r.Get("/deployments", s.handleListDeployments)
 				r.Get("/deployments/{id}", s.handleGetDeployment)
 				r.Get("/deployments/{id}/logs", s.handleGetDeploymentLogs)
+				r.Get("/deployments/{id}/logs/stream", s.handleStreamDeploymentLogs)
+				r.Post("/deployments/{id}/cancel", s.handleCancelDeployment)
 				r.Delete("/deployments/{id}", s.handleDeleteDeployment)
 				r.Put("/deployments/{id}/assign", s.handleAssignDeployment)
 			})
@@ -119,8 +157,15 @@ func New(ctx context.Context, dbPath string) (*Server, error) {
 				r.Post("/backup", s.handleCreateBackup)
 				r.Delete("/backup", s.handleDeleteBackup)
 				r.Get("/backup/download", s.handleDownloadBackup)
+				r.Get("/snapshots", s.handleListSnapshots)
+				r.Post("/snapshots", s.handleCreateSnapshot)
+				// Restauration et suppression de snapshots (admin ou propriétaire)
+				r.With(s.requireAdminOrOwner).Post("/snapshots/{name}/rollback", s.handleRollbackSnapshot)
+				r.With(s.requireAdminOrOwner).Delete("/snapshots/{name}", s.handleDeleteSnapshot)
 				r.Get("/action-logs", s.handleServerActionLogs)
 				r.Post("/migrate", s.handleServerMigrate)
+				// Déplacement de la VM vers un autre node Proxmox (admin ou propriétaire)
+				r.With(s.requireAdminOrOwner).Post("/node-migrate", s.handleServerNodeMigrate)
 				r.Get("/files", s.handleListFiles)
 				r.Get("/files/content", s.handleGetFileContent)
 				r.Put("/files/content", s.handlePutFileContent)
@@ -141,10 +186,63 @@ func New(ctx context.Context, dbPath string) (*Server, error) {
 	return s, nil
 }
 
-// ListenAndServe starts the HTTP server.
+// ListenAndServe starts the HTTP server. It returns http.ErrServerClosed
+// after Shutdown.
 func (s *Server) ListenAndServe(addr string) error {
 	log.Printf("listening on %s", addr)
-	return http.ListenAndServe(addr, s.Router)
+	s.httpServer = &http.Server{
+		Addr:        addr,
+		Handler:     s.Router,
+		BaseContext: func(net.Listener) context.Context { return s.baseCtx },
+	}
+	s.httpServer.RegisterOnShutdown(s.cancelBase)
+	return s.httpServer.ListenAndServe()
+}
+
+// Shutdown stops accepting connections, ends SSE streams, waits for in-flight
+// requests and stops the monitoring collector, until ctx expires.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	if s.httpServer != nil {
+		err = s.httpServer.Shutdown(ctx)
+	}
+	s.cancelBase()
+	s.stopOnce.Do(func() { close(s.stopCh) })
+	done := make(chan struct{})
+	go func() {
+		s.monitorWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// isStreamPath reports whether path is a long-lived SSE endpoint.
+func isStreamPath(path string) bool {
+	if strings.Contains(path, "/servers/") && strings.HasSuffix(path, "/console") {
+		return true
+	}
+	return strings.Contains(path, "/deployments/") && strings.HasSuffix(path, "/logs/stream")
+}
+
+// longOperationTimeout bounds the server operations that wait for Proxmox
+// tasks: automatic snapshot (10 min) then disk resize (30 min).
+const longOperationTimeout = 45 * time.Minute
+
+// isLongOperation reports whether a request is a server operation that may
+// take an automatic snapshot before running (specs update, version migrate).
+func isLongOperation(method, path string) bool {
+	if !strings.Contains(path, "/servers/") {
+		return false
+	}
+	return (method == http.MethodPut && strings.HasSuffix(path, "/specs")) ||
+		(method == http.MethodPost && strings.HasSuffix(path, "/migrate"))
 }
 
 // IsInitialized is a helper to check initialization status.
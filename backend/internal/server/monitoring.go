@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"log"
 	"regexp"
 	"strconv"
@@ -25,7 +26,7 @@ const (
 // collectMonitoringSample fetches one sample for a deployment (metrics + optional minecraft).
 func (s *Server) collectMonitoringSample(ctx context.Context, deploymentID int64) (
 	cpu, ramPct, diskPct float64, tps *float64, players *int, err error) {
-	node, vmid, _, err := s.getServerProxmoxTarget(ctx, deploymentID)
+	node, vmid, req, err := s.getServerProxmoxTarget(ctx, deploymentID)
 	if err != nil {
 		return 0, 0, 0, nil, nil, err
 	}
@@ -33,11 +34,18 @@ func (s *Server) collectMonitoringSample(ctx context.Context, deploymentID int64
 	if err != nil {
 		return 0, 0, 0, nil, nil, err
 	}
-	client, err := proxmox.NewClient(cfg.APIURL, cfg.APITokenID, cfg.APITokenSecret)
+	client, err := deploy.NewProxmoxClient(cfg)
 	if err != nil {
 		return 0, 0, 0, nil, nil, err
 	}
-	status, err := client.GetVMStatusCurrent(ctx, node, int(vmid))
+	guest := client.ForGuest(req.Guest())
+	status, err := guest.GetVMStatusCurrent(ctx, node, int(vmid))
+	if errors.Is(err, proxmox.ErrNotFound) {
+		if moved := s.relocateServer(ctx, deploymentID, guest, int(vmid), node); moved != node {
+			node = moved
+			status, err = guest.GetVMStatusCurrent(ctx, node, int(vmid))
+		}
+	}
 	if err != nil {
 		return 0, 0, 0, nil, nil, err
 	}
@@ -52,6 +60,12 @@ func (s *Server) collectMonitoringSample(ctx context.Context, deploymentID int64
 		diskPct = 100 * float64(status.Disk) / float64(status.MaxDisk)
 	}
 	if status.MaxDisk == 0 || status.Disk == 0 {
+		// Sans agent, Proxmox ne connaît pas l'occupation disque d'une VM.
+		if root := agentRootFS(ctx, guest, node, int(vmid)); root != nil {
+			diskPct = 100 * float64(root.UsedBytes) / float64(root.TotalBytes)
+		}
+	}
+	if diskPct == 0 {
 		ip, sshUser, err := s.getServerSSHTarget(ctx, deploymentID)
 		if err == nil {
 			stdout, _, _ := sshexec.RunCommand(ctx, ip, sshUser, sshexec.KeyPath(), "df -B1 / | tail -1")
@@ -101,18 +115,36 @@ func (s *Server) collectMonitoringSample(ctx context.Context, deploymentID int64
 	return cpu, ramPct, diskPct, tps, players, nil
 }
 
-// RunMonitoringCollector runs in the background: collect once at start, then every minute.
+// agentRootFS returns the root filesystem reported by the guest agent, nil
+// if the agent is unavailable.
+func agentRootFS(ctx context.Context, api proxmox.API, node string, vmid int) *proxmox.AgentFilesystem {
+	fs, err := api.AgentFSInfo(ctx, node, vmid)
+	if err != nil {
+		return nil
+	}
+	if root := proxmox.RootFilesystem(fs); root != nil && root.TotalBytes > 0 {
+		return root
+	}
+	return nil
+}
+
+// RunMonitoringCollector runs in the background: collect once at start, then
+// every minute, until the server shuts down.
 func (s *Server) RunMonitoringCollector() {
 	ticker := time.NewTicker(monitoringInterval)
 	defer ticker.Stop()
 	for {
 		s.runMonitoringCollectorOnce()
-		<-ticker.C
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
 func (s *Server) runMonitoringCollectorOnce() {
-	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
+	ctx, cancel := context.WithTimeout(s.baseCtx, 90*time.Second)
 	defer cancel()
 	rows, err := s.DB.Sql().QueryContext(ctx, `
 		SELECT id FROM deployments WHERE game = ? AND status = ?
@@ -120,3 +120,41 @@ func RunCommandWithStdin(ctx context.Context, host, user, keyPath, command strin
 	cmd.Stderr = nil
 	return cmd.Run()
 }
+
+// RunScript runs command on host with stdin from r and calls onLine for each
+// line of its combined stdout/stderr, as it is produced. Unlike
+// StreamCommand, the command's exit status is returned.
+func RunScript(ctx context.Context, host, user, keyPath, command string, r io.Reader, onLine func(line string)) error {
+	if keyPath == "" {
+		keyPath = KeyPath()
+	}
+	args := []string{
+		"-i", keyPath,
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "ConnectTimeout=15",
+		"-o", "ServerAliveInterval=15",
+		fmt.Sprintf("%s@%s", user, host),
+		command,
+	}
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdin = r
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			onLine(scanner.Text())
+		}
+		// Vide le pipe si le scanner s'arrête (ligne trop longue) pour ne pas bloquer ssh.
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+	err := cmd.Run()
+	_ = pw.Close()
+	<-done
+	return err
+}
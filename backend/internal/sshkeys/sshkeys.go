@@ -34,6 +34,16 @@ func EnsureKeyPair() (string, error) {
 	return strings.TrimSpace(string(pub)), nil
 }
 
+// PublicKey returns the public key of the app-managed key pair, without
+// generating it.
+func PublicKey() (string, error) {
+	pub, err := os.ReadFile(keyPathFromEnv() + ".pub")
+	if err != nil {
+		return "", fmt.Errorf("reading public key: %w", err)
+	}
+	return strings.TrimSpace(string(pub)), nil
+}
+
 // RegenerateKeyPair recreates the SSH key pair and returns the new public key.
 func RegenerateKeyPair() (string, error) {
 	path := keyPathFromEnv()